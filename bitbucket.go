@@ -0,0 +1,295 @@
+package gitfresh
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+)
+
+/* Bitbucket Cloud Provider */
+type BitbucketProvider struct {
+	logs       AppLogger
+	httpClient HttpClienter
+	host       string
+	apiURL     string
+	webURL     string
+	token      string
+}
+
+type bitbucketHook struct {
+	UUID        string   `json:"uuid,omitempty"`
+	Description string   `json:"description"`
+	URL         string   `json:"url"`
+	Active      bool     `json:"active"`
+	Events      []string `json:"events"`
+	Secret      string   `json:"secret,omitempty"`
+}
+
+type bitbucketPushPayload struct {
+	Repository struct {
+		Name     string `json:"name"`
+		FullName string `json:"full_name"`
+	} `json:"repository"`
+	Push struct {
+		Changes []struct {
+			New *struct {
+				Type   string `json:"type"`
+				Name   string `json:"name"`
+				Target struct {
+					Hash string `json:"hash"`
+				} `json:"target"`
+			} `json:"new"`
+		} `json:"changes"`
+	} `json:"push"`
+}
+
+/*
+NewBitbucketProvider accepts a repository/workspace access token or
+an app password written as "username:app_password"
+*/
+func NewBitbucketProvider(l AppLogger, c HttpClienter, server GitServerConfig) *BitbucketProvider {
+	return &BitbucketProvider{
+		logs:       l,
+		httpClient: c,
+		host:       server.Host,
+		apiURL:     strings.TrimSuffix(server.APIURL, "/"),
+		webURL:     strings.TrimSuffix(server.WebURL, "/"),
+		token:      server.Token,
+	}
+}
+
+func (p BitbucketProvider) Host() string {
+	return p.host
+}
+
+func (p BitbucketProvider) RepositoryURL(repo *GitRepository) string {
+	return fmt.Sprintf("%s/%s/%s", p.webURL, repo.Owner, repo.Name)
+}
+
+func (p BitbucketProvider) HooksPageURL(repo *GitRepository) string {
+	return p.RepositoryURL(repo) + "/admin/webhooks"
+}
+
+func (p BitbucketProvider) hooksURL(repo *GitRepository) string {
+	return fmt.Sprintf("%s/repositories/%s/%s/hooks", p.apiURL, repo.Owner, repo.Name)
+}
+
+func (p BitbucketProvider) newRequest(method, url string, body io.Reader) (*http.Request, error) {
+	req, err := http.NewRequest(method, url, body)
+	if err != nil {
+		p.logs.Error(err.Error())
+		return nil, err
+	}
+	if strings.Contains(p.token, ":") {
+		req.Header.Set("Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(p.token)))
+	} else {
+		req.Header.Set("Authorization", "Bearer "+p.token)
+	}
+	req.Header.Set("Accept", "application/json")
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	return req, nil
+}
+
+/* CheckToken tells who the token belongs to, the access tokens list their scopes on X-OAuth-Scopes */
+func (p BitbucketProvider) CheckToken() (TokenCheck, error) {
+	req, err := p.newRequest("GET", p.apiURL+"/user", nil)
+	if err != nil {
+		return TokenCheck{}, err
+	}
+	user, header, err := tokenUser(p.httpClient, req, "username")
+	if err != nil {
+		return TokenCheck{}, err
+	}
+	check := TokenCheck{User: user}
+	scopes := header.Values("X-OAuth-Scopes")
+	if len(scopes) < 1 {
+		check.Note = "the scopes of the token can't be read, it needs the webhook scope"
+		return check, nil
+	}
+	if !hasScope(strings.Join(scopes, ","), "webhook") {
+		check.Missing = append(check.Missing, "webhook scope")
+	}
+	return check, nil
+}
+
+func (p BitbucketProvider) listHooks(repo *GitRepository) ([]bitbucketHook, error) {
+	hooks := []bitbucketHook{}
+	next := p.hooksURL(repo)
+	for next != "" {
+		req, err := p.newRequest("GET", next, nil)
+		if err != nil {
+			return nil, err
+		}
+		resp, err := p.httpClient.Do(req)
+		if err != nil {
+			p.logs.Error(err.Error())
+			return nil, err
+		}
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			return nil, errors.New("listing bitbucket hooks via http, response with " + resp.Status)
+		}
+		var page struct {
+			Values []bitbucketHook `json:"values"`
+			Next   string          `json:"next"`
+		}
+		err = json.NewDecoder(resp.Body).Decode(&page)
+		resp.Body.Close()
+		if err != nil {
+			p.logs.Error(err.Error())
+			return nil, err
+		}
+		hooks = append(hooks, page.Values...)
+		next = page.Next
+	}
+	return hooks, nil
+}
+
+func (p BitbucketProvider) CreateHook(repo *GitRepository, hookURL string, secret string) error {
+	/* Bitbucket accepts duplicated hooks, so look for ours before creating it */
+	hooks, err := p.listHooks(repo)
+	if err != nil {
+		return err
+	}
+	for _, h := range hooks {
+		if h.URL == hookURL {
+			p.logs.Info("hook already exists on this repository", "repo", repo.Name, "hook_uuid", h.UUID)
+			return nil
+		}
+	}
+	jsonData, err := json.Marshal(bitbucketHook{
+		Description: "gitfresh",
+		URL:         hookURL,
+		Active:      true,
+		Events:      []string{"repo:push"},
+		Secret:      secret,
+	})
+	if err != nil {
+		p.logs.Error(err.Error())
+		return err
+	}
+	req, err := p.newRequest("POST", p.hooksURL(repo), bytes.NewBuffer(jsonData))
+	if err != nil {
+		return err
+	}
+	resp, err := p.httpClient.Do(req)
+	if err != nil {
+		p.logs.Error(err.Error())
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		rb, _ := io.ReadAll(resp.Body)
+		p.logs.Info(string(rb), "url", p.hooksURL(repo))
+		return errors.New("creating bitbucket webhook via http, response with " + resp.Status)
+	}
+	return nil
+}
+
+func (p BitbucketProvider) ListHooks(repo *GitRepository) ([]Hook, error) {
+	hooks, err := p.listHooks(repo)
+	if err != nil {
+		return nil, err
+	}
+	list := []Hook{}
+	for _, h := range hooks {
+		list = append(list, Hook{ID: h.UUID, URL: h.URL, Active: h.Active})
+	}
+	return list, nil
+}
+
+func (p BitbucketProvider) UpdateHook(repo *GitRepository, id string, hookURL string, secret string) error {
+	jsonData, err := json.Marshal(bitbucketHook{
+		Description: "gitfresh",
+		URL:         hookURL,
+		Active:      true,
+		Events:      []string{"repo:push"},
+		Secret:      secret,
+	})
+	if err != nil {
+		p.logs.Error(err.Error())
+		return err
+	}
+	return p.send("PUT", p.hookURL(repo, id), bytes.NewBuffer(jsonData), http.StatusOK)
+}
+
+func (p BitbucketProvider) DeleteHook(repo *GitRepository, id string) error {
+	return p.send("DELETE", p.hookURL(repo, id), nil, http.StatusNoContent)
+}
+
+/* The hook uuid comes with braces */
+func (p BitbucketProvider) hookURL(repo *GitRepository, uuid string) string {
+	return p.hooksURL(repo) + "/" + url.PathEscape(uuid)
+}
+
+func (p BitbucketProvider) send(method string, url string, body io.Reader, want int) error {
+	req, err := p.newRequest(method, url, body)
+	if err != nil {
+		return err
+	}
+	resp, err := p.httpClient.Do(req)
+	if err != nil {
+		p.logs.Error(err.Error())
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != want {
+		rb, _ := io.ReadAll(resp.Body)
+		p.logs.Info(string(rb), "url", url)
+		return errors.New(strings.ToLower(method) + " bitbucket webhook via http, response with " + resp.Status)
+	}
+	return nil
+}
+
+func (p BitbucketProvider) IsDelivery(r *http.Request, body []byte) bool {
+	return r.Header.Get("X-Event-Key") != ""
+}
+
+func (p BitbucketProvider) VerifyDelivery(r *http.Request, body []byte, secret string) error {
+	signature, found := strings.CutPrefix(r.Header.Get("X-Hub-Signature"), "sha256=")
+	if !found || !validHMACSHA256(signature, body, secret) {
+		return ErrInvalidSignature
+	}
+	return nil
+}
+
+func (p BitbucketProvider) ParsePush(r *http.Request, body []byte) ([]*APIPayload, error) {
+	event := r.Header.Get("X-Event-Key")
+	if event != "repo:push" {
+		p.logs.Info("ignoring bitbucket event", "event", event, "hook_uuid", r.Header.Get("X-Hook-UUID"))
+		return nil, ErrEventIgnored
+	}
+	var push bitbucketPushPayload
+	if err := json.Unmarshal(body, &push); err != nil {
+		p.logs.Error(err.Error())
+		return nil, err
+	}
+	payloads := []*APIPayload{}
+	for _, change := range push.Push.Changes {
+		/* Deleted branches come without new state and tags are not pulled */
+		if change.New == nil || change.New.Type != "branch" {
+			continue
+		}
+		payloads = append(payloads, &APIPayload{
+			Ref:    "refs/heads/" + change.New.Name,
+			Commit: change.New.Target.Hash,
+			Repository: APIRepository{
+				Name:     path.Base(push.Repository.FullName),
+				FullName: push.Repository.FullName,
+			},
+		})
+	}
+	if len(payloads) < 1 {
+		return nil, ErrEventIgnored
+	}
+	return payloads, nil
+}
@@ -3,26 +3,99 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"io"
 	"log/slog"
 	"net"
 	"net/http"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"slices"
+	"strings"
 	"sync"
+	"syscall"
 	"time"
 
 	"github.com/apolo96/gitfresh"
-	"golang.ngrok.com/ngrok"
-	"golang.ngrok.com/ngrok/config"
 )
 
 type ServiceProvider struct {
+	appOS         gitfresh.OSCommander
 	appConfig     *gitfresh.AppConfigSvc
-	gitRepository *gitfresh.GitRepositorySvc
+	gitRepository registryFunc
+	gitServer     *gitfresh.GitServerSvc
+	updates       *gitfresh.UpdateSvc
+	poller        *gitfresh.PollerSvc
+	history       *gitfresh.DeliveryLogSvc
+	dedup         *gitfresh.DedupSvc
+	queue         *updateQueue
+	pulls         *coalescer
 }
 
+/* Time given to the queued updates when the agent is stopped */
+const drainTimeout = time.Minute
+
+func newServiceProvider(logger *slog.Logger, path string) *ServiceProvider {
+	gitServer := gitfresh.NewGitServerSvc(
+		logger,
+		&http.Client{Timeout: time.Second * 3},
+	)
+	provider := &ServiceProvider{
+		appOS: &gitfresh.AppOS{},
+		appConfig: gitfresh.NewAppConfigSvc(
+			logger, &gitfresh.FlatFile{
+				Name: gitfresh.APP_CONFIG_FILE_NAME,
+				Path: path,
+			},
+			gitfresh.NewSecretStores(logger, path)...,
+		),
+		gitRepository: func(workspace string) *gitfresh.GitRepositorySvc {
+			return gitfresh.NewGitRepositorySvc(
+				logger,
+				&gitfresh.AppOS{},
+				&gitfresh.FlatFile{
+					Name: gitfresh.RepositoriesFileName(workspace),
+					Path: path,
+				},
+			)
+		},
+		gitServer: gitServer,
+		updates: gitfresh.NewUpdateSvc(
+			logger, &gitfresh.FlatFile{
+				Name: gitfresh.APP_UPDATES_FILE,
+				Path: path,
+			},
+		),
+		poller: gitfresh.NewPollerSvc(logger, &gitfresh.AppOS{}, gitServer),
+		history: gitfresh.NewDeliveryLogSvc(
+			logger, &gitfresh.FlatFile{
+				Name: gitfresh.APP_DELIVERIES_FILE,
+				Path: path,
+			},
+		),
+		dedup: gitfresh.NewDedupSvc(
+			logger, &gitfresh.FlatFile{
+				Name: gitfresh.APP_DEDUP_FILE,
+				Path: path,
+			},
+			gitfresh.APP_DEDUP_LIMIT,
+		),
+	}
+	provider.queue = newUpdateQueue(
+		refresh(provider.gitRepository, provider.updates, provider.history, provider.dedup),
+		provider.history,
+		provider.dedup,
+		queueWorkers,
+		queueDepth,
+	)
+	provider.pulls = newCoalescer(provider.queue.pull, provider.history)
+	return provider
+}
+
+/* registryFunc gives the repository service backed by the registry of a workspace */
+type registryFunc func(workspace string) *gitfresh.GitRepositorySvc
+
 func run() error {
 	/* Logger */
 	println("Config Agent Logger")
@@ -38,6 +111,30 @@ func run() error {
 	slog.Info("Loading GitFresh Agent")
 	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
 	defer cancel()
+	/* gitfresh stop sends a SIGTERM */
+	stopCtx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	userPath, err := os.UserHomeDir()
+	if err != nil {
+		slog.Error("error getting user home directory", "error", err.Error())
+		return err
+	}
+	path := filepath.Join(userPath, gitfresh.APP_FOLDER)
+	if err := gitfresh.SecureAppFolder(path); err != nil {
+		slog.Warn("securing app folder", "error", err.Error())
+	}
+	provider := newServiceProvider(logger, path)
+	if err := provider.history.Trim(gitfresh.APP_DELIVERIES_LIMIT); err != nil {
+		slog.Error("trimming delivery log", "error", err.Error())
+	}
+	/* In-flight updates finish before the agent exits */
+	defer func() {
+		drainCtx, cancel := context.WithTimeout(context.Background(), drainTimeout)
+		defer cancel()
+		if err := provider.queue.shutdown(drainCtx); err != nil {
+			slog.Error("draining update queue", "error", err.Error())
+		}
+	}()
 	/* tunnel to localserver  channel communication */
 	ch := make(chan string)
 	defer close(ch)
@@ -49,26 +146,7 @@ func run() error {
 	/* Start internet tunnel */
 	go func() {
 		slog.Info("Start Internet Tunnel")
-		userPath, err := os.UserHomeDir()
-		if err != nil {
-			slog.Error("error getting user home directory", "error", err.Error())
-			cancel()
-		}
-		path := filepath.Join(userPath, gitfresh.APP_FOLDER)
-		provider := &ServiceProvider{
-			appConfig: gitfresh.NewAppConfigSvc(
-				logger, &gitfresh.FlatFile{
-					Name: gitfresh.APP_CONFIG_FILE_NAME,
-					Path: path,
-				},
-			),
-			gitRepository: gitfresh.NewGitRepositorySvc(
-				logger,
-				&gitfresh.AppOS{},
-				&gitfresh.FlatFile{},
-			),
-		}
-		if err := tunnel(context.Background(), ch, provider, &wg); err != nil {
+		if err := tunnel(stopCtx, ch, provider, &wg); err != nil {
 			slog.Error("tunnel failed", "error", err.Error())
 			errch <- err
 		}
@@ -76,7 +154,7 @@ func run() error {
 	/* Start localserver */
 	go func() {
 		slog.Info("Start Local Serve")
-		if err := localserver(ch, &wg); err != nil {
+		if err := localserver(ch, &wg, provider); err != nil {
 			slog.Error("localserver failed", "error", err.Error())
 			errch <- err
 		}
@@ -94,20 +172,35 @@ func run() error {
 	case <-done:
 		slog.Info("servers are ready")
 	}
+	/* Pushes missed while the agent was stopped or the machine slept */
+	go catchUp(stopCtx, provider, lastDelivery(provider.history))
+	go watchResume(stopCtx, resumeTick, func(slept time.Time) {
+		catchUp(stopCtx, provider, slept)
+	})
+	go retireSecret(stopCtx, provider.appConfig, retireTick)
 	/* Waiting for errors from  tunnel or localserver */
-	return <-errch
+	err = <-errch
+	if stopCtx.Err() != nil {
+		slog.Info("agent stopped")
+		return nil
+	}
+	return err
 }
 
-func localserver(ch chan string, wg *sync.WaitGroup) error {
+func localserver(ch chan string, wg *sync.WaitGroup, provider *ServiceProvider) error {
 	url := <-ch
 	slog.Info("startup Local Serve then tunnel started")
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		data := fmt.Sprintf(`{"api_version":"1.0.0", "tunnel_domain":"%s"}`, url)
+		w.Header().Set("Content-type", "application/json")
+		w.Write([]byte(data))
+	})
+	mux.Handle("GET /deliveries", deliveries(provider.history))
+	mux.Handle("POST /refresh", manualRefresh(provider))
 	server := &http.Server{
-		Addr: gitfresh.API_AGENT_HOST,
-		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			data := fmt.Sprintf(`{"api_version":"1.0.0", "tunnel_domain":"%s"}`, url)
-			w.Header().Set("Content-type", "application/json")
-			w.Write([]byte(data))
-		}),
+		Addr:    gitfresh.API_AGENT_HOST,
+		Handler: mux,
 	}
 	listener, err := net.Listen("tcp", server.Addr)
 	if err != nil {
@@ -131,59 +224,343 @@ func tunnel(ctx context.Context,
 		slog.Error(err.Error())
 		return err
 	}
-	slog.Debug("load agent config from file", "config", fmt.Sprint(conf))
-	os.Setenv("NGROK_AUTHTOKEN", conf.TunnelToken)
-	listener, err := ngrok.Listen(ctx,
-		config.HTTPEndpoint(
-			config.WithWebhookVerification("github", conf.GitHookSecret),
-			config.WithDomain(conf.TunnelDomain),
-		),
-		ngrok.WithAuthtokenFromEnv(),
-	)
+	slog.Debug("load agent config from file", "agent_mode", conf.AgentMode, "tunnel_kind", conf.TunnelKind)
+	if conf.AgentMode == gitfresh.AGENT_MODE_POLL {
+		return poll(ctx, ch, provider, wg)
+	}
+	if conf.AgentMode == gitfresh.AGENT_MODE_RELAY {
+		return subscribe(ctx, ch, provider, wg, conf)
+	}
+	/* The handler verifies every delivery, ngrok also rejects bad GitHub signatures at the edge */
+	t, err := newTunnel(conf, provider.appOS, gitfresh.EdgeVerifiesGitHub(conf, time.Now()))
+	if err != nil {
+		slog.Error("configuring tunnel", "error", err.Error())
+		return err
+	}
+	listener, url, err := t.Listen(ctx)
 	if err != nil {
-		slog.Error("listening tunnel", "error", err.Error())
+		slog.Error("listening tunnel", "error", err.Error(), "kind", conf.TunnelKind)
 		return err
 	}
-	ch <- listener.URL()
+	defer t.Close()
+	/* Stopping the agent closes the listener so the tunnel program is stopped too */
+	go func() {
+		<-ctx.Done()
+		listener.Close()
+	}()
+	/* The hooks follow the domain ngrok gave to the agent */
+	changed, err := adoptTunnelURL(provider.appConfig, url)
+	if err != nil {
+		slog.Error("saving tunnel domain", "error", err.Error())
+	}
+	if changed {
+		go syncHooks(provider)
+	}
+	ch <- url
 	wg.Done()
-	println("Tunnel Listening on " + listener.URL())
-	slog.Info("Tunnel Listening on " + listener.URL())
-	return http.Serve(listener, handler(provider.appConfig, provider.gitRepository))
+	println("Tunnel Listening on " + url)
+	slog.Info("Tunnel Listening on " + url)
+	err = http.Serve(listener, handler(provider.appConfig, provider.gitRepository, provider.gitServer, provider.history, provider.dedup, provider.pulls))
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
 }
 
-func handler(appConfig *gitfresh.AppConfigSvc, git *gitfresh.GitRepositorySvc) http.Handler {
+func handler(
+	appConfig *gitfresh.AppConfigSvc,
+	registry registryFunc,
+	gitServer *gitfresh.GitServerSvc,
+	history *gitfresh.DeliveryLogSvc,
+	dedup *gitfresh.DedupSvc,
+	pulls *coalescer,
+) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		if r.Header.Get("X-GitHub-Event") == "ping" {
-			slog.Info("handling ping", "hook_id", r.Header.Get("X-GitHub-Hook-ID"))
+		received := time.Now()
+		id := gitfresh.DeliveryID(r)
+		app, err := appConfig.LoadConfigFile()
+		if err != nil {
+			slog.Error(err.Error())
+			http.Error(w, "error loading agent config", http.StatusInternalServerError)
+			return
+		}
+		webhooks, err := gitServer.ParseWebhook(r, app)
+		if errors.Is(err, gitfresh.ErrEventIgnored) {
 			w.WriteHeader(http.StatusOK)
 			return
 		}
-		slog.Info("handling webhook", "hook_id", r.Header.Get("X-GitHub-Hook-ID"))
-		form, err := io.ReadAll(r.Body)
 		if err != nil {
-			slog.Error(err.Error())
-			http.Error(w, "error reading request data", http.StatusBadRequest)
+			record(history, gitfresh.Delivery{ID: id, Received: received, Outcome: gitfresh.DELIVERY_REJECTED, Reason: err.Error()})
+		}
+		if errors.Is(err, gitfresh.ErrInvalidSignature) {
+			http.Error(w, "invalid webhook signature", http.StatusUnauthorized)
 			return
 		}
-		var webhook gitfresh.APIPayload
-		if err := json.Unmarshal([]byte(form), &webhook); err != nil {
+		if err != nil {
 			slog.Error(err.Error())
 			http.Error(w, "error parsing data form", http.StatusBadRequest)
 			return
 		}
-		slog.Info(
-			"payload form data",
-			"branch", webhook.Ref,
-			"repository", webhook.Repository.Name,
-			"last_commit", webhook.Commit[:7],
-		)
+		/* Duplicates are acknowledged, otherwise the git server keeps retrying */
+		duplicated, err := dedup.Seen(id)
+		if err != nil {
+			slog.Error("checking delivery id", "error", err.Error())
+		}
+		if duplicated {
+			slog.Info("ignoring duplicated delivery", "delivery", id)
+			w.WriteHeader(http.StatusOK)
+			return
+		}
 		w.WriteHeader(http.StatusOK)
-		go func() {
-			app, err := appConfig.ReadConfigFile()
+		repos := repositories(app, registry)
+		for _, webhook := range webhooks {
+			slog.Info(
+				"payload form data",
+				"branch", webhook.Ref,
+				"repository", webhook.Repository.FullName,
+				"provider", webhook.Provider,
+				"last_commit", webhook.Commit,
+			)
+			delivery := gitfresh.Delivery{
+				ID:         id,
+				Repository: webhook.Repository.FullName,
+				Provider:   webhook.Provider,
+				Ref:        webhook.Ref,
+				Commit:     webhook.Commit,
+				Received:   received,
+			}
+			matches := gitfresh.MatchRepositories(repos, webhook.Provider, webhook.Repository.FullName)
+			if len(matches) == 0 {
+				/* An organization hook also sends the pushes of the repositories cloned after the last scan */
+				slog.Warn(
+					"ignoring push for unregistered repository, run gitfresh scan to register its clone",
+					"repository", webhook.Repository.FullName,
+					"provider", webhook.Provider,
+				)
+				delivery.Outcome = gitfresh.DELIVERY_IGNORED
+				delivery.Reason = "unregistered repository, run gitfresh scan to register its clone"
+				record(history, delivery)
+				continue
+			}
+			for _, repo := range matches {
+				slog.Info("pulling repository", "path", repo.Path, "workspace", repo.Workspace)
+				pulls.push(repo, delivery)
+			}
+		}
+	})
+}
+
+/* refreshFunc pulls a clone for a delivery */
+type refreshFunc func(repo *gitfresh.GitRepository, delivery gitfresh.Delivery) error
+
+/* refresh pulls a clone with its workspace registry and records the result */
+func refresh(registry registryFunc, updates *gitfresh.UpdateSvc, history *gitfresh.DeliveryLogSvc, dedup *gitfresh.DedupSvc) refreshFunc {
+	return func(repo *gitfresh.GitRepository, delivery gitfresh.Delivery) error {
+		start := time.Now()
+		output, err := registry(repo.Workspace).Pull(repo, delivery.Ref)
+		if errors.Is(err, gitfresh.ErrUpdateSkipped) {
+			slog.Warn("working copy not updated", "path", repo.Path, "reason", err.Error())
+		}
+		if err := updates.Record(repo, delivery.Ref, err); err != nil {
+			slog.Error("recording repository update", "error", err.Error())
+		}
+		delivery.Path = repo.Path
+		delivery.Output = output
+		delivery.Duration = time.Since(start)
+		delivery.Outcome, delivery.Reason = gitfresh.PullOutcome(err)
+		record(history, delivery)
+		if err != nil && !errors.Is(err, gitfresh.ErrUpdateSkipped) {
+			forget(dedup, delivery)
+		}
+		return err
+	}
+}
+
+func record(history *gitfresh.DeliveryLogSvc, delivery gitfresh.Delivery) {
+	if err := history.Record(delivery); err != nil {
+		slog.Error("recording delivery", "error", err.Error())
+	}
+}
+
+/* forget lets a redelivery of a failed delivery through, GitHub keeps the delivery id */
+func forget(dedup *gitfresh.DedupSvc, delivery gitfresh.Delivery) {
+	if err := dedup.Forget(delivery.ID); err != nil {
+		slog.Error("forgetting delivery", "error", err.Error())
+	}
+}
+
+/* deliveries serves the delivery log to gitfresh history */
+func deliveries(history *gitfresh.DeliveryLogSvc) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		filter := gitfresh.DeliveryFilter{
+			Repository: r.URL.Query().Get("repo"),
+			Failed:     r.URL.Query().Get("failed") == "true",
+		}
+		if since := r.URL.Query().Get("since"); since != "" {
+			t, err := time.Parse(time.RFC3339, since)
 			if err != nil {
-				slog.Error(err.Error())
+				http.Error(w, "invalid since, use RFC3339", http.StatusBadRequest)
+				return
+			}
+			filter.Since = t
+		}
+		list, err := history.Deliveries(filter)
+		if err != nil {
+			slog.Error("reading delivery log", "error", err.Error())
+			http.Error(w, "error reading the delivery log", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-type", "application/json")
+		json.NewEncoder(w).Encode(list)
+	})
+}
+
+/*
+manualRefresh updates the requested repositories through the update queue like
+a push, streaming a JSON line when an update is queued and when it is done
+*/
+func manualRefresh(provider *ServiceProvider) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		refresh := gitfresh.RefreshRequest{}
+		if err := json.NewDecoder(r.Body).Decode(&refresh); err != nil {
+			http.Error(w, "error decoding the refresh request", http.StatusBadRequest)
+			return
+		}
+		if !refresh.All && len(refresh.Repositories) == 0 {
+			http.Error(w, "name the repositories to refresh or refresh them all", http.StatusBadRequest)
+			return
+		}
+		app, err := provider.appConfig.LoadConfigFile()
+		if err != nil {
+			slog.Error(err.Error())
+			http.Error(w, "error loading agent config", http.StatusInternalServerError)
+			return
+		}
+		selected, unknown := selectRepositories(repositories(app, provider.gitRepository), refresh)
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		encoder := json.NewEncoder(w)
+		flusher, _ := w.(http.Flusher)
+		send := func(event gitfresh.RefreshEvent) {
+			encoder.Encode(event)
+			if flusher != nil {
+				flusher.Flush()
 			}
-			git.Pull(app.GitWorkDir, webhook.Repository.Name, webhook.Ref)
+		}
+		for _, name := range unknown {
+			send(gitfresh.RefreshEvent{Repository: name, Status: gitfresh.UPDATE_STATUS_FAILED, Reason: "repository not registered"})
+		}
+		events := make(chan gitfresh.RefreshEvent)
+		var wg sync.WaitGroup
+		for _, repo := range selected {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				event := gitfresh.RefreshEvent{Repository: repo.Owner + "/" + repo.Name, Path: repo.Path}
+				ref, err := provider.gitRepository(repo.Workspace).CurrentBranch(repo)
+				if err == nil {
+					event.Branch = strings.TrimPrefix(ref, "refs/heads/")
+					event.Status = gitfresh.REFRESH_QUEUED
+					events <- event
+					err = provider.queue.pull(repo, gitfresh.Delivery{
+						ID:         "manual",
+						Repository: event.Repository,
+						Provider:   repo.Provider,
+						Ref:        ref,
+						Received:   time.Now(),
+					})
+				}
+				event.Status, event.Reason = gitfresh.PullOutcome(err)
+				events <- event
+			}()
+		}
+		go func() {
+			wg.Wait()
+			close(events)
 		}()
+		for event := range events {
+			send(event)
+		}
 	})
 }
+
+/* selectRepositories finds the clones by owner/name or name, giving the names not registered */
+func selectRepositories(repos []*gitfresh.GitRepository, refresh gitfresh.RefreshRequest) ([]*gitfresh.GitRepository, []string) {
+	if refresh.All {
+		return repos, nil
+	}
+	selected, unknown := []*gitfresh.GitRepository{}, []string{}
+	for _, name := range refresh.Repositories {
+		found := false
+		for _, r := range repos {
+			if strings.EqualFold(r.Owner+"/"+r.Name, name) || strings.EqualFold(r.Name, name) {
+				found = true
+				if !slices.Contains(selected, r) {
+					selected = append(selected, r)
+				}
+			}
+		}
+		if !found {
+			unknown = append(unknown, name)
+		}
+	}
+	return selected, unknown
+}
+
+/* poll refreshes the repositories without tunnel until the agent is stopped */
+func poll(ctx context.Context, ch chan<- string, provider *ServiceProvider, wg *sync.WaitGroup) error {
+	ch <- ""
+	wg.Done()
+	println("Polling repositories")
+	slog.Info("Polling repositories")
+	for {
+		/* The registries are read every time to poll the repositories added by gitfresh scan */
+		app, err := provider.appConfig.LoadConfigFile()
+		if err != nil {
+			return err
+		}
+		repos := repositories(app, provider.gitRepository)
+		slog.Debug("polling repositories", "count", len(repos))
+		provider.poller.Poll(ctx, repos, app, func(repo *gitfresh.GitRepository, ref string) error {
+			return provider.queue.pull(repo, gitfresh.Delivery{ID: "poll", Repository: repo.Owner + "/" + repo.Name, Provider: repo.Provider, Ref: ref, Received: time.Now()})
+		})
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(provider.poller.Next(repos, app)):
+		}
+	}
+}
+
+/*
+repositories loads the registries of every workspace, registries saved by older
+versions have no path so the clone is expected under the workspace directory
+*/
+func repositories(app *gitfresh.AppConfig, registry registryFunc) []*gitfresh.GitRepository {
+	all := []*gitfresh.GitRepository{}
+	for _, workspace := range gitfresh.WorkspaceNames(app) {
+		ws, err := gitfresh.Workspace(app, workspace)
+		if err != nil {
+			slog.Error(err.Error())
+			continue
+		}
+		repos, err := registry(workspace).LoadRepositories()
+		if err != nil {
+			slog.Error("loading repositories", "workspace", workspace, "error", err.Error())
+			continue
+		}
+		for _, r := range repos {
+			r.Workspace = workspace
+			if r.Path == "" {
+				r.Path = filepath.Join(ws.GitWorkDir, r.Name)
+			}
+			if r.Provider == "" {
+				r.Provider = gitfresh.APP_GIT_PROVIDER
+			}
+			if r.Strategy == "" {
+				r.Strategy = ws.GitStrategy
+			}
+			all = append(all, r)
+		}
+	}
+	return all
+}
@@ -0,0 +1,351 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/apolo96/gitfresh"
+	"github.com/google/go-cmp/cmp"
+)
+
+/* memFile keeps a flat file in memory */
+type memFile struct {
+	mu   sync.Mutex
+	data []byte
+}
+
+func (f *memFile) Write(data []byte) (n int, err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.data = data
+	return len(data), nil
+}
+
+func (f *memFile) Read() (n []byte, err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.data == nil {
+		return nil, fs.ErrNotExist
+	}
+	return f.data, nil
+}
+
+func (f *memFile) Append(data []byte) (n int, err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.data = append(f.data, data...)
+	return len(data), nil
+}
+
+/* gitOS records the git commands run by the agent */
+type gitOS struct {
+	commands chan string
+}
+
+func (o gitOS) RunProgram(path string, workdir string, args ...string) ([]byte, error) {
+	cmd := workdir + ": git " + strings.Join(args, " ")
+	o.commands <- cmd
+	if strings.HasPrefix(cmd, workdir+": git rev-parse --abbrev-ref") {
+		return []byte("main\n"), nil
+	}
+	return nil, nil
+}
+
+func (o gitOS) LookProgram(cmd string) (string, error) {
+	return "/usr/bin/git", nil
+}
+
+func (o gitOS) DirFS(path string) fs.FS {
+	return fstest.MapFS{".git/HEAD": &fstest.MapFile{}}
+}
+
+const testSecret = "s3cr3t"
+
+/* testProvider gives the agent services with a clone of apolo96/gitfresh in /code/gitfresh */
+func testProvider(t *testing.T) (*ServiceProvider, chan string) {
+	t.Helper()
+	logger := slog.New(slog.NewJSONHandler(&strings.Builder{}, nil))
+	config, _ := json.Marshal(&gitfresh.AppConfig{
+		GitServerToken: "ghp",
+		GitWorkDir:     "/code",
+		GitHookSecret:  testSecret,
+	})
+	repos, _ := json.Marshal([]*gitfresh.GitRepository{
+		{Owner: "apolo96", Name: "gitfresh", Provider: "github.com", Path: "/code/gitfresh"},
+	})
+	commands := make(chan string, 10)
+	provider := &ServiceProvider{
+		appConfig: gitfresh.NewAppConfigSvc(logger, &memFile{data: config}),
+		gitRepository: func(workspace string) *gitfresh.GitRepositorySvc {
+			return gitfresh.NewGitRepositorySvc(logger, gitOS{commands: commands}, &memFile{data: repos})
+		},
+		gitServer: gitfresh.NewGitServerSvc(logger, &http.Client{}),
+		updates:   gitfresh.NewUpdateSvc(logger, &memFile{}),
+		history:   gitfresh.NewDeliveryLogSvc(logger, &memFile{}),
+		dedup:     gitfresh.NewDedupSvc(logger, &memFile{}, 10),
+	}
+	provider.queue = newUpdateQueue(
+		refresh(provider.gitRepository, provider.updates, provider.history, provider.dedup),
+		provider.history,
+		provider.dedup,
+		queueWorkers,
+		queueDepth,
+	)
+	t.Cleanup(func() { provider.queue.shutdown(context.Background()) })
+	coalesceWindow = time.Millisecond * 20
+	provider.pulls = newCoalescer(provider.queue.pull, provider.history)
+	return provider, commands
+}
+
+func testHandler(t *testing.T) (http.Handler, chan string, *gitfresh.DeliveryLogSvc) {
+	t.Helper()
+	provider, commands := testProvider(t)
+	return handler(
+		provider.appConfig,
+		provider.gitRepository,
+		provider.gitServer,
+		provider.history,
+		provider.dedup,
+		provider.pulls,
+	), commands, provider.history
+}
+
+func sign(body string, secret string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(body))
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func TestHandler_Signature(t *testing.T) {
+	push := `{"ref":"refs/heads/main","after":"9a8b7c6d","repository":{"name":"gitfresh","full_name":"apolo96/gitfresh"}}`
+	tests := []struct {
+		name     string
+		body     string
+		headers  map[string]string
+		want     int
+		wantPull bool
+	}{
+		{
+			name:     "signed push",
+			body:     push,
+			headers:  map[string]string{"X-Hub-Signature-256": sign(push, testSecret)},
+			want:     http.StatusOK,
+			wantPull: true,
+		},
+		{
+			name:    "tampered payload",
+			body:    strings.Replace(push, "apolo96/gitfresh", "apolo96/other", 1),
+			headers: map[string]string{"X-Hub-Signature-256": sign(push, testSecret)},
+			want:    http.StatusUnauthorized,
+		},
+		{
+			name:    "signed with another secret",
+			body:    push,
+			headers: map[string]string{"X-Hub-Signature-256": sign(push, "guess")},
+			want:    http.StatusUnauthorized,
+		},
+		{
+			name:    "sha1 signature only",
+			body:    push,
+			headers: map[string]string{"X-Hub-Signature": "sha1=0123456789abcdef"},
+			want:    http.StatusUnauthorized,
+		},
+		{
+			name: "unsigned push",
+			body: push,
+			want: http.StatusUnauthorized,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h, commands, _ := testHandler(t)
+			server := httptest.NewServer(h)
+			defer server.Close()
+			req, _ := http.NewRequest("POST", server.URL, strings.NewReader(tt.body))
+			req.Header.Set("Content-Type", "application/json")
+			req.Header.Set("X-GitHub-Event", "push")
+			for k, v := range tt.headers {
+				req.Header.Set(k, v)
+			}
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != tt.want {
+				t.Fatalf("handler() status = %d, want %d", resp.StatusCode, tt.want)
+			}
+			select {
+			case cmd := <-commands:
+				if !tt.wantPull {
+					t.Fatalf("handler() ran %q for a rejected delivery", cmd)
+				}
+				if !strings.HasPrefix(cmd, "/code/gitfresh: git") {
+					t.Errorf("handler() ran %q", cmd)
+				}
+			case <-time.After(time.Millisecond * 200):
+				if tt.wantPull {
+					t.Fatal("handler() did not update the repository")
+				}
+			}
+		})
+	}
+}
+
+func TestHandler_History(t *testing.T) {
+	h, commands, history := testHandler(t)
+	server := httptest.NewServer(h)
+	defer server.Close()
+	deliver := func(id string, body string, signature string) {
+		req, _ := http.NewRequest("POST", server.URL, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("X-GitHub-Event", "push")
+		req.Header.Set("X-GitHub-Delivery", id)
+		req.Header.Set("X-Hub-Signature-256", signature)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+	push := `{"ref":"refs/heads/main","after":"9a8b7c6d","repository":{"name":"gitfresh","full_name":"apolo96/gitfresh"}}`
+	other := strings.Replace(push, "apolo96/gitfresh", "apolo96/other", 1)
+	deliver("d-1", push, sign(push, testSecret))
+	deliver("d-2", other, sign(other, testSecret))
+	deliver("d-3", push, sign(push, "guess"))
+	/* Waiting for the pull of d-1 */
+	for cmd := range commands {
+		if strings.Contains(cmd, "pull") {
+			break
+		}
+	}
+	deadline := time.Now().Add(time.Second * 2)
+	var list []gitfresh.Delivery
+	for {
+		list, _ = history.Deliveries(gitfresh.DeliveryFilter{})
+		if len(list) == 3 || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	outcomes := map[string]string{}
+	for _, d := range list {
+		outcomes[d.ID] = d.Outcome
+	}
+	want := map[string]string{
+		"d-1": gitfresh.UPDATE_STATUS_UPDATED,
+		"d-2": gitfresh.DELIVERY_IGNORED,
+		"d-3": gitfresh.DELIVERY_REJECTED,
+	}
+	if diff := cmp.Diff(outcomes, want); diff != "" {
+		t.Error("handler() deliveries = ", diff)
+	}
+	rec := httptest.NewRecorder()
+	deliveries(history).ServeHTTP(rec, httptest.NewRequest("GET", "/deliveries?failed=true", nil))
+	failed := []gitfresh.Delivery{}
+	json.NewDecoder(rec.Body).Decode(&failed)
+	if len(failed) != 1 || failed[0].ID != "d-3" {
+		t.Errorf("deliveries() = %+v, want the rejected delivery", failed)
+	}
+}
+
+func TestHandler_Duplicates(t *testing.T) {
+	h, commands, history := testHandler(t)
+	server := httptest.NewServer(h)
+	defer server.Close()
+	deliver := func(id string, body string) {
+		req, _ := http.NewRequest("POST", server.URL, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("X-GitHub-Event", "push")
+		req.Header.Set("X-GitHub-Delivery", id)
+		req.Header.Set("X-Hub-Signature-256", sign(body, testSecret))
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("handler() status = %d, want %d", resp.StatusCode, http.StatusOK)
+		}
+	}
+	push := `{"ref":"refs/heads/main","after":"%s","repository":{"name":"gitfresh","full_name":"apolo96/gitfresh"}}`
+	/* A retried delivery and a burst of pushes to main */
+	deliver("d-1", fmt.Sprintf(push, "1111"))
+	deliver("d-1", fmt.Sprintf(push, "1111"))
+	deliver("d-2", fmt.Sprintf(push, "2222"))
+	deliver("d-3", fmt.Sprintf(push, "3333"))
+	pulls := 0
+	timeout := time.After(time.Millisecond * 300)
+	for done := false; !done; {
+		select {
+		case cmd := <-commands:
+			if strings.Contains(cmd, "git pull") {
+				pulls++
+			}
+		case <-timeout:
+			done = true
+		}
+	}
+	if pulls != 1 {
+		t.Errorf("handler() pulled %d times, want 1", pulls)
+	}
+	list, _ := history.Deliveries(gitfresh.DeliveryFilter{})
+	outcomes := map[string]string{}
+	for _, d := range list {
+		outcomes[d.ID] = d.Outcome
+	}
+	want := map[string]string{
+		"d-1": gitfresh.DELIVERY_COALESCED,
+		"d-2": gitfresh.DELIVERY_COALESCED,
+		"d-3": gitfresh.UPDATE_STATUS_UPDATED,
+	}
+	if diff := cmp.Diff(outcomes, want); diff != "" {
+		t.Error("handler() deliveries = ", diff)
+	}
+}
+
+func TestManualRefresh(t *testing.T) {
+	provider, commands := testProvider(t)
+	go func() {
+		for range commands {
+		}
+	}()
+	body := `{"Repositories":["gitfresh","apolo96/unknown"]}`
+	rec := httptest.NewRecorder()
+	manualRefresh(provider).ServeHTTP(rec, httptest.NewRequest("POST", "/refresh", strings.NewReader(body)))
+	events := []string{}
+	decoder := json.NewDecoder(rec.Body)
+	for decoder.More() {
+		event := gitfresh.RefreshEvent{}
+		if err := decoder.Decode(&event); err != nil {
+			t.Fatal(err)
+		}
+		events = append(events, event.Repository+" "+event.Branch+" "+event.Status)
+	}
+	want := []string{
+		"apolo96/unknown  failed",
+		"apolo96/gitfresh main queued",
+		"apolo96/gitfresh main updated",
+	}
+	if diff := cmp.Diff(events, want); diff != "" {
+		t.Error("manualRefresh() events = ", diff)
+	}
+	rec = httptest.NewRecorder()
+	manualRefresh(provider).ServeHTTP(rec, httptest.NewRequest("POST", "/refresh", strings.NewReader(`{}`)))
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("manualRefresh() without repositories status = %d, want %d", rec.Code, http.StatusBadRequest)
+	}
+}
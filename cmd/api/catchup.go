@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/apolo96/gitfresh"
+)
+
+/* The wall clock is checked every tick, the monotonic clock stops while the machine sleeps */
+const resumeTick = time.Second * 30
+const resumeThreshold = time.Minute
+
+/* GitHub keeps the deliveries of a hook for 3 days */
+const redeliverWindow = time.Hour * 72
+
+/*
+catchUp applies the pushes missed while the agent was stopped or the machine
+slept, comparing every clone with its remote like the poll mode does. The
+failed GitHub deliveries since then are redelivered when enabled, with the
+token of the workspace of every repository.
+*/
+func catchUp(ctx context.Context, provider *ServiceProvider, since time.Time) {
+	app, err := provider.appConfig.LoadConfigFile()
+	if err != nil {
+		slog.Error("catching up", "error", err.Error())
+		return
+	}
+	/* The poll mode checks every clone anyway */
+	if app.AgentMode == gitfresh.AGENT_MODE_POLL {
+		return
+	}
+	repos := repositories(app, provider.gitRepository)
+	slog.Info("catching up missed pushes", "repositories", len(repos), "since", since.Format(time.RFC3339))
+	provider.poller.CatchUp(ctx, repos, app, func(repo *gitfresh.GitRepository, ref string) error {
+		return provider.queue.pull(repo, gitfresh.Delivery{
+			ID:         "catch-up",
+			Repository: repo.Owner + "/" + repo.Name,
+			Provider:   repo.Provider,
+			Ref:        ref,
+			Received:   time.Now(),
+		})
+	})
+	if !app.RedeliverFailed {
+		return
+	}
+	if oldest := time.Now().Add(-redeliverWindow); since.Before(oldest) {
+		since = oldest
+	}
+	/* Every clone of a repository shares its hook */
+	done := map[string]bool{}
+	for _, repo := range repos {
+		key := strings.ToLower(repo.Provider + "/" + repo.Owner + "/" + repo.Name)
+		if done[key] {
+			continue
+		}
+		done[key] = true
+		config, err := gitfresh.Workspace(app, repo.Workspace)
+		if err != nil {
+			slog.Error(err.Error())
+			continue
+		}
+		n, err := provider.gitServer.RedeliverFailed(repo, since, config)
+		if errors.Is(err, errors.ErrUnsupported) {
+			continue
+		}
+		if err != nil {
+			slog.Warn("redelivering failed deliveries", "repository", key, "error", err.Error())
+			continue
+		}
+		if n > 0 {
+			slog.Info("failed deliveries redelivered", "repository", key, "count", n)
+		}
+	}
+}
+
+/* lastDelivery gives when the agent received its last delivery, the start of the redelivery window */
+func lastDelivery(history *gitfresh.DeliveryLogSvc) time.Time {
+	list, err := history.Deliveries(gitfresh.DeliveryFilter{})
+	if err != nil || len(list) == 0 {
+		return time.Now().Add(-redeliverWindow)
+	}
+	return list[len(list)-1].Received
+}
+
+/* watchResume calls onResume with the time the machine went to sleep */
+func watchResume(ctx context.Context, tick time.Duration, onResume func(slept time.Time)) {
+	ticker := time.NewTicker(tick)
+	defer ticker.Stop()
+	last := time.Now().Round(0)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		now := time.Now().Round(0)
+		if resumed(last, now, tick) {
+			slog.Info("resumed from sleep", "slept", now.Sub(last).Round(time.Second).String())
+			onResume(last)
+		}
+		last = now
+	}
+}
+
+/* resumed compares wall clock readings, Round(0) strips the monotonic reading */
+func resumed(last time.Time, now time.Time, tick time.Duration) bool {
+	return now.Sub(last) > tick+resumeThreshold
+}
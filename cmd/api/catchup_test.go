@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/apolo96/gitfresh"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestResumed(t *testing.T) {
+	last := time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name string
+		now  time.Time
+		want bool
+	}{
+		{name: "regular tick", now: last.Add(resumeTick), want: false},
+		{name: "late tick", now: last.Add(resumeTick + time.Second*10), want: false},
+		{name: "night asleep", now: last.Add(time.Hour * 8), want: true},
+		{name: "clock set back", now: last.Add(-time.Hour), want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := resumed(last, tt.now, resumeTick); got != tt.want {
+				t.Errorf("resumed() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+/* clientFunc answers the git server requests of the agent */
+type clientFunc func(req *http.Request) (*http.Response, error)
+
+func (f clientFunc) Do(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+func TestCatchUp_Workspaces(t *testing.T) {
+	provider, commands := testProvider(t)
+	logger := slog.New(slog.NewJSONHandler(&strings.Builder{}, nil))
+	config, _ := json.Marshal(&gitfresh.AppConfig{
+		GitServerToken:  "ghp_personal",
+		GitWorkDir:      "/code",
+		RedeliverFailed: true,
+		Workspaces:      []gitfresh.WorkspaceConfig{{Name: "client", GitWorkDir: "/client", GitServerToken: "ghp_client"}},
+	})
+	provider.appConfig = gitfresh.NewAppConfigSvc(logger, &memFile{data: config})
+	registries := map[string][]*gitfresh.GitRepository{
+		gitfresh.APP_DEFAULT_WORKSPACE: {{Owner: "apolo96", Name: "gitfresh", Provider: "github.com", Path: "/code/gitfresh"}},
+		"client":                       {{Owner: "client", Name: "shop", Provider: "github.com", Path: "/client/shop"}},
+	}
+	provider.gitRepository = func(workspace string) *gitfresh.GitRepositorySvc {
+		repos, _ := json.Marshal(registries[workspace])
+		return gitfresh.NewGitRepositorySvc(logger, gitOS{commands: commands}, &memFile{data: repos})
+	}
+	var mu sync.Mutex
+	tokens := map[string]string{}
+	provider.gitServer = gitfresh.NewGitServerSvc(logger, clientFunc(func(req *http.Request) (*http.Response, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		tokens[req.URL.Path] = req.Header.Get("Authorization")
+		return &http.Response{StatusCode: http.StatusOK, Body: io.NopCloser(strings.NewReader("[]"))}, nil
+	}))
+	provider.poller = gitfresh.NewPollerSvc(logger, gitOS{commands: commands}, provider.gitServer)
+	catchUp(context.Background(), provider, time.Now().Add(-time.Hour))
+	want := map[string]string{
+		"/repos/apolo96/gitfresh/hooks": "Bearer ghp_personal",
+		"/repos/client/shop/hooks":      "Bearer ghp_client",
+	}
+	if diff := cmp.Diff(tokens, want); diff != "" {
+		t.Error("catchUp() tokens = ", diff)
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/apolo96/gitfresh"
+)
+
+/* A burst of pushes to a branch within the window becomes one pull */
+var coalesceWindow = time.Second * 2
+
+type pendingPull struct {
+	repo     *gitfresh.GitRepository
+	delivery *gitfresh.Delivery
+}
+
+/*
+coalescer runs a single pull at a time for every clone and branch. The
+deliveries received while a pull is waiting or running replace each other,
+so only the latest one is pulled after it.
+*/
+type coalescer struct {
+	pull    refreshFunc
+	history *gitfresh.DeliveryLogSvc
+	window  time.Duration
+	mu      sync.Mutex
+	pending map[string]*pendingPull
+}
+
+func newCoalescer(pull refreshFunc, history *gitfresh.DeliveryLogSvc) *coalescer {
+	return &coalescer{
+		pull:    pull,
+		history: history,
+		window:  coalesceWindow,
+		pending: map[string]*pendingPull{},
+	}
+}
+
+func (c *coalescer) push(repo *gitfresh.GitRepository, delivery gitfresh.Delivery) {
+	key := repo.Path + " " + delivery.Ref
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	p, ok := c.pending[key]
+	if !ok {
+		c.pending[key] = &pendingPull{repo: repo, delivery: &delivery}
+		go c.run(key)
+		return
+	}
+	if p.delivery != nil {
+		superseded := *p.delivery
+		superseded.Path = repo.Path
+		superseded.Outcome = gitfresh.DELIVERY_COALESCED
+		superseded.Reason = "superseded by delivery " + delivery.ID
+		record(c.history, superseded)
+	}
+	p.repo = repo
+	p.delivery = &delivery
+}
+
+func (c *coalescer) run(key string) {
+	for {
+		time.Sleep(c.window)
+		c.mu.Lock()
+		p := c.pending[key]
+		if p.delivery == nil {
+			delete(c.pending, key)
+			c.mu.Unlock()
+			return
+		}
+		repo, delivery := p.repo, *p.delivery
+		p.delivery = nil
+		c.mu.Unlock()
+		/* The result is kept by the update status and the delivery log */
+		c.pull(repo, delivery)
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"log/slog"
+	"strings"
+
+	"github.com/apolo96/gitfresh"
+)
+
+/*
+adoptTunnelURL saves the URL ngrok gave to the agent when no domain was
+reserved, true when it changed so the webhooks must be synced.
+*/
+func adoptTunnelURL(appConfig *gitfresh.AppConfigSvc, url string) (bool, error) {
+	changed := false
+	/* The CLI may save config.json at the same time */
+	err := appConfig.UpdateConfigFile(func(app *gitfresh.AppConfig) bool {
+		changed = false
+		if app.TunnelKind != "" && app.TunnelKind != gitfresh.TUNNEL_NGROK {
+			return false
+		}
+		if app.TunnelDomain != "" && !app.TunnelDomainAssigned {
+			return false
+		}
+		if publicURL(app.TunnelDomain) == publicURL(url) {
+			return false
+		}
+		slog.Info("tunnel domain changed", "old", app.TunnelDomain, "new", url)
+		/* The hooks without the install marker still send to the old domain */
+		if app.TunnelDomain != "" {
+			app.PreviousTunnelDomain = app.TunnelDomain
+		}
+		app.TunnelDomain = url
+		app.TunnelDomainAssigned = true
+		changed = true
+		return true
+	})
+	if err != nil {
+		return false, err
+	}
+	return changed, nil
+}
+
+/* syncHooks points the webhooks of every registered repository to the agent */
+func syncHooks(provider *ServiceProvider) {
+	app, err := provider.appConfig.ReadConfigFile()
+	if err != nil {
+		slog.Error("syncing hooks", "error", err.Error())
+		return
+	}
+	/* Every clone of a repository shares its hook */
+	done := map[string]bool{}
+	for _, repo := range repositories(app, provider.gitRepository) {
+		key := strings.ToLower(repo.Provider + "/" + repo.Owner + "/" + repo.Name)
+		if done[key] {
+			continue
+		}
+		done[key] = true
+		config, err := gitfresh.Workspace(app, repo.Workspace)
+		if err != nil {
+			slog.Error(err.Error())
+			continue
+		}
+		status, err := provider.gitServer.SyncGitServerHook(repo, config)
+		if err != nil {
+			slog.Error("syncing hook", "repository", key, "error", err.Error())
+			continue
+		}
+		slog.Info("hook synced", "repository", key, "status", status)
+	}
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"strings"
+	"testing"
+
+	"github.com/apolo96/gitfresh"
+)
+
+func TestAdoptTunnelURL(t *testing.T) {
+	tests := []struct {
+		name   string
+		config gitfresh.AppConfig
+		want   bool
+		domain string
+	}{
+		{name: "first start", config: gitfresh.AppConfig{}, want: true, domain: "https://b2.ngrok-free.app"},
+		{name: "new domain", config: gitfresh.AppConfig{TunnelDomain: "https://a1.ngrok-free.app", TunnelDomainAssigned: true}, want: true, domain: "https://b2.ngrok-free.app"},
+		{name: "same domain", config: gitfresh.AppConfig{TunnelDomain: "https://b2.ngrok-free.app", TunnelDomainAssigned: true}, want: false, domain: "https://b2.ngrok-free.app"},
+		{name: "reserved domain", config: gitfresh.AppConfig{TunnelDomain: "fresh.ngrok.app"}, want: false, domain: "fresh.ngrok.app"},
+		{name: "cloudflared", config: gitfresh.AppConfig{TunnelKind: gitfresh.TUNNEL_CLOUDFLARED}, want: false, domain: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data, _ := json.Marshal(tt.config)
+			appConfig := gitfresh.NewAppConfigSvc(slog.New(slog.NewJSONHandler(&strings.Builder{}, nil)), &memFile{data: data})
+			changed, err := adoptTunnelURL(appConfig, "https://b2.ngrok-free.app")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if changed != tt.want {
+				t.Errorf("adoptTunnelURL() = %v, want %v", changed, tt.want)
+			}
+			saved, _ := appConfig.ReadConfigFile()
+			if saved.TunnelDomain != tt.domain {
+				t.Errorf("adoptTunnelURL() saved %q, want %q", saved.TunnelDomain, tt.domain)
+			}
+			/* The hooks without the install marker are still found with the old domain */
+			if tt.want && saved.PreviousTunnelDomain != tt.config.TunnelDomain {
+				t.Errorf("adoptTunnelURL() saved the previous domain %q, want %q", saved.PreviousTunnelDomain, tt.config.TunnelDomain)
+			}
+		})
+	}
+}
@@ -6,7 +6,13 @@ import (
 )
 
 func main() {
-	if err := run(); err != nil {
+	var err error
+	if len(os.Args) > 1 && os.Args[1] == "relay" {
+		err = runRelay(os.Args[2:])
+	} else {
+		err = run()
+	}
+	if err != nil {
 		fmt.Fprintf(os.Stderr, "\n%s\n", "error: "+err.Error())
 		os.Exit(1)
 	}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"sync"
+
+	"github.com/apolo96/gitfresh"
+)
+
+/* Pulls running at the same time, whatever the repository */
+const queueWorkers = 4
+
+/* Updates waiting for a clone, the next ones are dropped */
+const queueDepth = 16
+
+var errQueueFull = errors.New("too many updates waiting for the repository")
+var errQueueClosed = errors.New("the agent is stopping")
+
+type updateJob struct {
+	repo     *gitfresh.GitRepository
+	delivery gitfresh.Delivery
+	done     chan error
+}
+
+/*
+updateQueue runs the updates with a pool of workers. Every clone has its own
+lane, its updates run one after the other so git never races on the index
+lock, while the updates of other clones run in parallel.
+*/
+type updateQueue struct {
+	run     refreshFunc
+	history *gitfresh.DeliveryLogSvc
+	dedup   *gitfresh.DedupSvc
+	depth   int
+	mu      sync.Mutex
+	cond    *sync.Cond
+	lanes   map[string][]*updateJob
+	busy    map[string]bool
+	/* lanes with updates and no worker, oldest first */
+	ready  []string
+	closed bool
+	wg     sync.WaitGroup
+}
+
+func newUpdateQueue(run refreshFunc, history *gitfresh.DeliveryLogSvc, dedup *gitfresh.DedupSvc, workers int, depth int) *updateQueue {
+	q := &updateQueue{
+		run:     run,
+		history: history,
+		dedup:   dedup,
+		depth:   depth,
+		lanes:   map[string][]*updateJob{},
+		busy:    map[string]bool{},
+	}
+	q.cond = sync.NewCond(&q.mu)
+	q.wg.Add(workers)
+	for range workers {
+		go q.work()
+	}
+	return q
+}
+
+/* enqueue adds an update to the lane of the clone, the channel gives its result */
+func (q *updateQueue) enqueue(repo *gitfresh.GitRepository, delivery gitfresh.Delivery) (<-chan error, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.closed {
+		return nil, errQueueClosed
+	}
+	lane := q.lanes[repo.Path]
+	if len(lane) >= q.depth {
+		return nil, errQueueFull
+	}
+	job := &updateJob{repo: repo, delivery: delivery, done: make(chan error, 1)}
+	q.lanes[repo.Path] = append(lane, job)
+	if len(lane) == 0 && !q.busy[repo.Path] {
+		q.ready = append(q.ready, repo.Path)
+		q.cond.Signal()
+	}
+	return job.done, nil
+}
+
+/* pull enqueues an update and waits for it, a dropped update is recorded as failed */
+func (q *updateQueue) pull(repo *gitfresh.GitRepository, delivery gitfresh.Delivery) error {
+	done, err := q.enqueue(repo, delivery)
+	if err != nil {
+		slog.Warn("dropping update", "path", repo.Path, "delivery", delivery.ID, "error", err.Error())
+		delivery.Path = repo.Path
+		delivery.Outcome = gitfresh.UPDATE_STATUS_FAILED
+		delivery.Reason = err.Error()
+		record(q.history, delivery)
+		forget(q.dedup, delivery)
+		return err
+	}
+	return <-done
+}
+
+func (q *updateQueue) work() {
+	defer q.wg.Done()
+	for {
+		q.mu.Lock()
+		for len(q.ready) == 0 && !q.closed {
+			q.cond.Wait()
+		}
+		if len(q.ready) == 0 {
+			q.mu.Unlock()
+			return
+		}
+		path := q.ready[0]
+		q.ready = q.ready[1:]
+		job := q.lanes[path][0]
+		q.lanes[path] = q.lanes[path][1:]
+		q.busy[path] = true
+		q.mu.Unlock()
+		job.done <- q.run(job.repo, job.delivery)
+		q.mu.Lock()
+		delete(q.busy, path)
+		if len(q.lanes[path]) > 0 {
+			q.ready = append(q.ready, path)
+			q.cond.Signal()
+		} else {
+			delete(q.lanes, path)
+		}
+		q.mu.Unlock()
+	}
+}
+
+/* shutdown rejects new updates and waits for the queued ones until the context is done */
+func (q *updateQueue) shutdown(ctx context.Context) error {
+	q.mu.Lock()
+	q.closed = true
+	q.cond.Broadcast()
+	q.mu.Unlock()
+	drained := make(chan struct{})
+	go func() {
+		q.wg.Wait()
+		close(drained)
+	}()
+	select {
+	case <-drained:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/apolo96/gitfresh"
+	"github.com/google/go-cmp/cmp"
+)
+
+func testQueue(run refreshFunc, workers int, depth int) *updateQueue {
+	logger := slog.New(slog.NewJSONHandler(&strings.Builder{}, nil))
+	return newUpdateQueue(
+		run,
+		gitfresh.NewDeliveryLogSvc(logger, &memFile{}),
+		gitfresh.NewDedupSvc(logger, &memFile{}, 10),
+		workers,
+		depth,
+	)
+}
+
+func TestUpdateQueue_Ordering(t *testing.T) {
+	var mu sync.Mutex
+	running := map[string]bool{}
+	order := map[string][]string{}
+	parallel, maxParallel := 0, 0
+	run := func(repo *gitfresh.GitRepository, delivery gitfresh.Delivery) error {
+		mu.Lock()
+		if running[repo.Path] {
+			t.Errorf("two updates of %s at the same time", repo.Path)
+		}
+		running[repo.Path] = true
+		parallel++
+		maxParallel = max(maxParallel, parallel)
+		mu.Unlock()
+		time.Sleep(time.Millisecond * 2)
+		mu.Lock()
+		running[repo.Path] = false
+		parallel--
+		order[repo.Path] = append(order[repo.Path], delivery.ID)
+		mu.Unlock()
+		return nil
+	}
+	q := testQueue(run, 3, 20)
+	repos := []*gitfresh.GitRepository{{Path: "/code/api"}, {Path: "/code/web"}, {Path: "/code/docs"}, {Path: "/code/cli"}}
+	want := map[string][]string{}
+	results := []<-chan error{}
+	for i := range 15 {
+		for _, repo := range repos {
+			id := fmt.Sprint(i)
+			done, err := q.enqueue(repo, gitfresh.Delivery{ID: id, Ref: "refs/heads/main"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			results = append(results, done)
+			want[repo.Path] = append(want[repo.Path], id)
+		}
+	}
+	for _, done := range results {
+		if err := <-done; err != nil {
+			t.Error(err)
+		}
+	}
+	if diff := cmp.Diff(order, want); diff != "" {
+		t.Error("updateQueue order = ", diff)
+	}
+	if maxParallel > 3 {
+		t.Errorf("updateQueue ran %d updates at the same time, want 3 at most", maxParallel)
+	}
+	if err := q.shutdown(context.Background()); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestUpdateQueue_Depth(t *testing.T) {
+	release := make(chan struct{})
+	q := testQueue(func(repo *gitfresh.GitRepository, delivery gitfresh.Delivery) error {
+		<-release
+		return nil
+	}, 1, 2)
+	repo := &gitfresh.GitRepository{Path: "/code/api"}
+	/* The first update is taken by the worker, two more can wait */
+	first, _ := q.enqueue(repo, gitfresh.Delivery{ID: "1"})
+	for {
+		q.mu.Lock()
+		busy := q.busy[repo.Path]
+		q.mu.Unlock()
+		if busy {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	q.enqueue(repo, gitfresh.Delivery{ID: "2"})
+	q.enqueue(repo, gitfresh.Delivery{ID: "3"})
+	if err := q.pull(repo, gitfresh.Delivery{ID: "4"}); !errors.Is(err, errQueueFull) {
+		t.Errorf("updateQueue.pull() = %v, want %v", err, errQueueFull)
+	}
+	close(release)
+	<-first
+}
+
+func TestUpdateQueue_Drain(t *testing.T) {
+	var mu sync.Mutex
+	pulled := []string{}
+	q := testQueue(func(repo *gitfresh.GitRepository, delivery gitfresh.Delivery) error {
+		time.Sleep(time.Millisecond * 20)
+		mu.Lock()
+		pulled = append(pulled, delivery.ID)
+		mu.Unlock()
+		return nil
+	}, 1, 5)
+	repo := &gitfresh.GitRepository{Path: "/code/api"}
+	q.enqueue(repo, gitfresh.Delivery{ID: "1"})
+	q.enqueue(repo, gitfresh.Delivery{ID: "2"})
+	if err := q.shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(pulled, []string{"1", "2"}); diff != "" {
+		t.Error("updateQueue.shutdown() pulled = ", diff)
+	}
+	if _, err := q.enqueue(repo, gitfresh.Delivery{ID: "3"}); !errors.Is(err, errQueueClosed) {
+		t.Errorf("updateQueue.enqueue() after shutdown = %v, want %v", err, errQueueClosed)
+	}
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/apolo96/gitfresh"
+)
+
+/* GitHub sends payloads up to 25MB */
+const relayMaxBody = 25 << 20
+const relayHeartbeat = time.Second * 30
+
+/* relayDelivery is a webhook forwarded by the relay, the agents verify its signature */
+type relayDelivery struct {
+	Header http.Header `json:"header"`
+	Body   []byte      `json:"body"`
+}
+
+/* relay receives the webhooks once and fans them out to the subscribed agents over SSE */
+type relay struct {
+	token       string
+	mu          sync.Mutex
+	subscribers map[chan relayDelivery]struct{}
+}
+
+func newRelay(token string) *relay {
+	return &relay{
+		token:       token,
+		subscribers: map[chan relayDelivery]struct{}{},
+	}
+}
+
+func (rl *relay) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case r.Method == http.MethodGet && r.URL.Path == "/events":
+		rl.subscribe(w, r)
+	case r.Method == http.MethodPost:
+		rl.publish(w, r)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (rl *relay) publish(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, relayMaxBody))
+	if err != nil {
+		http.Error(w, "error reading the webhook", http.StatusBadRequest)
+		return
+	}
+	delivery := relayDelivery{Header: http.Header{}, Body: body}
+	for k, v := range r.Header {
+		if strings.HasPrefix(k, "X-") || k == "Content-Type" {
+			delivery.Header[k] = v
+		}
+	}
+	rl.mu.Lock()
+	agents := len(rl.subscribers)
+	for ch := range rl.subscribers {
+		select {
+		case ch <- delivery:
+		default:
+			slog.Warn("dropping delivery for a slow agent")
+		}
+	}
+	rl.mu.Unlock()
+	slog.Info("delivery relayed", "agents", agents, "event", r.Header.Get("X-GitHub-Event"))
+	w.WriteHeader(http.StatusOK)
+}
+
+func (rl *relay) subscribe(w http.ResponseWriter, r *http.Request) {
+	token, _ := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if subtle.ConstantTimeCompare([]byte(token), []byte(rl.token)) != 1 {
+		http.Error(w, "invalid relay token", http.StatusUnauthorized)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming not supported", http.StatusInternalServerError)
+		return
+	}
+	ch := make(chan relayDelivery, 64)
+	rl.mu.Lock()
+	rl.subscribers[ch] = struct{}{}
+	rl.mu.Unlock()
+	defer func() {
+		rl.mu.Lock()
+		delete(rl.subscribers, ch)
+		rl.mu.Unlock()
+	}()
+	slog.Info("agent subscribed", "remote", r.RemoteAddr)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+	/* The comments keep proxies from closing an idle connection */
+	heartbeat := time.NewTicker(relayHeartbeat)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			slog.Info("agent unsubscribed", "remote", r.RemoteAddr)
+			return
+		case <-heartbeat.C:
+			fmt.Fprint(w, ": ping\n\n")
+		case delivery := <-ch:
+			data, err := json.Marshal(delivery)
+			if err != nil {
+				slog.Error(err.Error())
+				continue
+			}
+			fmt.Fprintf(w, "event: delivery\ndata: %s\n\n", data)
+		}
+		flusher.Flush()
+	}
+}
+
+/* runRelay starts the relay server: gitfreshd relay -addr :9393 -token <token> */
+func runRelay(args []string) error {
+	logger := slog.New(slog.NewJSONHandler(os.Stdout, &slog.HandlerOptions{Level: slog.LevelInfo}))
+	slog.SetDefault(logger.With("version", "1.0.0", "mode", gitfresh.AGENT_MODE_RELAY))
+	flags := flag.NewFlagSet("relay", flag.ContinueOnError)
+	addr := flags.String("addr", gitfresh.APP_RELAY_ADDR, "address receiving the webhooks and the agents")
+	token := flags.String("token", os.Getenv("GITFRESH_RELAY_TOKEN"), "token of the agents, by default $GITFRESH_RELAY_TOKEN")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *token == "" {
+		return errors.New("the relay needs a token to authenticate the agents")
+	}
+	server := &http.Server{
+		Addr:              *addr,
+		Handler:           newRelay(*token),
+		ReadHeaderTimeout: time.Second * 10,
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go func() {
+		<-ctx.Done()
+		server.Shutdown(context.Background())
+	}()
+	println("Relay Listening on " + server.Addr)
+	slog.Info("Relay Listening on " + server.Addr)
+	if err := server.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
+
+/* subscribe receives the deliveries of the relay until the agent is stopped, reconnecting when the connection drops */
+func subscribe(ctx context.Context, ch chan<- string, provider *ServiceProvider, wg *sync.WaitGroup, conf *gitfresh.AppConfig) error {
+	if conf.RelayURL == "" || conf.RelayToken == "" {
+		return errors.New("relay mode needs the RelayURL and RelayToken")
+	}
+	ch <- conf.RelayURL
+	wg.Done()
+	println("Subscribed to the relay " + conf.RelayURL)
+	slog.Info("Subscribed to the relay " + conf.RelayURL)
+	h := handler(provider.appConfig, provider.gitRepository, provider.gitServer, provider.history, provider.dedup, provider.pulls)
+	client := &http.Client{}
+	backoff := time.Second
+	for {
+		connected, err := listenRelay(ctx, client, conf, h)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if connected {
+			backoff = time.Second
+		}
+		slog.Warn("relay connection lost", "error", fmt.Sprint(err), "retry_in", backoff.String())
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(backoff):
+		}
+		backoff = min(backoff*2, time.Minute)
+	}
+}
+
+/* listenRelay reads the SSE stream, every delivery goes through the webhook handler */
+func listenRelay(ctx context.Context, client *http.Client, conf *gitfresh.AppConfig, h http.Handler) (bool, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", strings.TrimSuffix(conf.RelayURL, "/")+"/events", nil)
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Authorization", "Bearer "+conf.RelayToken)
+	req.Header.Set("Accept", "text/event-stream")
+	resp, err := client.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return false, errors.New("subscribing to the relay, response with " + resp.Status)
+	}
+	slog.Info("relay connected")
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 64*1024), relayMaxBody*2)
+	event, data := "", ""
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case line == "":
+			if event == "delivery" {
+				dispatch(h, data)
+			}
+			event, data = "", ""
+		case strings.HasPrefix(line, "event:"):
+			event = strings.TrimSpace(strings.TrimPrefix(line, "event:"))
+		case strings.HasPrefix(line, "data:"):
+			data += strings.TrimSpace(strings.TrimPrefix(line, "data:"))
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return true, err
+	}
+	return true, io.EOF
+}
+
+func dispatch(h http.Handler, data string) {
+	delivery := relayDelivery{}
+	if err := json.Unmarshal([]byte(data), &delivery); err != nil {
+		slog.Error("decoding relay delivery", "error", err.Error())
+		return
+	}
+	req, err := http.NewRequest("POST", "/", bytes.NewReader(delivery.Body))
+	if err != nil {
+		slog.Error(err.Error())
+		return
+	}
+	req.Header = delivery.Header
+	w := &relayResponse{header: http.Header{}, status: http.StatusOK}
+	h.ServeHTTP(w, req)
+	if w.status >= http.StatusBadRequest {
+		slog.Warn("relay delivery rejected", "status", w.status)
+	}
+}
+
+/* relayResponse keeps the status given by the handler to a relayed delivery */
+type relayResponse struct {
+	header http.Header
+	status int
+}
+
+func (w *relayResponse) Header() http.Header {
+	return w.header
+}
+
+func (w *relayResponse) Write(b []byte) (int, error) {
+	return len(b), nil
+}
+
+func (w *relayResponse) WriteHeader(status int) {
+	w.status = status
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/apolo96/gitfresh"
+)
+
+func TestRelay_FanOut(t *testing.T) {
+	rl := newRelay("team-token")
+	server := httptest.NewServer(rl)
+	defer server.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	conf := &gitfresh.AppConfig{RelayURL: server.URL, RelayToken: "team-token"}
+	received := make(chan *http.Request, 4)
+	bodies := make(chan string, 4)
+	agent := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		received <- r
+		bodies <- string(body)
+	})
+	for range 2 {
+		go listenRelay(ctx, &http.Client{}, conf, agent)
+	}
+	deadline := time.Now().Add(time.Second * 2)
+	for {
+		rl.mu.Lock()
+		n := len(rl.subscribers)
+		rl.mu.Unlock()
+		if n == 2 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("relay has %d subscribers, want 2", n)
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	push := `{"ref":"refs/heads/main","repository":{"full_name":"apolo96/gitfresh"}}`
+	req, _ := http.NewRequest("POST", server.URL, strings.NewReader(push))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-GitHub-Event", "push")
+	req.Header.Set("X-Hub-Signature-256", sign(push, testSecret))
+	req.Header.Set("Cookie", "session=private")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("relay status = %d, want %d", resp.StatusCode, http.StatusOK)
+	}
+	for range 2 {
+		select {
+		case r := <-received:
+			if got := <-bodies; got != push {
+				t.Errorf("agent body = %s, want %s", got, push)
+			}
+			if r.Header.Get("X-Hub-Signature-256") != sign(push, testSecret) || r.Header.Get("X-GitHub-Event") != "push" {
+				t.Errorf("agent headers = %v", r.Header)
+			}
+			if r.Header.Get("Cookie") != "" {
+				t.Error("relay forwarded the cookies")
+			}
+		case <-time.After(time.Second * 2):
+			t.Fatal("agent did not receive the delivery")
+		}
+	}
+}
+
+func TestRelay_Unauthorized(t *testing.T) {
+	server := httptest.NewServer(newRelay("team-token"))
+	defer server.Close()
+	conf := &gitfresh.AppConfig{RelayURL: server.URL + "/", RelayToken: "guess"}
+	connected, err := listenRelay(context.Background(), &http.Client{}, conf, http.NotFoundHandler())
+	if connected || err == nil || !strings.Contains(err.Error(), "401") {
+		t.Errorf("listenRelay() = %v, %v, want a 401 error", connected, err)
+	}
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"github.com/apolo96/gitfresh"
+)
+
+/* The config is checked every tick, gitfresh secret rotate changes it while the agent runs */
+const retireTick = time.Minute
+
+/* retireSecret forgets the previous webhook secret once its grace window is over */
+func retireSecret(ctx context.Context, appConfig *gitfresh.AppConfigSvc, tick time.Duration) {
+	ticker := time.NewTicker(tick)
+	defer ticker.Stop()
+	for {
+		if err := retirePreviousSecret(appConfig, time.Now()); err != nil {
+			slog.Error("retiring webhook secret", "error", err.Error())
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func retirePreviousSecret(appConfig *gitfresh.AppConfigSvc, now time.Time) error {
+	/* gitfresh secret rotate may save config.json at the same time */
+	return appConfig.UpdateConfigFile(func(app *gitfresh.AppConfig) bool {
+		if app.PreviousHookSecret == nil || now.Before(app.PreviousHookSecret.Until) {
+			return false
+		}
+		app.PreviousHookSecret = nil
+		slog.Info("previous webhook secret retired")
+		return true
+	})
+}
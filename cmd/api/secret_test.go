@@ -0,0 +1,33 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/apolo96/gitfresh"
+)
+
+func TestRetirePreviousSecret(t *testing.T) {
+	now := time.Now()
+	data, _ := json.Marshal(gitfresh.AppConfig{
+		GitHookSecret:      "n3w",
+		PreviousHookSecret: &gitfresh.RetiringSecret{Secret: "0ld", Until: now.Add(time.Hour)},
+	})
+	appConfig := gitfresh.NewAppConfigSvc(slog.New(slog.NewJSONHandler(&strings.Builder{}, nil)), &memFile{data: data})
+	if err := retirePreviousSecret(appConfig, now); err != nil {
+		t.Fatal(err)
+	}
+	if app, _ := appConfig.ReadConfigFile(); app.PreviousHookSecret == nil {
+		t.Error("retirePreviousSecret() retired the secret during the grace window")
+	}
+	if err := retirePreviousSecret(appConfig, now.Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	app, _ := appConfig.ReadConfigFile()
+	if app.PreviousHookSecret != nil || app.GitHookSecret != "n3w" {
+		t.Errorf("retirePreviousSecret() kept %+v", app.PreviousHookSecret)
+	}
+}
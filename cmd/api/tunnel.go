@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"strings"
+
+	"github.com/apolo96/gitfresh"
+	"golang.ngrok.com/ngrok"
+	"golang.ngrok.com/ngrok/config"
+)
+
+/* Tunnel exposes the agent handler to the git servers */
+type Tunnel interface {
+	/* Listen gives the listener receiving the webhooks and the public URL of the tunnel */
+	Listen(ctx context.Context) (net.Listener, string, error)
+	Close() error
+}
+
+func newTunnel(conf *gitfresh.AppConfig, appOS gitfresh.OSCommander, verifyGitHub bool) (Tunnel, error) {
+	port := conf.TunnelPort
+	if port == 0 {
+		port = gitfresh.APP_TUNNEL_PORT
+	}
+	local := fmt.Sprintf("127.0.0.1:%d", port)
+	switch conf.TunnelKind {
+	case "", gitfresh.TUNNEL_NGROK:
+		t := &ngrokTunnel{token: conf.TunnelToken, domain: conf.TunnelDomain}
+		/* The domain given on the last start is not reserved, ngrok gives a new one */
+		if conf.TunnelDomainAssigned {
+			t.domain = ""
+		}
+		if verifyGitHub {
+			t.secret = conf.GitHookSecret
+		}
+		return t, nil
+	case gitfresh.TUNNEL_CLOUDFLARED:
+		if conf.TunnelToken == "" || conf.TunnelDomain == "" {
+			return nil, errors.New("cloudflared tunnel needs the TunnelToken and TunnelDomain")
+		}
+		/* cloudflared reads the token from the environment, so it is not shown by ps */
+		os.Setenv("TUNNEL_TOKEN", conf.TunnelToken)
+		return &processTunnel{
+			appOS:   appOS,
+			program: "cloudflared",
+			args:    []string{"tunnel", "--no-autoupdate", "run"},
+			addr:    local,
+			url:     publicURL(conf.TunnelDomain),
+		}, nil
+	case gitfresh.TUNNEL_SSH:
+		if conf.TunnelSSHHost == "" || conf.TunnelDomain == "" {
+			return nil, errors.New("ssh tunnel needs the TunnelSSHHost and TunnelDomain")
+		}
+		remote := conf.TunnelRemotePort
+		if remote == 0 {
+			remote = port
+		}
+		return &processTunnel{
+			appOS:   appOS,
+			program: "ssh",
+			args: []string{
+				"-N",
+				"-o", "BatchMode=yes",
+				"-o", "ExitOnForwardFailure=yes",
+				"-o", "ServerAliveInterval=30",
+				"-R", fmt.Sprintf("%d:%s", remote, local),
+				conf.TunnelSSHHost,
+			},
+			addr: local,
+			url:  publicURL(conf.TunnelDomain),
+		}, nil
+	case gitfresh.TUNNEL_NONE:
+		if conf.TunnelDomain == "" {
+			return nil, errors.New("none tunnel needs the TunnelDomain where the agent is reachable")
+		}
+		/* The machine is reachable, so the agent listens on every interface */
+		return &directTunnel{addr: fmt.Sprintf(":%d", port), url: publicURL(conf.TunnelDomain)}, nil
+	}
+	return nil, errors.New("unknown tunnel kind " + conf.TunnelKind)
+}
+
+func publicURL(domain string) string {
+	if strings.Contains(domain, "://") {
+		return strings.TrimSuffix(domain, "/")
+	}
+	return "https://" + strings.TrimSuffix(domain, "/")
+}
+
+/* ngrokTunnel runs the ngrok agent inside the process */
+type ngrokTunnel struct {
+	token  string
+	domain string
+	secret string
+}
+
+func (t *ngrokTunnel) Listen(ctx context.Context) (net.Listener, string, error) {
+	os.Setenv("NGROK_AUTHTOKEN", t.token)
+	opts := []config.HTTPEndpointOption{config.WithDomain(t.domain)}
+	if t.secret != "" {
+		opts = append(opts, config.WithWebhookVerification("github", t.secret))
+	}
+	listener, err := ngrok.Listen(ctx,
+		config.HTTPEndpoint(opts...),
+		ngrok.WithAuthtokenFromEnv(),
+	)
+	if err != nil {
+		return nil, "", err
+	}
+	return listener, listener.URL(), nil
+}
+
+func (t *ngrokTunnel) Close() error {
+	return nil
+}
+
+/* processTunnel forwards a local port through a program like cloudflared or ssh */
+type processTunnel struct {
+	appOS   gitfresh.OSCommander
+	program string
+	args    []string
+	addr    string
+	url     string
+	pid     int
+}
+
+func (t *processTunnel) Listen(ctx context.Context) (net.Listener, string, error) {
+	path, err := t.appOS.LookProgram(t.program)
+	if err != nil {
+		return nil, "", err
+	}
+	listener, err := net.Listen("tcp", t.addr)
+	if err != nil {
+		return nil, "", err
+	}
+	pid, err := t.appOS.StartProgram(path, t.args...)
+	if err != nil {
+		listener.Close()
+		return nil, "", err
+	}
+	t.pid = pid
+	slog.Info("tunnel program started", "program", path, "pid", pid, "local", t.addr)
+	return listener, t.url, nil
+}
+
+func (t *processTunnel) Close() error {
+	if t.pid == 0 {
+		return nil
+	}
+	slog.Info("stopping tunnel program", "program", t.program, "pid", t.pid)
+	return t.appOS.StopProgram(t.pid)
+}
+
+/* directTunnel is used when the machine already has a reachable address */
+type directTunnel struct {
+	addr string
+	url  string
+}
+
+func (t *directTunnel) Listen(ctx context.Context) (net.Listener, string, error) {
+	listener, err := net.Listen("tcp", t.addr)
+	if err != nil {
+		return nil, "", err
+	}
+	return listener, t.url, nil
+}
+
+func (t *directTunnel) Close() error {
+	return nil
+}
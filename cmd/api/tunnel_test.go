@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/apolo96/gitfresh"
+	"github.com/google/go-cmp/cmp"
+)
+
+/* programOS records the programs started by the tunnels */
+type programOS struct {
+	gitfresh.AppOS
+	started []string
+	stopped []int
+}
+
+func (o *programOS) LookProgram(cmd string) (string, error) {
+	return "/usr/bin/" + cmd, nil
+}
+
+func (o *programOS) StartProgram(path string, args ...string) (int, error) {
+	o.started = append(o.started, path+" "+strings.Join(args, " "))
+	return 4242, nil
+}
+
+func (o *programOS) StopProgram(pid int) error {
+	o.stopped = append(o.stopped, pid)
+	return nil
+}
+
+func TestNewTunnel(t *testing.T) {
+	tests := []struct {
+		name        string
+		conf        *gitfresh.AppConfig
+		wantURL     string
+		wantProgram string
+		wantErr     bool
+	}{
+		{
+			name: "cloudflared named tunnel",
+			conf: &gitfresh.AppConfig{
+				TunnelKind:   gitfresh.TUNNEL_CLOUDFLARED,
+				TunnelToken:  "eyJh",
+				TunnelDomain: "hooks.company.com",
+				TunnelPort:   19292,
+			},
+			wantURL:     "https://hooks.company.com",
+			wantProgram: "/usr/bin/cloudflared tunnel --no-autoupdate run",
+		},
+		{
+			name: "ssh reverse tunnel",
+			conf: &gitfresh.AppConfig{
+				TunnelKind:       gitfresh.TUNNEL_SSH,
+				TunnelDomain:     "https://bastion.company.com/lio/",
+				TunnelSSHHost:    "tunnel@bastion.company.com",
+				TunnelPort:       19293,
+				TunnelRemotePort: 8022,
+			},
+			wantURL: "https://bastion.company.com/lio",
+			wantProgram: "/usr/bin/ssh -N -o BatchMode=yes -o ExitOnForwardFailure=yes -o ServerAliveInterval=30 " +
+				"-R 8022:127.0.0.1:19293 tunnel@bastion.company.com",
+		},
+		{
+			name: "reachable machine",
+			conf: &gitfresh.AppConfig{
+				TunnelKind:   gitfresh.TUNNEL_NONE,
+				TunnelDomain: "http://10.0.0.7:19294",
+				TunnelPort:   19294,
+			},
+			wantURL: "http://10.0.0.7:19294",
+		},
+		{
+			name:    "ssh without bastion",
+			conf:    &gitfresh.AppConfig{TunnelKind: gitfresh.TUNNEL_SSH, TunnelDomain: "bastion.company.com"},
+			wantErr: true,
+		},
+		{
+			name:    "unknown kind",
+			conf:    &gitfresh.AppConfig{TunnelKind: "localtunnel"},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			appOS := &programOS{}
+			tun, err := newTunnel(tt.conf, appOS, false)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("newTunnel() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			listener, url, err := tun.Listen(context.Background())
+			if err != nil {
+				t.Fatalf("Tunnel.Listen() error = %v", err)
+			}
+			defer listener.Close()
+			if url != tt.wantURL {
+				t.Errorf("Tunnel.Listen() url = %s, want %s", url, tt.wantURL)
+			}
+			if err := tun.Close(); err != nil {
+				t.Fatal(err)
+			}
+			wantStarted := []string{}
+			wantStopped := []int{}
+			if tt.wantProgram != "" {
+				wantStarted = append(wantStarted, tt.wantProgram)
+				wantStopped = append(wantStopped, 4242)
+			}
+			if diff := cmp.Diff(append([]string{}, appOS.started...), wantStarted); diff != "" {
+				t.Error("Tunnel started programs = ", diff)
+			}
+			if diff := cmp.Diff(append([]int{}, appOS.stopped...), wantStopped); diff != "" {
+				t.Error("Tunnel stopped programs = ", diff)
+			}
+		})
+	}
+}
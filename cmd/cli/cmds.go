@@ -1,31 +1,131 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"io"
 	"log/slog"
 	"os"
+	"regexp"
+	"slices"
+	"strings"
 	"time"
 
 	"github.com/apolo96/gitfresh"
+	"golang.ngrok.com/ngrok"
 )
 
 type AppFlags struct {
-	TunnelToken    string `name:"TunnelToken" description:"Actually gitfresh support only Ngrok Internet Tunnel.\nYou can get a Token going to https://dashboard.ngrok.com/get-started/your-authtoken \n"`
-	TunnelDomain   string `name:"TunnelDomain" description:"Actually gitfresh support only Ngrok Internet Tunnel.\nYou can get a Custom Domain going to https://dashboard.ngrok.com/cloud-edge/domains \n"`
-	GitServerToken string `name:"GitServerToken" description:"Actually gitfresh support only github.com.\nYou can get a Toke going to https://github.com \n"`
-	GitWorkDir     string `name:"GitWorkDir" description:"Your Git working directory where you have all repositories.\nFor example: /users/lio/code . Type the absolute path.\nIf you don't enter a GitWorkDir, then GitFresh assumes that your GitWorkDir is your current directory. \n"`
+	AgentMode        string `name:"AgentMode" description:"webhook, poll or relay. The poll mode refreshes the repositories without tunnel nor webhooks,\nthe relay mode receives the webhooks of the team from a gitfreshd relay. By default webhook \n"`
+	RelayURL         string `name:"RelayURL" description:"Public URL of the gitfreshd relay of your team. For example: https://relay.company.com \n"`
+	RelayToken       string `name:"RelayToken" description:"Token given to the gitfreshd relay with -token \n"`
+	GitHookSecret    string `name:"GitHookSecret" description:"Webhook secret, by default a random one. The whole team shares it in relay mode \n"`
+	PollInterval     int    `name:"PollInterval" description:"Seconds between every check of the repositories in poll mode, by default 300 \n"`
+	PollConcurrency  int    `name:"PollConcurrency" description:"How many repositories are checked at the same time in poll mode, by default 4 \n"`
+	PollGitHubAPI    bool   `name:"PollGitHubAPI" description:"Check the GitHub branches with conditional API requests instead of git ls-remote \n"`
+	RedeliverFailed  bool   `name:"RedeliverFailed" description:"Ask GitHub to redeliver the pushes that failed while the agent was stopped or the laptop slept \n"`
+	TunnelKind       string `name:"TunnelKind" description:"Internet tunnel used by the agent: ngrok, cloudflared, ssh or none.\nBy default ngrok \n"`
+	TunnelToken      string `name:"TunnelToken" description:"Token of the Ngrok or Cloudflare Tunnel.\nYou can get a Ngrok Token going to https://dashboard.ngrok.com/get-started/your-authtoken \n"`
+	TunnelDomain     string `name:"TunnelDomain" description:"Public domain of the tunnel, optional for Ngrok.\nYou can get a Custom Domain going to https://dashboard.ngrok.com/cloud-edge/domains \n"`
+	TunnelPort       int    `name:"TunnelPort" description:"Local port where the agent receives the webhooks with cloudflared, ssh or none.\nBy default 9292 \n"`
+	TunnelSSHHost    string `name:"TunnelSSHHost" description:"Bastion used by the ssh tunnel. For example: tunnel@bastion.company.com \n"`
+	TunnelRemotePort int    `name:"TunnelRemotePort" description:"Port opened on the bastion by the ssh tunnel, by default the TunnelPort \n"`
+	GitServerToken   string `name:"GitServerToken" description:"Token to manage the webhooks of the repositories hosted on github.com.\nYou can get a Token with admin:repo_hook scope going to https://github.com/settings/tokens\nUse GitLabToken, BitbucketToken and GiteaToken for the other git servers \n"`
+	GitHubAppID      int64  `name:"GitHubAppID" description:"ID of a GitHub App installed on your accounts, used instead of the GitServerToken.\nThe app needs the Webhooks read and write permission of the repositories or organizations \n"`
+	GitHubAppKey     string `name:"GitHubAppKey" description:"Path to the .pem private key of the GitHub App \n"`
+	GitHubOrgHooks   bool   `name:"GitHubOrgHooks" description:"Create one webhook for every organization where the GitHub App is installed,\nso its new repositories are covered without creating more hooks \n"`
+	GitLabToken      string `name:"GitLabToken" description:"Optional token to refresh repositories hosted on gitlab.com.\nYou can get a Token with api scope going to https://gitlab.com/-/user_settings/personal_access_tokens \n"`
+	BitbucketToken   string `name:"BitbucketToken" description:"Optional token to refresh repositories hosted on bitbucket.org.\nUse a repository access token with webhook scope or an app password typed as username:app_password \n"`
+	GiteaURL         string `name:"GiteaURL" description:"Optional base URL of your self-hosted Gitea or Forgejo.\nFor example: https://git.company.com \n"`
+	GiteaToken       string `name:"GiteaToken" description:"Token to manage webhooks on your Gitea or Forgejo.\nYou can get a Token going to <GiteaURL>/user/settings/applications \n"`
+	GitWorkDir       string `name:"GitWorkDir" description:"Your Git working directory where you have all repositories.\nFor example: /users/lio/code . Type the absolute path.\nIf you don't enter a GitWorkDir, then GitFresh assumes that your GitWorkDir is your current directory. \n"`
+	GitScanDepth     int    `name:"GitScanDepth" description:"How many directory levels below the GitWorkDir are scanned looking for repositories.\nBy default 3, for example /users/lio/code/<client>/<repo> needs 2. \n"`
+	GitStrategy      string `name:"GitStrategy" description:"How the checked out branch is updated: ff-only, skip-if-dirty, autostash or fetch-only.\nBy default ff-only, every repository can override it with: gitfresh strategy \n"`
+	SkipTokenCheck   bool   `name:"SkipTokenCheck" description:"Save the config even when the tokens are rejected or lack a scope, for example offline \n"`
 }
 
-func configCmd(appConfigSvc *gitfresh.AppConfigSvc, flags *AppFlags) error {
-	if flags.TunnelToken == "" {
+var agentModes = []string{
+	gitfresh.AGENT_MODE_WEBHOOK,
+	gitfresh.AGENT_MODE_POLL,
+	gitfresh.AGENT_MODE_RELAY,
+}
+
+var tunnelKinds = []string{
+	gitfresh.TUNNEL_NGROK,
+	gitfresh.TUNNEL_CLOUDFLARED,
+	gitfresh.TUNNEL_SSH,
+	gitfresh.TUNNEL_NONE,
+}
+
+var gitStrategies = []string{
+	gitfresh.GIT_STRATEGY_FAST_FORWARD,
+	gitfresh.GIT_STRATEGY_SKIP_DIRTY,
+	gitfresh.GIT_STRATEGY_AUTOSTASH,
+	gitfresh.GIT_STRATEGY_FETCH_ONLY,
+}
+
+func configCmd(appConfigSvc *gitfresh.AppConfigSvc, gitServerSvc *gitfresh.GitServerSvc, flags *AppFlags) error {
+	if flags.AgentMode == "" {
+		flags.AgentMode = gitfresh.AGENT_MODE_WEBHOOK
+	}
+	if !slices.Contains(agentModes, flags.AgentMode) {
+		return errors.New("unknown AgentMode " + flags.AgentMode)
+	}
+	if flags.AgentMode == gitfresh.AGENT_MODE_RELAY {
+		if flags.RelayURL == "" {
+			flags.RelayURL = PromptSecret("Type the RelayURL (gitfreshd relay):", true)
+		}
+		if flags.RelayToken == "" {
+			flags.RelayToken = PromptSecret("Type the RelayToken (gitfreshd relay):", true)
+		}
+		/* Every agent verifies the signatures of the shared webhooks */
+		if flags.GitHookSecret == "" {
+			flags.GitHookSecret = PromptSecret("Type the GitHookSecret shared by your team:", true)
+		}
+	}
+	/* The poll and relay modes don't need a tunnel */
+	if flags.TunnelKind == "" && flags.AgentMode != gitfresh.AGENT_MODE_WEBHOOK {
+		flags.TunnelKind = gitfresh.TUNNEL_NONE
+	}
+	if flags.TunnelKind == "" {
+		flags.TunnelKind = gitfresh.TUNNEL_NGROK
+	}
+	if !slices.Contains(tunnelKinds, flags.TunnelKind) {
+		return errors.New("unknown TunnelKind " + flags.TunnelKind)
+	}
+	if flags.TunnelToken == "" && flags.TunnelKind == gitfresh.TUNNEL_NGROK {
 		flags.TunnelToken = PromptSecret("Type the TunnelToken (Ngrok):", true)
 	}
-	if flags.GitServerToken == "" {
+	if flags.TunnelToken == "" && flags.TunnelKind == gitfresh.TUNNEL_CLOUDFLARED {
+		flags.TunnelToken = PromptSecret("Type the TunnelToken (Cloudflare Tunnel):", true)
+	}
+	if flags.TunnelSSHHost == "" && flags.TunnelKind == gitfresh.TUNNEL_SSH {
+		flags.TunnelSSHHost = PromptSecret("Type the TunnelSSHHost (user@bastion):", true)
+	}
+	appKey, err := readAppKey(flags.GitHubAppID, flags.GitHubAppKey)
+	if err != nil {
+		return err
+	}
+	/* The GitHub App replaces the token */
+	if flags.GitServerToken == "" && flags.GitHubAppID == 0 {
 		flags.GitServerToken = PromptSecret("Type the GitServerToken (Github):", true)
 	}
-	if flags.TunnelDomain == "" {
-		flags.TunnelDomain = PromptSecret("Type the TunnelDomain (Ngrok):", false)
+	if flags.GitLabToken == "" {
+		flags.GitLabToken = PromptSecret("Type the GitLabToken (GitLab):", false)
+	}
+	if flags.BitbucketToken == "" {
+		flags.BitbucketToken = PromptSecret("Type the BitbucketToken (Bitbucket):", false)
+	}
+	if flags.GiteaURL == "" {
+		flags.GiteaURL = PromptSecret("Type the GiteaURL (Gitea/Forgejo):", false)
+	}
+	if flags.GiteaURL != "" && flags.GiteaToken == "" {
+		flags.GiteaToken = PromptSecret("Type the GiteaToken (Gitea/Forgejo):", true)
+	}
+	if flags.TunnelDomain == "" && flags.AgentMode == gitfresh.AGENT_MODE_WEBHOOK {
+		/* Only ngrok is able to give a random domain */
+		flags.TunnelDomain = PromptSecret("Type the TunnelDomain ("+flags.TunnelKind+"):", flags.TunnelKind != gitfresh.TUNNEL_NGROK)
 	}
 	if flags.GitWorkDir == "" {
 		workdir, err := os.Getwd()
@@ -38,15 +138,70 @@ func configCmd(appConfigSvc *gitfresh.AppConfigSvc, flags *AppFlags) error {
 		}
 		flags.GitWorkDir = workdir
 	}
-	slog.Info("flags values", "content", fmt.Sprint(flags))
+	if flags.GitStrategy != "" && !slices.Contains(gitStrategies, flags.GitStrategy) {
+		return errors.New("unknown GitStrategy " + flags.GitStrategy)
+	}
+	/* The tokens are left out, they are only saved in the keyring or the vault */
+	slog.Info("flags values", "agent_mode", flags.AgentMode, "tunnel_kind", flags.TunnelKind, "git_workdir", flags.GitWorkDir)
+	/* Keep the git servers and workspaces added with `gitfresh config server|workspace` */
+	current, err := appConfigSvc.ReadConfigFile()
+	if err != nil {
+		slog.Info("there is not a previous config file", "error", err.Error())
+	}
+	if flags.GitHookSecret == "" {
+		flags.GitHookSecret = gitfresh.WebHookSecret()
+	}
+	/* The saved PollConcurrency is kept when the flag is not given */
+	if flags.PollConcurrency == 0 {
+		flags.PollConcurrency = current.PollConcurrency
+	}
+	/* The hooks created before keep their marker */
+	installID := current.InstallID
+	if installID == "" {
+		installID = gitfresh.NewInstallID()
+	}
+	/* The hooks without the marker are found with the domain they send to */
+	previousDomain := current.PreviousTunnelDomain
+	if current.TunnelDomain != "" && current.TunnelDomain != flags.TunnelDomain {
+		previousDomain = current.TunnelDomain
+	}
 	config := &gitfresh.AppConfig{
-		TunnelToken:    flags.TunnelToken,
-		TunnelDomain:   flags.TunnelDomain,
-		GitServerToken: flags.GitServerToken,
-		GitWorkDir:     flags.GitWorkDir,
-		GitHookSecret:  gitfresh.WebHookSecret(),
+		AgentMode:            flags.AgentMode,
+		RelayURL:             flags.RelayURL,
+		RelayToken:           flags.RelayToken,
+		PollInterval:         flags.PollInterval,
+		PollConcurrency:      flags.PollConcurrency,
+		PollGitHubAPI:        flags.PollGitHubAPI,
+		RedeliverFailed:      flags.RedeliverFailed,
+		TunnelKind:           flags.TunnelKind,
+		TunnelToken:          flags.TunnelToken,
+		TunnelDomain:         flags.TunnelDomain,
+		PreviousTunnelDomain: previousDomain,
+		TunnelPort:           flags.TunnelPort,
+		TunnelSSHHost:        flags.TunnelSSHHost,
+		TunnelRemotePort:     flags.TunnelRemotePort,
+		GitServerToken:       flags.GitServerToken,
+		GitHubAppID:          flags.GitHubAppID,
+		GitHubAppKey:         appKey,
+		GitHubOrgHooks:       flags.GitHubOrgHooks,
+		GitLabToken:          flags.GitLabToken,
+		BitbucketToken:       flags.BitbucketToken,
+		GiteaURL:             flags.GiteaURL,
+		GiteaToken:           flags.GiteaToken,
+		GitServers:           current.GitServers,
+		Workspaces:           current.Workspaces,
+		GitWorkDir:           flags.GitWorkDir,
+		GitScanDepth:         flags.GitScanDepth,
+		GitStrategy:          flags.GitStrategy,
+		GitHookSecret:        flags.GitHookSecret,
+		InstallID:            installID,
+		/* The agent may save config.json meanwhile, the config is written over the one read */
+		Revision: current.Revision,
+	}
+	if !flags.SkipTokenCheck && !checkTokens(os.Stdout, gitServerSvc, config) {
+		return errors.New("config.json not written, fix the tokens or run again with -SkipTokenCheck")
 	}
-	err := appConfigSvc.CreateConfigFile(config)
+	err = appConfigSvc.CreateConfigFile(config)
 	if err != nil {
 		slog.Error("creating config file")
 		slog.Error(err.Error())
@@ -57,23 +212,265 @@ func configCmd(appConfigSvc *gitfresh.AppConfigSvc, flags *AppFlags) error {
 	return nil
 }
 
+/*
+checkTokens prints who every token belongs to and what it lacks, false when
+the agent would fail to open the tunnel or to create the webhooks
+*/
+func checkTokens(w io.Writer, gitServerSvc *gitfresh.GitServerSvc, config *gitfresh.AppConfig) bool {
+	renderText(w, "🔎 Checking the tokens...")
+	checks := []gitfresh.TokenCheck{}
+	if config.TunnelKind == gitfresh.TUNNEL_NGROK {
+		checks = append(checks, gitfresh.TokenCheck{Host: "ngrok", Err: checkNgrokToken(config.TunnelToken)})
+	}
+	checks = append(checks, gitServerSvc.CheckTokens(config)...)
+	ok := true
+	for i, c := range checks {
+		/* The poll mode doesn't create webhooks */
+		if config.AgentMode == gitfresh.AGENT_MODE_POLL {
+			checks[i].Missing = nil
+		}
+		if c.Err != nil || len(checks[i].Missing) > 0 {
+			ok = false
+		}
+	}
+	renderTokenChecks(w, checks)
+	return ok
+}
+
+/*
+checkNgrokToken opens a test session, ngrok rejects the invalid tokens. The free
+accounts have a single session, so a running agent makes ngrok answer ERR_NGROK_108
+after accepting the token.
+*/
+func checkNgrokToken(token string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*15)
+	defer cancel()
+	session, err := ngrok.Connect(ctx, ngrok.WithAuthtoken(token))
+	if err != nil && strings.Contains(err.Error(), "ERR_NGROK_108") {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return session.Close()
+}
+
+type ServerFlags struct {
+	Kind           string `name:"Kind" description:"Git server kind: github, gitlab, bitbucket or gitea"`
+	Host           string `name:"Host" description:"Web host used to match the repository remotes.\nFor example: ghe.company.com"`
+	APIURL         string `name:"APIURL" description:"API base URL. For example: https://ghe.company.com/api/v3\nBy default it is guessed from the Kind and Host"`
+	WebURL         string `name:"WebURL" description:"Optional web URL used to print repository links.\nFor example: http://git.company.com:3000"`
+	Token          string `name:"Token" description:"Token with permissions to manage the repository webhooks"`
+	AppID          int64  `name:"AppID" description:"ID of a GitHub App used instead of the Token, only for github"`
+	AppKey         string `name:"AppKey" description:"Path to the .pem private key of the GitHub App"`
+	OrgHooks       bool   `name:"OrgHooks" description:"Create one webhook for every organization where the GitHub App is installed"`
+	SkipTokenCheck bool   `name:"SkipTokenCheck" description:"Save the server even when the token is rejected or lacks a scope"`
+}
+
+/* readAppKey loads the private key of the GitHub App, it is saved with the other secrets */
+func readAppKey(appID int64, path string) (string, error) {
+	if appID == 0 {
+		return "", nil
+	}
+	for path == "" {
+		path = PromptSecret("Type the path of the GitHub App private key (.pem):", true)
+	}
+	key, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	if _, err := gitfresh.NewGitHubApp(nil, nil, "", appID, string(key)); err != nil {
+		return "", err
+	}
+	return string(key), nil
+}
+
+func configServerCmd(appConfigSvc *gitfresh.AppConfigSvc, gitServerSvc *gitfresh.GitServerSvc, flags *ServerFlags) error {
+	config, err := appConfigSvc.ReadConfigFile()
+	if err != nil {
+		println("Please, run the following command first:\n\n gitfresh config \n")
+		return err
+	}
+	kinds := []string{
+		gitfresh.GIT_PROVIDER_GITHUB,
+		gitfresh.GIT_PROVIDER_GITLAB,
+		gitfresh.GIT_PROVIDER_BITBUCKET,
+		gitfresh.GIT_PROVIDER_GITEA,
+	}
+	for !slices.Contains(kinds, flags.Kind) {
+		flags.Kind = PromptSecret("Type the git server Kind (github, gitlab, bitbucket, gitea):", true)
+	}
+	if flags.Host == "" && flags.WebURL == "" {
+		flags.Host = PromptSecret("Type the git server Host (ghe.company.com):", true)
+	}
+	if flags.AppID != 0 && flags.Kind != gitfresh.GIT_PROVIDER_GITHUB {
+		return errors.New("only the github servers support apps")
+	}
+	appKey, err := readAppKey(flags.AppID, flags.AppKey)
+	if err != nil {
+		return err
+	}
+	if flags.Token == "" && flags.AppID == 0 {
+		flags.Token = PromptSecret("Type the git server Token:", true)
+	}
+	server := gitfresh.GitServerConfig{
+		Kind:     flags.Kind,
+		Host:     flags.Host,
+		APIURL:   flags.APIURL,
+		WebURL:   flags.WebURL,
+		Token:    flags.Token,
+		AppID:    flags.AppID,
+		AppKey:   appKey,
+		OrgHooks: flags.OrgHooks,
+	}
+	/* The host tells the server of every remote, it must be known and not taken */
+	server.Host = gitfresh.GitServerHost(server)
+	if server.Host == "" {
+		return errors.New("the git server needs a Host or a WebURL with a host")
+	}
+	servers := []gitfresh.GitServerConfig{}
+	for _, s := range gitfresh.GitServers(&gitfresh.AppConfig{
+		GitServerToken: config.GitServerToken,
+		GitHubAppID:    config.GitHubAppID,
+		GitLabToken:    config.GitLabToken,
+		BitbucketToken: config.BitbucketToken,
+		GiteaURL:       config.GiteaURL,
+	}) {
+		if s.Host == server.Host && (s.Token != "" || s.AppID != 0) {
+			return errors.New(server.Host + " is already configured by gitfresh config")
+		}
+	}
+	for _, s := range config.GitServers {
+		if gitfresh.GitServerHost(s) != server.Host {
+			servers = append(servers, s)
+			continue
+		}
+		/* Saving the same server again replaces it */
+		if s.Kind != server.Kind {
+			return errors.New(server.Host + " is already configured as a " + s.Kind + " server")
+		}
+	}
+	check := &gitfresh.AppConfig{AgentMode: config.AgentMode, GitServers: []gitfresh.GitServerConfig{server}}
+	if !flags.SkipTokenCheck && !checkTokens(os.Stdout, gitServerSvc, check) {
+		return errors.New("config.json not written, fix the token or run again with -SkipTokenCheck")
+	}
+	config.GitServers = append(servers, server)
+	if err := appConfigSvc.CreateConfigFile(config); err != nil {
+		return err
+	}
+	renderText(os.Stdout, "✅ Git server saved! Now, run the following command: \n\n gitfresh scan \n")
+	return nil
+}
+
+type WorkspaceFlags struct {
+	Name           string `name:"Name" description:"Workspace name, used by: gitfresh scan -workspace <Name>"`
+	GitWorkDir     string `name:"GitWorkDir" description:"Git working directory of this workspace. Type the absolute path."`
+	GitScanDepth   int    `name:"GitScanDepth" description:"How many directory levels below the GitWorkDir are scanned. By default 3"`
+	GitServerToken string `name:"GitServerToken" description:"Optional Github token for this workspace, by default the global GitServerToken"`
+	SkipTokenCheck bool   `name:"SkipTokenCheck" description:"Save the workspace even when its tokens are rejected or lack a scope"`
+}
+
+func configWorkspaceCmd(appConfigSvc *gitfresh.AppConfigSvc, gitServerSvc *gitfresh.GitServerSvc, flags *WorkspaceFlags) error {
+	config, err := appConfigSvc.ReadConfigFile()
+	if err != nil {
+		println("Please, run the following command first:\n\n gitfresh config \n")
+		return err
+	}
+	/* The name is part of the registry file name */
+	validName := regexp.MustCompile(`^[a-zA-Z0-9_-]+$`)
+	for !validName.MatchString(flags.Name) || flags.Name == gitfresh.APP_DEFAULT_WORKSPACE {
+		flags.Name = PromptSecret("Type the workspace Name (letters, numbers, - and _):", true)
+	}
+	if flags.GitWorkDir == "" {
+		flags.GitWorkDir = PromptSecret("Type the workspace GitWorkDir:", true)
+	}
+	if flags.GitServerToken == "" {
+		flags.GitServerToken = PromptSecret("Type the GitServerToken (Github) of this workspace:", false)
+	}
+	workspace := gitfresh.WorkspaceConfig{
+		Name:           flags.Name,
+		GitWorkDir:     flags.GitWorkDir,
+		GitScanDepth:   flags.GitScanDepth,
+		GitServerToken: flags.GitServerToken,
+	}
+	workspaces := []gitfresh.WorkspaceConfig{}
+	for _, w := range config.Workspaces {
+		if w.Name != workspace.Name {
+			workspaces = append(workspaces, w)
+			continue
+		}
+		/* Keep the git servers of the workspace, they are edited by hand */
+		workspace.GitServers = w.GitServers
+	}
+	/* Only the tokens of the workspace, the others were checked by gitfresh config */
+	check := &gitfresh.AppConfig{AgentMode: config.AgentMode, GitServerToken: workspace.GitServerToken, GitServers: workspace.GitServers}
+	hasTokens := workspace.GitServerToken != "" || len(workspace.GitServers) > 0
+	if !flags.SkipTokenCheck && hasTokens && !checkTokens(os.Stdout, gitServerSvc, check) {
+		return errors.New("config.json not written, fix the tokens or run again with -SkipTokenCheck")
+	}
+	config.Workspaces = append(workspaces, workspace)
+	if err := appConfigSvc.CreateConfigFile(config); err != nil {
+		return err
+	}
+	renderText(os.Stdout, fmt.Sprintf("✅ Workspace saved! Now, run the following command: \n\n gitfresh scan -workspace %s \n", workspace.Name))
+	return nil
+}
+
+type StrategyFlags struct {
+	Repository string `name:"Repository" description:"Repository owner/name, every clone of it gets the strategy"`
+	Strategy   string `name:"Strategy" description:"ff-only, skip-if-dirty, autostash or fetch-only"`
+}
+
+func strategyCmd(repoSvc *gitfresh.GitRepositorySvc, flags *StrategyFlags) error {
+	repos, err := repoSvc.LoadRepositories()
+	if err != nil {
+		println("Please, run the following command first:\n\n gitfresh init \n")
+		return err
+	}
+	for !slices.Contains(gitStrategies, flags.Strategy) {
+		flags.Strategy = PromptSecret("Type the Strategy (ff-only, skip-if-dirty, autostash, fetch-only):", true)
+	}
+	n := 0
+	for _, r := range repos {
+		if strings.EqualFold(r.Owner+"/"+r.Name, flags.Repository) {
+			r.Strategy = flags.Strategy
+			n++
+		}
+	}
+	if n < 1 {
+		return errors.New("repository not registered " + flags.Repository)
+	}
+	if _, err := repoSvc.SaveRepositories(repos); err != nil {
+		return err
+	}
+	renderText(os.Stdout, fmt.Sprintf("✅ Strategy %s saved for %d clone(s) of %s", flags.Strategy, n, flags.Repository))
+	return nil
+}
+
 func initCmd(
 	repoSvc *gitfresh.GitRepositorySvc,
 	agentSvc *gitfresh.AgentSvc,
 	appConfigSvc *gitfresh.AppConfigSvc,
 	gitServerSvc *gitfresh.GitServerSvc,
+	workspace string,
 ) error {
-	config, err := appConfigSvc.ReadConfigFile()
+	appConfig, err := appConfigSvc.ReadConfigFile()
 	if err != nil {
 		return err
 	}
-	repos, err := repoSvc.ScanRepositories(config.GitWorkDir, gitfresh.APP_GIT_PROVIDER)
+	config, err := gitfresh.Workspace(appConfig, workspace)
+	if err != nil {
+		return err
+	}
+	report, err := repoSvc.ScanWorkspace(config.GitWorkDir, config.GitScanDepth, gitServerSvc.ProviderHosts(config)...)
 	if err != nil {
 		slog.Error(err.Error())
 		return err
 	}
+	repos := report.Repos
 	println("🌟 Repositories:\n")
-	renderRepos(repos, false)
+	renderRepos(repos, false, gitServerSvc, config)
+	renderSkipped(report.Skipped)
 	if len(repos) < 1 {
 		println("The scanner didn't find available repositories")
 		return nil
@@ -104,16 +501,29 @@ func initCmd(
 		return err
 	}
 	renderVerbose("\nGitFresh Agent is running!")
-	if config.TunnelDomain == "" {
+	if config.TunnelDomain == "" && (config.AgentMode == "" || config.AgentMode == gitfresh.AGENT_MODE_WEBHOOK) {
 		println("Saving TunnelDomain")
 		config.TunnelDomain = agent.TunnelDomain
-		err := appConfigSvc.CreateConfigFile(config)
+		/* The agent saves the domain ngrok gave it too */
+		err := appConfigSvc.UpdateConfigFile(func(app *gitfresh.AppConfig) bool {
+			if app.TunnelDomain != "" {
+				return false
+			}
+			app.TunnelDomain = agent.TunnelDomain
+			app.TunnelDomainAssigned = true
+			return true
+		})
 		if err != nil {
 			return err
 		}
 	}
 	fRepos := []*gitfresh.GitRepository{}
 	for i, r := range repos {
+		/* The poll mode refreshes the repositories without webhooks */
+		if config.AgentMode == gitfresh.AGENT_MODE_POLL {
+			fRepos = append(fRepos, repos[i])
+			continue
+		}
 		if err := gitServerSvc.CreateGitServerHook(r, config); err != nil {
 			slog.Error(err.Error())
 			continue
@@ -123,11 +533,14 @@ func initCmd(
 	if len(fRepos) < 1 {
 		return errors.New("creating webhook for repositories")
 	}
+	if saved, err := repoSvc.LoadRepositories(); err == nil {
+		gitfresh.KeepStrategies(saved, fRepos)
+	}
 	if _, err := repoSvc.SaveRepositories(fRepos); err != nil {
 		return err
 	}
 	renderText(os.Stdout, "\n🍃 Repositories to Refresh:\n")
-	renderRepos(fRepos, true)
+	renderRepos(fRepos, true, gitServerSvc, config)
 	return nil
 }
 
@@ -135,20 +548,32 @@ func scanCmd(
 	repoSvc *gitfresh.GitRepositorySvc,
 	appConfigSvc *gitfresh.AppConfigSvc,
 	gitServerSvc *gitfresh.GitServerSvc,
+	workspace string,
 ) error {
-	config, err := appConfigSvc.ReadConfigFile()
+	appConfig, err := appConfigSvc.ReadConfigFile()
 	if err != nil {
 		return err
 	}
-	repos, err := repoSvc.ScanRepositories(config.GitWorkDir, gitfresh.APP_GIT_PROVIDER)
+	config, err := gitfresh.Workspace(appConfig, workspace)
+	if err != nil {
+		return err
+	}
+	report, err := repoSvc.ScanWorkspace(config.GitWorkDir, config.GitScanDepth, gitServerSvc.ProviderHosts(config)...)
+	repos := report.Repos
 	println("🌟 Repositories:\n")
-	renderRepos(repos, false)
+	renderRepos(repos, false, gitServerSvc, config)
+	renderSkipped(report.Skipped)
 	if err != nil {
 		slog.Error(err.Error())
 		return err
 	}
 	fRepos := []*gitfresh.GitRepository{}
 	for i, r := range repos {
+		/* The poll mode refreshes the repositories without webhooks */
+		if config.AgentMode == gitfresh.AGENT_MODE_POLL {
+			fRepos = append(fRepos, repos[i])
+			continue
+		}
 		if err := gitServerSvc.CreateGitServerHook(r, config); err != nil {
 			slog.Error(err.Error())
 			continue
@@ -158,15 +583,21 @@ func scanCmd(
 	if len(fRepos) < 1 {
 		return errors.New("creating webhook for repositories")
 	}
+	if saved, err := repoSvc.LoadRepositories(); err == nil {
+		gitfresh.KeepStrategies(saved, fRepos)
+	}
 	if _, err := repoSvc.SaveRepositories(fRepos); err != nil {
 		return err
 	}
 	println("\n🍃 Repositories to Refresh:\n")
-	renderRepos(fRepos, true)
+	renderRepos(fRepos, true, gitServerSvc, config)
 	return nil
 }
 
-func statusCmd(agentSvc *gitfresh.AgentSvc) error {
+func statusCmd(agentSvc *gitfresh.AgentSvc, updateSvc *gitfresh.UpdateSvc) error {
+	if updates, err := updateSvc.Updates(); err == nil {
+		renderUpdates(updates)
+	}
 	ok, err := agentSvc.IsAgentRunning()
 	tick := time.NewTicker(time.Microsecond)
 	if !ok {
@@ -187,6 +618,414 @@ func statusCmd(agentSvc *gitfresh.AgentSvc) error {
 	return nil
 }
 
+/* hookedRepository is a repository with the config of its workspace, which has the tokens */
+type hookedRepository struct {
+	repo   *gitfresh.GitRepository
+	config *gitfresh.AppConfig
+}
+
+/* hookedRepositories gives every registered repository once, all its clones share the hooks */
+func hookedRepositories(appConfig *gitfresh.AppConfig, registry func(workspace string) *gitfresh.GitRepositorySvc) []hookedRepository {
+	all := []hookedRepository{}
+	seen := map[string]bool{}
+	for _, workspace := range gitfresh.WorkspaceNames(appConfig) {
+		config, err := gitfresh.Workspace(appConfig, workspace)
+		if err != nil {
+			slog.Error(err.Error())
+			continue
+		}
+		repos, err := registry(workspace).LoadRepositories()
+		if err != nil {
+			slog.Info("loading repositories", "workspace", workspace, "error", err.Error())
+			continue
+		}
+		for _, r := range repos {
+			if r.Provider == "" {
+				r.Provider = gitfresh.APP_GIT_PROVIDER
+			}
+			key := strings.ToLower(r.Provider + "/" + r.Owner + "/" + r.Name)
+			if seen[key] {
+				continue
+			}
+			seen[key] = true
+			all = append(all, hookedRepository{repo: r, config: config})
+		}
+	}
+	return all
+}
+
+func hooksListCmd(appConfigSvc *gitfresh.AppConfigSvc, registry func(workspace string) *gitfresh.GitRepositorySvc, gitServerSvc *gitfresh.GitServerSvc) error {
+	appConfig, err := appConfigSvc.ReadConfigFile()
+	if err != nil {
+		println("Please, run the following command first:\n\n gitfresh config \n")
+		return err
+	}
+	rows := []hookRow{}
+	for _, h := range hookedRepositories(appConfig, registry) {
+		name := h.repo.Owner + "/" + h.repo.Name
+		hooks, err := gitServerSvc.OwnHooks(h.repo, h.config)
+		if err != nil {
+			slog.Error("listing hooks", "repository", name, "error", err.Error())
+			rows = append(rows, hookRow{Repository: name, Status: "error: " + err.Error()})
+			continue
+		}
+		if len(hooks) == 0 {
+			rows = append(rows, hookRow{Repository: name, Status: "missing"})
+		}
+		current := gitServerSvc.HookURL(h.config)
+		for _, hook := range hooks {
+			row := hookRow{Repository: name, Hook: hook, Status: "ok"}
+			if hook.URL != current {
+				row.Status = "stale, run gitfresh hooks sync"
+			} else if !hook.Active {
+				row.Status = "inactive"
+			}
+			rows = append(rows, row)
+		}
+	}
+	if len(rows) < 1 {
+		println("No repositories registered, run the following command first:\n\n gitfresh init \n")
+		return nil
+	}
+	renderHooks(os.Stdout, rows)
+	return nil
+}
+
+/*
+hooksRemoveCmd deletes the hooks of the repositories. The hook of an organization
+is shared by all its repositories, so it is only deleted with -org.
+*/
+func hooksRemoveCmd(appConfigSvc *gitfresh.AppConfigSvc, registry func(workspace string) *gitfresh.GitRepositorySvc, gitServerSvc *gitfresh.GitServerSvc, args []string, org bool) error {
+	/* The flag typed after the repositories is not parsed by the cli */
+	names := []string{}
+	for _, arg := range args {
+		if arg == "-org" || arg == "--org" {
+			org = true
+			continue
+		}
+		names = append(names, arg)
+	}
+	if len(names) < 1 {
+		println("Please, type the repositories:\n\n gitfresh hooks remove apolo96/gitfresh \n")
+		return errors.New("no repositories to remove the hooks from")
+	}
+	appConfig, err := appConfigSvc.ReadConfigFile()
+	if err != nil {
+		return err
+	}
+	selected := []hookedRepository{}
+	for _, name := range names {
+		found := false
+		for _, h := range hookedRepositories(appConfig, registry) {
+			if strings.EqualFold(h.repo.Owner+"/"+h.repo.Name, name) || strings.EqualFold(h.repo.Name, name) {
+				selected = append(selected, h)
+				found = true
+			}
+		}
+		if !found {
+			return errors.New("repository not registered " + name)
+		}
+	}
+	for _, h := range selected {
+		shared, err := gitServerSvc.IsOrgHook(h.repo, h.config)
+		if err != nil {
+			return err
+		}
+		if shared && !org {
+			fmt.Printf("%s/%s sends its pushes through the hook of the %s organization, removing it stops the pushes of every repository of %s.\n", h.repo.Owner, h.repo.Name, h.repo.Owner, h.repo.Owner)
+			println("Remove the organization hook anyway with:\n\n gitfresh hooks remove -org " + h.repo.Owner + "/" + h.repo.Name + " \n")
+			return errors.New("the hook of the " + h.repo.Owner + " organization is shared")
+		}
+	}
+	if n := removeHooks(gitServerSvc, selected); n < 0 {
+		return errors.New("removing hooks")
+	}
+	return nil
+}
+
+/* hooksSyncCmd points the webhooks of every registered repository to the agent, creating the missing ones */
+func hooksSyncCmd(appConfigSvc *gitfresh.AppConfigSvc, registry func(workspace string) *gitfresh.GitRepositorySvc, gitServerSvc *gitfresh.GitServerSvc) error {
+	appConfig, err := appConfigSvc.ReadConfigFile()
+	if err != nil {
+		println("Please, run the following command first:\n\n gitfresh config \n")
+		return err
+	}
+	if appConfig.AgentMode == gitfresh.AGENT_MODE_POLL {
+		println("The poll mode refreshes the repositories without webhooks")
+		return nil
+	}
+	if appConfig.AgentMode != gitfresh.AGENT_MODE_RELAY && appConfig.TunnelDomain == "" {
+		println("The tunnel domain is unknown, start the agent first:\n\n gitfresh start \n")
+		return errors.New("syncing hooks without tunnel domain")
+	}
+	failed := false
+	for _, h := range hookedRepositories(appConfig, registry) {
+		name := h.repo.Owner + "/" + h.repo.Name
+		status, err := gitServerSvc.SyncGitServerHook(h.repo, h.config)
+		if err != nil {
+			slog.Error("syncing hook", "repository", name, "error", err.Error())
+			fmt.Printf("❌ Repository: %-25s | %s\n", name, err.Error())
+			failed = true
+			continue
+		}
+		fmt.Printf("🔗 Repository: %-25s | Hook %s: %s\n", name, status, gitServerSvc.HookURL(h.config))
+	}
+	if failed {
+		return errors.New("syncing hooks")
+	}
+	return nil
+}
+
+type SecretRotateFlags struct {
+	Grace string `name:"grace" description:"How long the previous secret is still accepted, for example 1h or 30m"`
+}
+
+/*
+secretRotateCmd moves the webhooks to a new secret. The agent accepts both
+secrets during the grace window, so the deliveries sent while the hooks are
+updated are not rejected, then it retires the previous one.
+*/
+func secretRotateCmd(
+	appConfigSvc *gitfresh.AppConfigSvc,
+	registry func(workspace string) *gitfresh.GitRepositorySvc,
+	gitServerSvc *gitfresh.GitServerSvc,
+	agentSvc *gitfresh.AgentSvc,
+	flags *SecretRotateFlags,
+) error {
+	grace := time.Second * gitfresh.APP_SECRET_GRACE
+	if flags.Grace != "" {
+		d, err := time.ParseDuration(flags.Grace)
+		if err != nil {
+			return errors.New("the grace must be a duration like 1h or 30m")
+		}
+		grace = d
+	}
+	appConfig, err := appConfigSvc.ReadConfigFile()
+	if err != nil {
+		println("Please, run the following command first:\n\n gitfresh config \n")
+		return err
+	}
+	if appConfig.AgentMode == gitfresh.AGENT_MODE_POLL {
+		println("The poll mode refreshes the repositories without webhooks")
+		return nil
+	}
+	/* ngrok checks the GitHub signatures at the edge with the secret the agent started with */
+	edge := gitfresh.EdgeVerifiesGitHub(appConfig, time.Now()) &&
+		appConfig.AgentMode != gitfresh.AGENT_MODE_RELAY &&
+		(appConfig.TunnelKind == "" || appConfig.TunnelKind == gitfresh.TUNNEL_NGROK)
+	secret := gitfresh.WebHookSecret()
+	/* The agent saves config.json too, when it retires a secret or ngrok gives it a new domain */
+	err = appConfigSvc.UpdateConfigFile(func(app *gitfresh.AppConfig) bool {
+		app.PreviousHookSecret = &gitfresh.RetiringSecret{
+			Secret: app.GitHookSecret,
+			Until:  time.Now().Add(grace),
+		}
+		app.GitHookSecret = secret
+		appConfig = app
+		return true
+	})
+	if err != nil {
+		return err
+	}
+	if ok, err := agentSvc.IsAgentRunning(); edge && (ok || err == nil) {
+		renderVerbose("\nRestarting GitFresh Agent with both secrets...")
+		if err := restartAgent(agentSvc); err != nil {
+			return err
+		}
+		/* The agent may have a new tunnel URL */
+		if appConfig, err = appConfigSvc.ReadConfigFile(); err != nil {
+			return err
+		}
+	}
+	failed := false
+	for _, h := range hookedRepositories(appConfig, registry) {
+		name := h.repo.Owner + "/" + h.repo.Name
+		if _, err := gitServerSvc.SyncGitServerHook(h.repo, h.config); err != nil {
+			slog.Error("rotating hook secret", "repository", name, "error", err.Error())
+			fmt.Printf("❌ Repository: %-25s | %s\n", name, err.Error())
+			failed = true
+			continue
+		}
+		fmt.Printf("🔑 Repository: %-25s | Hook secret rotated\n", name)
+	}
+	if appConfig.AgentMode == gitfresh.AGENT_MODE_RELAY {
+		println("\nShare the new GitHookSecret with your team, every agent of the relay needs it:\n\n gitfresh config -GitHookSecret <secret>\n")
+	}
+	retired := appConfig.PreviousHookSecret.Until.Format(time.DateTime)
+	if failed {
+		println("\nSome hooks keep the previous secret, it is accepted until " + retired + ". Try again with:\n\n gitfresh hooks sync \n")
+		return errors.New("rotating hook secret")
+	}
+	renderText(os.Stdout, "\n✅ Webhook secret rotated, the previous one is accepted until "+retired)
+	return nil
+}
+
+/* restartAgent stops the agent, waits for its queued updates and starts it again */
+func restartAgent(agentSvc *gitfresh.AgentSvc) error {
+	if err := agentSvc.StopAgent(); err != nil {
+		return err
+	}
+	deadline := time.Now().Add(time.Minute + time.Second*10)
+	for {
+		if ok, err := agentSvc.IsAgentRunning(); !ok && err != nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			return errors.New("the agent is still stopping, start it again with: gitfresh start")
+		}
+		time.Sleep(time.Millisecond * 500)
+	}
+	return startCmd(agentSvc)
+}
+
+/* removeHooks deletes the hooks of this installation, giving -1 when some failed */
+func removeHooks(gitServerSvc *gitfresh.GitServerSvc, repos []hookedRepository) int {
+	n, failed := 0, false
+	for _, h := range repos {
+		name := h.repo.Owner + "/" + h.repo.Name
+		hooks, err := gitServerSvc.OwnHooks(h.repo, h.config)
+		if err != nil {
+			slog.Error("listing hooks", "repository", name, "error", err.Error())
+			fmt.Printf("❌ Repository: %-25s | %s\n", name, err.Error())
+			failed = true
+			continue
+		}
+		for _, hook := range hooks {
+			if err := gitServerSvc.DeleteGitServerHook(h.repo, hook, h.config); err != nil {
+				slog.Error("deleting hook", "repository", name, "hook", hook.ID, "error", err.Error())
+				fmt.Printf("❌ Repository: %-25s | Hook: %s | %s\n", name, hook.URL, err.Error())
+				failed = true
+				continue
+			}
+			fmt.Printf("🗑️  Repository: %-25s | Hook: %s removed\n", name, hook.URL)
+			n++
+		}
+	}
+	if failed {
+		return -1
+	}
+	return n
+}
+
+type UninstallFlags struct {
+	Purge bool `name:"purge" description:"Also delete the secrets from the keyring and the ~/.gitfresh folder with the config, registries and logs"`
+}
+
+func uninstallCmd(
+	appConfigSvc *gitfresh.AppConfigSvc,
+	registry func(workspace string) *gitfresh.GitRepositorySvc,
+	gitServerSvc *gitfresh.GitServerSvc,
+	agentSvc *gitfresh.AgentSvc,
+	appFolder string,
+	flags *UninstallFlags,
+) error {
+	appConfig, err := appConfigSvc.ReadConfigFile()
+	failed := false
+	switch {
+	case err != nil:
+		slog.Info("there is not a config file", "error", err.Error())
+	/* The relay hook receives the pushes of the whole team */
+	case appConfig.AgentMode == gitfresh.AGENT_MODE_RELAY:
+		println("The relay hooks are shared by your team, remove them with: gitfresh hooks remove <repo>\n")
+	default:
+		failed = removeHooks(gitServerSvc, hookedRepositories(appConfig, registry)) < 0
+	}
+	if ok, err := agentSvc.IsAgentRunning(); ok || err == nil {
+		if err := agentSvc.StopAgent(); err != nil {
+			slog.Error("stopping agent", "error", err.Error())
+			failed = true
+		}
+	}
+	if failed {
+		println("\nSome hooks were not removed, so ~/.gitfresh is kept to try again")
+		return errors.New("uninstalling gitfresh")
+	}
+	if flags.Purge {
+		/* The keyring is out of the app folder */
+		if err := appConfigSvc.DeleteSecrets(); err != nil {
+			slog.Error("deleting secrets", "error", err.Error())
+			println("\nSome secrets were not deleted from the keyring, so ~/.gitfresh is kept to try again")
+			return err
+		}
+		println("🗑️  Secrets deleted")
+		if err := os.RemoveAll(appFolder); err != nil {
+			return err
+		}
+		println("🗑️  " + appFolder + " removed")
+	}
+	renderText(os.Stdout, "\n✅ GitFresh uninstalled, the binaries can be deleted now")
+	return nil
+}
+
+type HistoryFlags struct {
+	Repo   string `name:"repo" description:"Only the deliveries of a repository, owner/name or name"`
+	Since  string `name:"since" description:"Only the deliveries received in the last duration, for example 1h or 30m"`
+	Failed bool   `name:"failed" description:"Only the failed, skipped and rejected deliveries"`
+}
+
+func historyCmd(agentSvc *gitfresh.AgentSvc, historySvc *gitfresh.DeliveryLogSvc, flags *HistoryFlags) error {
+	filter := gitfresh.DeliveryFilter{Repository: flags.Repo, Failed: flags.Failed}
+	if flags.Since != "" {
+		since, err := time.ParseDuration(flags.Since)
+		if err != nil {
+			return errors.New("invalid since, use a duration like 1h or 30m")
+		}
+		filter.Since = time.Now().Add(-since)
+	}
+	/* The log file is read directly when the agent is stopped */
+	deliveries, err := agentSvc.Deliveries(filter)
+	if err != nil {
+		slog.Debug("asking the agent for the deliveries", "error", err.Error())
+		deliveries, err = historySvc.Deliveries(filter)
+	}
+	if err != nil {
+		slog.Error("reading delivery log", "error", err.Error())
+		return err
+	}
+	if len(deliveries) < 1 {
+		println("No deliveries found")
+		return nil
+	}
+	renderDeliveries(os.Stdout, deliveries)
+	return nil
+}
+
+func pullCmd(agentSvc *gitfresh.AgentSvc, args []string, all bool) error {
+	refresh := gitfresh.RefreshRequest{All: all}
+	/* The flag typed after the repositories is not parsed by the cli */
+	for _, arg := range args {
+		if arg == "-all" || arg == "--all" {
+			refresh.All = true
+			continue
+		}
+		refresh.Repositories = append(refresh.Repositories, arg)
+	}
+	if !refresh.All && len(refresh.Repositories) < 1 {
+		println("Please, type the repositories to refresh or use -all:\n\n gitfresh pull gitfresh apolo96/api \n")
+		return errors.New("no repositories to refresh")
+	}
+	if ok, _ := agentSvc.IsAgentRunning(); !ok {
+		println("❌ GitFresh Agent is not running!\n")
+		println("Please, run the following command:\n\n gitfresh start \n")
+		return errors.New("agent not running")
+	}
+	failed := 0
+	err := agentSvc.Refresh(refresh, func(event gitfresh.RefreshEvent) {
+		if event.Status == gitfresh.UPDATE_STATUS_FAILED {
+			failed++
+		}
+		renderRefresh(os.Stdout, event)
+	})
+	if err != nil {
+		slog.Error("refreshing repositories", "error", err.Error())
+		return err
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d repositories failed, run gitfresh history -failed to see the git output", failed)
+	}
+	return nil
+}
+
 func startCmd(agentSvc *gitfresh.AgentSvc) error {
 	/* Start Agent */
 	ok, err := agentSvc.IsAgentRunning()
@@ -38,31 +38,112 @@ func run(w io.Writer, args []string) error {
 	config := cli.NewSubCommand("config", "Configure the application parameters")
 	config.AddFlags(flags)
 	config.Action(func() error {
-		return configCmd(svcProvider.appConfig, flags)
+		return configCmd(svcProvider.appConfig, svcProvider.gitServer, flags)
+	})
+	serverFlags := &ServerFlags{}
+	configServer := config.NewSubCommand("server", "Add a git server instance like GitHub Enterprise or a self-hosted GitLab")
+	configServer.AddFlags(serverFlags)
+	configServer.Action(func() error {
+		return configServerCmd(svcProvider.appConfig, svcProvider.gitServer, serverFlags)
+	})
+	workspaceFlags := &WorkspaceFlags{}
+	configWorkspace := config.NewSubCommand("workspace", "Add a named workspace with its own GitWorkDir and tokens")
+	configWorkspace.AddFlags(workspaceFlags)
+	configWorkspace.Action(func() error {
+		return configWorkspaceCmd(svcProvider.appConfig, svcProvider.gitServer, workspaceFlags)
 	})
 	/* Init Command */
+	var workspace string
 	initCommand := cli.NewSubCommand("init", "Initialise the Workspace and Agent")
+	initCommand.StringFlag("workspace", "Workspace name, by default the GitWorkDir typed in gitfresh config", &workspace)
 	initCommand.Action(func() error {
 		return initCmd(
-			svcProvider.gitRepository,
+			svcProvider.gitRepository(workspace),
 			svcProvider.agent,
 			svcProvider.appConfig,
 			svcProvider.gitServer,
+			workspace,
 		)
 	})
 	/* Scan Command */
 	scan := cli.NewSubCommand("scan", "Discover new repositories to refresh")
+	scan.StringFlag("workspace", "Workspace name, by default the GitWorkDir typed in gitfresh config", &workspace)
 	scan.Action(func() error {
 		return scanCmd(
-			svcProvider.gitRepository,
+			svcProvider.gitRepository(workspace),
 			svcProvider.appConfig,
 			svcProvider.gitServer,
+			workspace,
 		)
 	})
+	/* Strategy Command */
+	strategyFlags := &StrategyFlags{}
+	strategy := cli.NewSubCommand("strategy", "Choose how the working copy of a repository is updated")
+	strategy.AddFlags(strategyFlags)
+	strategy.StringFlag("workspace", "Workspace name, by default the GitWorkDir typed in gitfresh config", &workspace)
+	strategy.Action(func() error {
+		return strategyCmd(svcProvider.gitRepository(workspace), strategyFlags)
+	})
 	/* Status Command */
 	status := cli.NewSubCommand("status", "Check Agent Status")
 	status.Action(func() error {
-		return statusCmd(svcProvider.agent)
+		return statusCmd(svcProvider.agent, svcProvider.updates)
+	})
+	/* History Command */
+	historyFlags := &HistoryFlags{}
+	history := cli.NewSubCommand("history", "Show the webhook deliveries received by the Agent")
+	history.AddFlags(historyFlags)
+	history.Action(func() error {
+		return historyCmd(svcProvider.agent, svcProvider.history, historyFlags)
+	})
+	/* Pull Command */
+	var all bool
+	pull := cli.NewSubCommand("pull", "Refresh repositories now through the Agent: gitfresh pull [repo...] [-all]")
+	pull.BoolFlag("all", "Refresh every registered repository", &all)
+	pull.Action(func() error {
+		return pullCmd(svcProvider.agent, pull.OtherArgs(), all)
+	})
+	/* Hooks Command */
+	hooks := cli.NewSubCommand("hooks", "Manage the webhooks created by gitfresh")
+	hooks.NewSubCommand("list", "List the webhooks of the registered repositories and check they reach the Agent").Action(func() error {
+		return hooksListCmd(svcProvider.appConfig, svcProvider.gitRepository, svcProvider.gitServer)
+	})
+	hooks.NewSubCommand("sync", "Point the webhooks to the current Agent URL and secret, creating the missing ones").Action(func() error {
+		return hooksSyncCmd(svcProvider.appConfig, svcProvider.gitRepository, svcProvider.gitServer)
+	})
+	var org bool
+	hooksRemove := hooks.NewSubCommand("remove", "Remove the webhooks of repositories: gitfresh hooks remove <repo...> [-org]")
+	hooksRemove.BoolFlag("org", "Also remove the webhook of the organization, shared by all its repositories", &org)
+	hooksRemove.Action(func() error {
+		return hooksRemoveCmd(svcProvider.appConfig, svcProvider.gitRepository, svcProvider.gitServer, hooksRemove.OtherArgs(), org)
+	})
+	/* Secret Command */
+	secret := cli.NewSubCommand("secret", "Manage the webhook secret")
+	secretRotateFlags := &SecretRotateFlags{}
+	secretRotate := secret.NewSubCommand("rotate", "Move every webhook to a new secret, the previous one is accepted during a grace window")
+	secretRotate.AddFlags(secretRotateFlags)
+	secretRotate.Action(func() error {
+		return secretRotateCmd(
+			svcProvider.appConfig,
+			svcProvider.gitRepository,
+			svcProvider.gitServer,
+			svcProvider.agent,
+			secretRotateFlags,
+		)
+	})
+	/* Uninstall Command */
+	uninstallFlags := &UninstallFlags{}
+	uninstall := cli.NewSubCommand("uninstall", "Remove every webhook created by gitfresh and stop the Agent")
+	uninstall.AddFlags(uninstallFlags)
+	uninstall.Action(func() error {
+		return uninstallCmd(
+			svcProvider.appConfig,
+			svcProvider.gitRepository,
+			svcProvider.gitServer,
+			svcProvider.agent,
+			svcProvider.appFolder,
+			uninstallFlags,
+		)
 	})
 	/* Start Command */
 	start := cli.NewSubCommand("start", "Start the Agent")
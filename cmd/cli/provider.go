@@ -19,7 +19,10 @@ type ServiceProvider struct {
 	gitServer     *gitfresh.GitServerSvc
 	agent         *gitfresh.AgentSvc
 	appConfig     *gitfresh.AppConfigSvc
-	gitRepository *gitfresh.GitRepositorySvc
+	gitRepository func(workspace string) *gitfresh.GitRepositorySvc
+	updates       *gitfresh.UpdateSvc
+	history       *gitfresh.DeliveryLogSvc
+	appFolder     string
 	logger        slogger
 }
 
@@ -39,15 +42,20 @@ func NewServiceProvider() (ServiceProvider, error) {
 		return ServiceProvider{}, err
 	}
 	path := filepath.Join(userPath, gitfresh.APP_FOLDER)
+	if err := gitfresh.SecureAppFolder(path); err != nil {
+		logger.Warn("securing app folder", "error", err.Error())
+	}
 	/* Services Provider */
 	appOS := &gitfresh.AppOS{}
-	gitRepoSvc := gitfresh.NewGitRepositorySvc(logger,
-		appOS,
-		&gitfresh.FlatFile{
-			Name: gitfresh.APP_REPOS_FILE_NAME,
-			Path: path,
-		},
-	)
+	gitRepoSvc := func(workspace string) *gitfresh.GitRepositorySvc {
+		return gitfresh.NewGitRepositorySvc(logger,
+			appOS,
+			&gitfresh.FlatFile{
+				Name: gitfresh.RepositoriesFileName(workspace),
+				Path: path,
+			},
+		)
+	}
 	gitfresh.DevMode = devMode
 	agentSvc := gitfresh.NewAgentSvc(logger,
 		appOS,
@@ -55,15 +63,23 @@ func NewServiceProvider() (ServiceProvider, error) {
 			Name: gitfresh.APP_AGENT_FILE,
 			Path: path,
 		},
-		&http.Client{Timeout: time.Second * 2},
+		/* Without a whole request timeout so gitfresh pull can stream the updates */
+		&http.Client{Transport: &http.Transport{ResponseHeaderTimeout: time.Second * 2}},
+	)
+	appConfigSvc := gitfresh.NewAppConfigSvc(
+		logger,
+		&gitfresh.FlatFile{Name: gitfresh.APP_CONFIG_FILE_NAME, Path: path},
+		gitfresh.NewSecretStores(logger, path)...,
 	)
-	appConfigSvc := gitfresh.NewAppConfigSvc(logger, &gitfresh.FlatFile{Name: gitfresh.APP_CONFIG_FILE_NAME, Path: path})
 	gitServerSvc := gitfresh.NewGitServerSvc(logger, &http.Client{Timeout: time.Second * 3})
 	sp := ServiceProvider{
 		gitServer:     gitServerSvc,
 		agent:         agentSvc,
 		appConfig:     appConfigSvc,
 		gitRepository: gitRepoSvc,
+		updates:       gitfresh.NewUpdateSvc(logger, &gitfresh.FlatFile{Name: gitfresh.APP_UPDATES_FILE, Path: path}),
+		appFolder:     path,
+		history:       gitfresh.NewDeliveryLogSvc(logger, &gitfresh.FlatFile{Name: gitfresh.APP_DELIVERIES_FILE, Path: path}),
 		logger: slogger{
 			log: logger,
 			closer: func() {
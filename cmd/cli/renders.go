@@ -3,6 +3,9 @@ package main
 import (
 	"fmt"
 	"io"
+	"strings"
+	"text/tabwriter"
+	"time"
 
 	"github.com/apolo96/gitfresh"
 )
@@ -15,16 +18,114 @@ func renderVerbose(text string) {
 	}
 }
 
-func renderRepos(rp []*gitfresh.GitRepository, fresh bool) {
+func renderRepos(rp []*gitfresh.GitRepository, fresh bool, gitServerSvc *gitfresh.GitServerSvc, config *gitfresh.AppConfig) {
 	for _, r := range rp {
-		url := fmt.Sprintf("https://github.com/%s/%s", r.Owner, r.Name)
+		url := gitServerSvc.RepositoryURL(r, config)
 		if fresh {
-			url = url + "/settings/hooks"
+			url = gitServerSvc.HooksPageURL(r, config)
 		}
 		fmt.Printf("Repository: %-25s | URL: %-20s\n", r.Name, url)
 	}
 }
 
+func renderSkipped(skipped []gitfresh.SkippedDir) {
+	if len(skipped) < 1 {
+		return
+	}
+	println("\n⏭️  Skipped directories:\n")
+	for _, s := range skipped {
+		fmt.Printf("Directory: %-25s | Reason: %s\n", s.Path, s.Reason)
+	}
+}
+
+func renderUpdates(updates []gitfresh.RepositoryUpdate) {
+	pending := []gitfresh.RepositoryUpdate{}
+	for _, u := range updates {
+		if u.Status != gitfresh.UPDATE_STATUS_UPDATED {
+			pending = append(pending, u)
+		}
+	}
+	if len(pending) < 1 {
+		return
+	}
+	println("⚠️  Repositories not updated:\n")
+	for _, u := range pending {
+		fmt.Printf("Repository: %-25s | Branch: %-15s | %s at %s: %s\n", u.Path, u.Branch, u.Status, u.Time.Format(time.DateTime), u.Reason)
+	}
+	println()
+}
+
+func renderDeliveries(w io.Writer, deliveries []gitfresh.Delivery) {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "RECEIVED\tREPOSITORY\tREF\tCOMMIT\tOUTCOME\tDURATION\tDELIVERY\tREASON")
+	for _, d := range deliveries {
+		commit := d.Commit
+		if len(commit) > 7 {
+			commit = commit[:7]
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n",
+			d.Received.Local().Format(time.DateTime),
+			d.Repository,
+			strings.TrimPrefix(d.Ref, "refs/heads/"),
+			commit,
+			d.Outcome,
+			d.Duration.Round(time.Millisecond),
+			d.ID,
+			d.Reason,
+		)
+	}
+	tw.Flush()
+}
+
+func renderRefresh(w io.Writer, event gitfresh.RefreshEvent) {
+	icon := map[string]string{
+		gitfresh.REFRESH_QUEUED:        "⏳",
+		gitfresh.UPDATE_STATUS_UPDATED: "✅",
+		gitfresh.UPDATE_STATUS_SKIPPED: "⚠️ ",
+		gitfresh.UPDATE_STATUS_FAILED:  "❌",
+	}[event.Status]
+	line := fmt.Sprintf("%s Repository: %-25s | Branch: %-15s | %s", icon, event.Repository, event.Branch, event.Status)
+	if event.Reason != "" {
+		line += ": " + event.Reason
+	}
+	fmt.Fprintln(w, line)
+}
+
+type hookRow struct {
+	Repository string
+	Hook       gitfresh.Hook
+	Status     string
+}
+
+func renderHooks(w io.Writer, rows []hookRow) {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "REPOSITORY\tHOOK\tURL\tSTATUS")
+	for _, r := range rows {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", r.Repository, r.Hook.ID, r.Hook.URL, r.Status)
+	}
+	tw.Flush()
+}
+
+func renderTokenChecks(w io.Writer, checks []gitfresh.TokenCheck) {
+	for _, c := range checks {
+		name := c.Host
+		if c.User != "" {
+			name += " as " + c.User
+		}
+		switch {
+		case c.Err != nil:
+			fmt.Fprintf(w, "❌ %s: %s\n", name, c.Err.Error())
+		case len(c.Missing) > 0:
+			fmt.Fprintf(w, "❌ %s, the token is missing: %s\n", name, strings.Join(c.Missing, ", "))
+		default:
+			fmt.Fprintf(w, "✅ %s\n", name)
+		}
+		if c.Note != "" {
+			fmt.Fprintf(w, "   ⚠️  %s\n", c.Note)
+		}
+	}
+}
+
 func renderText(w io.Writer, s string) {
 	fmt.Fprintln(w, s)
 }
@@ -1,10 +1,68 @@
 package gitfresh
 
 const APP_CONFIG_FILE_NAME = "config.json"
+
+/* Times a change is applied to config.json when another process saves it meanwhile */
+const APP_CONFIG_ATTEMPTS = 3
 const APP_FOLDER = ".gitfresh"
 const APP_REPOS_FILE_NAME = "repositories.json"
+const APP_DEFAULT_WORKSPACE = "default"
 const APP_AGENT_FILE = "agent.txt"
 const API_AGENT_HOST = "127.0.0.1:9191"
 const APP_AGENT_LOG_FILE = "agent-log.json"
 const APP_CLI_LOG_FILE = "cli-log.json"
+const APP_UPDATES_FILE = "updates.json"
+const APP_DELIVERIES_FILE = "deliveries.jsonl"
+const APP_DELIVERIES_LIMIT = 5000
+const APP_DEDUP_FILE = "delivered.json"
+const APP_DEDUP_LIMIT = 1000
+const APP_TUNNEL_PORT = 9292
+const APP_POLL_INTERVAL = 300
+const APP_POLL_CONCURRENCY = 4
+
+/* Seconds the previous webhook secret is accepted after gitfresh secret rotate */
+const APP_SECRET_GRACE = 3600
+const APP_RELAY_ADDR = ":9393"
+const APP_IGNORE_FILE = ".gitfreshignore"
+const APP_VAULT_FILE = "vault.json"
+const APP_VAULT_KEY_FILE = "vault.key"
+const APP_VAULT_ITERATIONS = 200000
+const APP_VAULT_KDF_PASSPHRASE = "pbkdf2-sha256"
+const APP_VAULT_KDF_KEY_FILE = "key-file"
+
+/* Seconds before the expiry of a GitHub App installation token when a new one is requested */
+const APP_GITHUB_TOKEN_MARGIN = 300
+const APP_PASSPHRASE_ENV = "GITFRESH_PASSPHRASE"
+const APP_SECRET_SERVICE = "gitfresh"
+const APP_SCAN_DEPTH = 3
 const APP_GIT_PROVIDER = "github.com"
+const APP_GITLAB_PROVIDER = "gitlab.com"
+const APP_BITBUCKET_PROVIDER = "bitbucket.org"
+const GITHUB_API_URL = "https://api.github.com"
+const GITLAB_API_URL = "https://gitlab.com/api/v4"
+const BITBUCKET_API_URL = "https://api.bitbucket.org/2.0"
+const GIT_PROVIDER_GITHUB = "github"
+const GIT_PROVIDER_GITLAB = "gitlab"
+const GIT_PROVIDER_BITBUCKET = "bitbucket"
+const GIT_PROVIDER_GITEA = "gitea"
+const GIT_STRATEGY_FAST_FORWARD = "ff-only"
+const GIT_STRATEGY_SKIP_DIRTY = "skip-if-dirty"
+const GIT_STRATEGY_AUTOSTASH = "autostash"
+const GIT_STRATEGY_FETCH_ONLY = "fetch-only"
+const UPDATE_STATUS_UPDATED = "updated"
+const UPDATE_STATUS_SKIPPED = "skipped"
+const UPDATE_STATUS_FAILED = "failed"
+const DELIVERY_IGNORED = "ignored"
+const DELIVERY_REJECTED = "rejected"
+const DELIVERY_COALESCED = "coalesced"
+const REFRESH_QUEUED = "queued"
+const TUNNEL_NGROK = "ngrok"
+const TUNNEL_CLOUDFLARED = "cloudflared"
+const TUNNEL_SSH = "ssh"
+const TUNNEL_NONE = "none"
+const AGENT_MODE_WEBHOOK = "webhook"
+const AGENT_MODE_POLL = "poll"
+const AGENT_MODE_RELAY = "relay"
+const HOOK_MARKER = "gitfresh"
+const HOOK_CREATED = "created"
+const HOOK_UPDATED = "updated"
@@ -0,0 +1,265 @@
+package gitfresh
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+/* Gitea & Forgejo Provider */
+type GiteaProvider struct {
+	logs       AppLogger
+	httpClient HttpClienter
+	host       string
+	apiURL     string
+	webURL     string
+	token      string
+}
+
+type giteaHook struct {
+	ID     int               `json:"id,omitempty"`
+	Type   string            `json:"type"`
+	Active bool              `json:"active"`
+	Events []string          `json:"events"`
+	Config map[string]string `json:"config"`
+}
+
+func NewGiteaProvider(l AppLogger, c HttpClienter, server GitServerConfig) *GiteaProvider {
+	return &GiteaProvider{
+		logs:       l,
+		httpClient: c,
+		host:       server.Host,
+		apiURL:     strings.TrimSuffix(server.APIURL, "/"),
+		webURL:     strings.TrimSuffix(server.WebURL, "/"),
+		token:      server.Token,
+	}
+}
+
+func (p GiteaProvider) Host() string {
+	return p.host
+}
+
+func (p GiteaProvider) RepositoryURL(repo *GitRepository) string {
+	return fmt.Sprintf("%s/%s/%s", p.webURL, repo.Owner, repo.Name)
+}
+
+func (p GiteaProvider) HooksPageURL(repo *GitRepository) string {
+	return p.RepositoryURL(repo) + "/settings/hooks"
+}
+
+func (p GiteaProvider) hooksURL(repo *GitRepository) string {
+	return fmt.Sprintf("%s/repos/%s/%s/hooks", p.apiURL, repo.Owner, repo.Name)
+}
+
+func (p GiteaProvider) newRequest(method, url string, body io.Reader) (*http.Request, error) {
+	req, err := http.NewRequest(method, url, body)
+	if err != nil {
+		p.logs.Error(err.Error())
+		return nil, err
+	}
+	req.Header.Set("Authorization", "token "+p.token)
+	req.Header.Set("Accept", "application/json")
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	return req, nil
+}
+
+/* CheckToken tells who the token belongs to, Gitea doesn't tell the scopes of the token */
+func (p GiteaProvider) CheckToken() (TokenCheck, error) {
+	req, err := p.newRequest("GET", p.apiURL+"/user", nil)
+	if err != nil {
+		return TokenCheck{}, err
+	}
+	user, _, err := tokenUser(p.httpClient, req, "login")
+	if err != nil {
+		return TokenCheck{}, err
+	}
+	return TokenCheck{User: user}, nil
+}
+
+func (p GiteaProvider) listHooks(repo *GitRepository) ([]giteaHook, error) {
+	req, err := p.newRequest("GET", p.hooksURL(repo), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := p.httpClient.Do(req)
+	if err != nil {
+		p.logs.Error(err.Error())
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.New("listing gitea hooks via http, response with " + resp.Status)
+	}
+	hooks := []giteaHook{}
+	if err := json.NewDecoder(resp.Body).Decode(&hooks); err != nil {
+		p.logs.Error(err.Error())
+		return nil, err
+	}
+	return hooks, nil
+}
+
+func (p GiteaProvider) CreateHook(repo *GitRepository, hookURL string, secret string) error {
+	/* Gitea accepts duplicated hooks, so look for ours before creating it */
+	hooks, err := p.listHooks(repo)
+	if err != nil {
+		return err
+	}
+	for _, h := range hooks {
+		if h.Config["url"] == hookURL {
+			p.logs.Info("hook already exists on this repository", "repo", repo.Name, "hook_id", h.ID)
+			return nil
+		}
+	}
+	jsonData, err := json.Marshal(giteaHook{
+		Type:   "gitea",
+		Active: true,
+		Events: []string{"push"},
+		Config: map[string]string{
+			"url":          hookURL,
+			"content_type": "json",
+			"secret":       secret,
+		},
+	})
+	if err != nil {
+		p.logs.Error(err.Error())
+		return err
+	}
+	req, err := p.newRequest("POST", p.hooksURL(repo), bytes.NewBuffer(jsonData))
+	if err != nil {
+		return err
+	}
+	resp, err := p.httpClient.Do(req)
+	if err != nil {
+		p.logs.Error(err.Error())
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		rb, _ := io.ReadAll(resp.Body)
+		p.logs.Info(string(rb), "url", p.hooksURL(repo))
+		return errors.New("creating gitea webhook via http, response with " + resp.Status)
+	}
+	return nil
+}
+
+func (p GiteaProvider) ListHooks(repo *GitRepository) ([]Hook, error) {
+	hooks, err := p.listHooks(repo)
+	if err != nil {
+		return nil, err
+	}
+	list := []Hook{}
+	for _, h := range hooks {
+		list = append(list, Hook{ID: strconv.Itoa(h.ID), URL: h.Config["url"], Active: h.Active})
+	}
+	return list, nil
+}
+
+func (p GiteaProvider) UpdateHook(repo *GitRepository, id string, hookURL string, secret string) error {
+	jsonData, err := json.Marshal(giteaHook{
+		Type:   "gitea",
+		Active: true,
+		Events: []string{"push"},
+		Config: map[string]string{
+			"url":          hookURL,
+			"content_type": "json",
+			"secret":       secret,
+		},
+	})
+	if err != nil {
+		p.logs.Error(err.Error())
+		return err
+	}
+	return p.send("PATCH", p.hooksURL(repo)+"/"+id, bytes.NewBuffer(jsonData), http.StatusOK)
+}
+
+func (p GiteaProvider) DeleteHook(repo *GitRepository, id string) error {
+	return p.send("DELETE", p.hooksURL(repo)+"/"+id, nil, http.StatusNoContent)
+}
+
+func (p GiteaProvider) send(method string, url string, body io.Reader, want int) error {
+	req, err := p.newRequest(method, url, body)
+	if err != nil {
+		return err
+	}
+	resp, err := p.httpClient.Do(req)
+	if err != nil {
+		p.logs.Error(err.Error())
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != want {
+		rb, _ := io.ReadAll(resp.Body)
+		p.logs.Info(string(rb), "url", url)
+		return errors.New(strings.ToLower(method) + " gitea webhook via http, response with " + resp.Status)
+	}
+	return nil
+}
+
+func giteaEvent(r *http.Request) string {
+	if event := r.Header.Get("X-Forgejo-Event"); event != "" {
+		return event
+	}
+	return r.Header.Get("X-Gitea-Event")
+}
+
+/*
+Gitea doesn't tell its host on the headers, the repository of the payload
+does, so every instance only takes its own deliveries
+*/
+func (p GiteaProvider) IsDelivery(r *http.Request, body []byte) bool {
+	if giteaEvent(r) == "" {
+		return false
+	}
+	var payload struct {
+		Repository struct {
+			HTMLURL  string `json:"html_url"`
+			CloneURL string `json:"clone_url"`
+		} `json:"repository"`
+	}
+	json.Unmarshal(body, &payload)
+	for _, repoURL := range []string{payload.Repository.HTMLURL, payload.Repository.CloneURL} {
+		if u, err := url.Parse(repoURL); err == nil && u.Host != "" {
+			return u.Hostname() == p.host
+		}
+	}
+	/* The events without repository can't be told apart */
+	return true
+}
+
+func (p GiteaProvider) VerifyDelivery(r *http.Request, body []byte, secret string) error {
+	signature := r.Header.Get("X-Forgejo-Signature")
+	if signature == "" {
+		signature = r.Header.Get("X-Gitea-Signature")
+	}
+	if !validHMACSHA256(signature, body, secret) {
+		return ErrInvalidSignature
+	}
+	return nil
+}
+
+/* Gitea push payloads follow the GitHub layout */
+func (p GiteaProvider) ParsePush(r *http.Request, body []byte) ([]*APIPayload, error) {
+	event := giteaEvent(r)
+	if event != "push" {
+		p.logs.Info("ignoring gitea event", "event", event)
+		return nil, ErrEventIgnored
+	}
+	payload := &APIPayload{}
+	if err := json.Unmarshal(body, payload); err != nil {
+		p.logs.Error(err.Error())
+		return nil, err
+	}
+	if !branchUpdate(payload.Ref, payload.Commit) {
+		p.logs.Info("ignoring gitea push", "ref", payload.Ref, "after", payload.Commit)
+		return nil, ErrEventIgnored
+	}
+	return []*APIPayload{payload}, nil
+}
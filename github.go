@@ -0,0 +1,409 @@
+package gitfresh
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/* GitHub Provider */
+type GitHubProvider struct {
+	logs       AppLogger
+	httpClient HttpClienter
+	host       string
+	apiURL     string
+	webURL     string
+	tokens     TokenSource
+	orgHooks   bool
+}
+
+func NewGitHubProvider(l AppLogger, c HttpClienter, server GitServerConfig) *GitHubProvider {
+	return &GitHubProvider{
+		logs:       l,
+		httpClient: c,
+		host:       server.Host,
+		apiURL:     strings.TrimSuffix(server.APIURL, "/"),
+		webURL:     strings.TrimSuffix(server.WebURL, "/"),
+		tokens:     staticToken(server.Token),
+		orgHooks:   server.OrgHooks,
+	}
+}
+
+func (p GitHubProvider) Host() string {
+	return p.host
+}
+
+func (p GitHubProvider) RepositoryURL(repo *GitRepository) string {
+	return fmt.Sprintf("%s/%s/%s", p.webURL, repo.Owner, repo.Name)
+}
+
+func (p GitHubProvider) HooksPageURL(repo *GitRepository) string {
+	return p.RepositoryURL(repo) + "/settings/hooks"
+}
+
+func (p GitHubProvider) CreateHook(repo *GitRepository, hookURL string, secret string) error {
+	url, err := p.hooksURL(repo)
+	if err != nil {
+		return err
+	}
+	webhook := Webhook{
+		Name:   "web",
+		Active: true,
+		Events: []string{"push"},
+		Config: map[string]string{
+			"url":          hookURL,
+			"content_type": "json",
+			"secret":       secret,
+			"insecure_ssl": "0",
+		},
+	}
+	jsonData, err := json.Marshal(webhook)
+	if err != nil {
+		p.logs.Error(err.Error())
+		return err
+	}
+	req, err := p.apiRequest("POST", url, repo.Owner, bytes.NewBuffer(jsonData))
+	if err != nil {
+		return err
+	}
+
+	resp, err := p.httpClient.Do(req)
+	if err != nil {
+		p.logs.Error(err.Error())
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		p.logs.Info(string(jsonData))
+		p.logs.Info(url)
+		rb, _ := io.ReadAll(resp.Body)
+		p.logs.Info(string(rb))
+		if resp.StatusCode == http.StatusUnprocessableEntity {
+			var errResponse struct {
+				Message string `json:"message"`
+				Errors  []struct {
+					Resource string `json:"resource"`
+					Code     string `json:"code"`
+					Message  string `json:"message"`
+				}
+				DocumentationURL string `json:"documentation_url"`
+			}
+			err := json.Unmarshal(rb, &errResponse)
+			if err != nil {
+				p.logs.Error(err.Error())
+			}
+			for _, e := range errResponse.Errors {
+				if e.Resource == "Hook" {
+					if strings.Contains(e.Message, "already exists") {
+						p.logs.Info(e.Message, "repo", repo.Name)
+						return nil
+					}
+				}
+			}
+		}
+		return errors.New("creating webhook via http, response with " + resp.Status)
+	}
+	return nil
+}
+
+/*
+Gitea and Forgejo also send X-GitHub-Event for compatibility and
+GitHub Enterprise Server tells its host on X-GitHub-Enterprise-Host
+*/
+func (p GitHubProvider) IsDelivery(r *http.Request, body []byte) bool {
+	if r.Header.Get("X-GitHub-Event") == "" ||
+		r.Header.Get("X-Gitea-Event") != "" ||
+		r.Header.Get("X-Forgejo-Event") != "" {
+		return false
+	}
+	enterprise := r.Header.Get("X-GitHub-Enterprise-Host")
+	if enterprise == "" {
+		return p.host == APP_GIT_PROVIDER
+	}
+	return enterprise == p.host
+}
+
+/* VerifyDelivery checks the X-Hub-Signature-256 header, the deliveries may not come through the ngrok edge */
+func (p GitHubProvider) VerifyDelivery(r *http.Request, body []byte, secret string) error {
+	signature, found := strings.CutPrefix(r.Header.Get("X-Hub-Signature-256"), "sha256=")
+	if !found || !validHMACSHA256(signature, body, secret) {
+		return ErrInvalidSignature
+	}
+	return nil
+}
+
+func (p GitHubProvider) ParsePush(r *http.Request, body []byte) ([]*APIPayload, error) {
+	event := r.Header.Get("X-GitHub-Event")
+	if event != "push" {
+		p.logs.Info("ignoring github event", "event", event, "hook_id", r.Header.Get("X-GitHub-Hook-ID"))
+		return nil, ErrEventIgnored
+	}
+	payload := &APIPayload{}
+	if err := json.Unmarshal(body, payload); err != nil {
+		p.logs.Error(err.Error())
+		return nil, err
+	}
+	if !branchUpdate(payload.Ref, payload.Commit) {
+		p.logs.Info("ignoring github push", "ref", payload.Ref, "after", payload.Commit)
+		return nil, ErrEventIgnored
+	}
+	return []*APIPayload{payload}, nil
+}
+
+/* BranchHead answers with ErrNotModified when the branch did not move since the etag */
+func (p GitHubProvider) BranchHead(repo *GitRepository, branch string, etag string) (string, string, error) {
+	url := fmt.Sprintf("%s/repos/%s/%s/branches/%s", p.apiURL, repo.Owner, repo.Name, branch)
+	req, err := p.apiRequest("GET", url, repo.Owner, nil)
+	if err != nil {
+		return "", "", err
+	}
+	if etag != "" {
+		req.Header.Set("If-None-Match", etag)
+	}
+	resp, err := p.httpClient.Do(req)
+	if err != nil {
+		p.logs.Error(err.Error())
+		return "", "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotModified {
+		return "", etag, ErrNotModified
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", "", errors.New("getting branch via http, response with " + resp.Status)
+	}
+	var head struct {
+		Commit struct {
+			SHA string `json:"sha"`
+		} `json:"commit"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&head); err != nil {
+		p.logs.Error(err.Error())
+		return "", "", err
+	}
+	return head.Commit.SHA, resp.Header.Get("ETag"), nil
+}
+
+/* RedeliverFailed sends again the failed deliveries of the hook, unless a later attempt succeeded */
+func (p GitHubProvider) RedeliverFailed(repo *GitRepository, hookURL string, since time.Time) (int, error) {
+	hookID, err := p.findHook(repo, hookURL)
+	if err != nil {
+		return 0, err
+	}
+	hooks, err := p.hooksURL(repo)
+	if err != nil {
+		return 0, err
+	}
+	url := fmt.Sprintf("%s/%s/deliveries?per_page=100", hooks, hookID)
+	var deliveries []struct {
+		ID          int64     `json:"id"`
+		GUID        string    `json:"guid"`
+		DeliveredAt time.Time `json:"delivered_at"`
+		StatusCode  int       `json:"status_code"`
+		Event       string    `json:"event"`
+	}
+	if err := p.getJSON(url, repo.Owner, &deliveries); err != nil {
+		return 0, err
+	}
+	/* The newest attempt comes first */
+	delivered := map[string]bool{}
+	failed := []int64{}
+	for _, d := range deliveries {
+		if d.DeliveredAt.Before(since) || d.Event != "push" || delivered[d.GUID] {
+			continue
+		}
+		delivered[d.GUID] = true
+		if d.StatusCode < 200 || d.StatusCode > 299 {
+			failed = append(failed, d.ID)
+		}
+	}
+	n := 0
+	for _, id := range failed {
+		url := fmt.Sprintf("%s/%s/deliveries/%d/attempts", hooks, hookID, id)
+		if err := p.send("POST", url, repo.Owner, nil, http.StatusAccepted); err != nil {
+			return n, err
+		}
+		n++
+	}
+	return n, nil
+}
+
+/* findHook gives the id of the repository hook sending to hookURL */
+func (p GitHubProvider) findHook(repo *GitRepository, hookURL string) (string, error) {
+	hooks, err := p.ListHooks(repo)
+	if err != nil {
+		return "", err
+	}
+	for _, h := range hooks {
+		if h.URL == hookURL {
+			return h.ID, nil
+		}
+	}
+	return "", errors.New("webhook not found for " + hookURL)
+}
+
+func (p GitHubProvider) ListHooks(repo *GitRepository) ([]Hook, error) {
+	url, err := p.hooksURL(repo)
+	if err != nil {
+		return nil, err
+	}
+	var hooks []struct {
+		ID     int64             `json:"id"`
+		Active bool              `json:"active"`
+		Config map[string]string `json:"config"`
+	}
+	if err := p.getJSON(url+"?per_page=100", repo.Owner, &hooks); err != nil {
+		return nil, err
+	}
+	list := []Hook{}
+	for _, h := range hooks {
+		list = append(list, Hook{ID: strconv.FormatInt(h.ID, 10), URL: h.Config["url"], Active: h.Active})
+	}
+	return list, nil
+}
+
+func (p GitHubProvider) UpdateHook(repo *GitRepository, id string, hookURL string, secret string) error {
+	/* The name of a hook can't be changed */
+	jsonData, err := json.Marshal(map[string]any{
+		"active": true,
+		"events": []string{"push"},
+		"config": map[string]string{
+			"url":          hookURL,
+			"content_type": "json",
+			"secret":       secret,
+			"insecure_ssl": "0",
+		},
+	})
+	if err != nil {
+		p.logs.Error(err.Error())
+		return err
+	}
+	url, err := p.hooksURL(repo)
+	if err != nil {
+		return err
+	}
+	return p.send("PATCH", url+"/"+id, repo.Owner, bytes.NewBuffer(jsonData), http.StatusOK)
+}
+
+func (p GitHubProvider) DeleteHook(repo *GitRepository, id string) error {
+	url, err := p.hooksURL(repo)
+	if err != nil {
+		return err
+	}
+	return p.send("DELETE", url+"/"+id, repo.Owner, nil, http.StatusNoContent)
+}
+
+/*
+CheckToken tells who the token belongs to. The classic tokens list their scopes
+on X-OAuth-Scopes, the fine-grained ones don't tell their permissions.
+*/
+func (p GitHubProvider) CheckToken() (TokenCheck, error) {
+	if app, ok := p.tokens.(*GitHubApp); ok {
+		return app.CheckPermissions(p.orgHooks)
+	}
+	req, err := p.apiRequest("GET", p.apiURL+"/user", "", nil)
+	if err != nil {
+		return TokenCheck{}, err
+	}
+	user, header, err := tokenUser(p.httpClient, req, "login")
+	if err != nil {
+		return TokenCheck{}, err
+	}
+	check := TokenCheck{User: user}
+	scopes := header.Values("X-OAuth-Scopes")
+	if len(scopes) < 1 {
+		check.Note = "fine-grained tokens need the Webhooks read and write permission of the repositories"
+		return check, nil
+	}
+	/* The repo scope includes the repository hooks */
+	if !hasScope(strings.Join(scopes, ","), "repo", "admin:repo_hook", "write:repo_hook") {
+		check.Missing = append(check.Missing, "admin:repo_hook scope")
+	}
+	return check, nil
+}
+
+/* IsOrgHook tells when the repository sends its pushes through the hook of its organization */
+func (p GitHubProvider) IsOrgHook(repo *GitRepository) (bool, error) {
+	app, ok := p.tokens.(*GitHubApp)
+	if !p.orgHooks || !ok {
+		return false, nil
+	}
+	return app.IsOrganization(repo.Owner)
+}
+
+/* hooksURL gives the hooks of the organization when they cover all its repositories, the ones of the repository otherwise */
+func (p GitHubProvider) hooksURL(repo *GitRepository) (string, error) {
+	org, err := p.IsOrgHook(repo)
+	if err != nil {
+		return "", err
+	}
+	if org {
+		return fmt.Sprintf("%s/orgs/%s/hooks", p.apiURL, repo.Owner), nil
+	}
+	return fmt.Sprintf("%s/repos/%s/%s/hooks", p.apiURL, repo.Owner, repo.Name), nil
+}
+
+/* send makes an API request answered with the status want and no content needed */
+func (p GitHubProvider) send(method string, url string, owner string, body io.Reader, want int) error {
+	req, err := p.apiRequest(method, url, owner, body)
+	if err != nil {
+		return err
+	}
+	resp, err := p.httpClient.Do(req)
+	if err != nil {
+		p.logs.Error(err.Error())
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != want {
+		rb, _ := io.ReadAll(resp.Body)
+		p.logs.Info(string(rb), "url", url)
+		return errors.New(strings.ToLower(method) + " " + url + ", response with " + resp.Status)
+	}
+	return nil
+}
+
+func (p GitHubProvider) getJSON(url string, owner string, v any) error {
+	req, err := p.apiRequest("GET", url, owner, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := p.httpClient.Do(req)
+	if err != nil {
+		p.logs.Error(err.Error())
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return errors.New("requesting " + url + ", response with " + resp.Status)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		p.logs.Error(err.Error())
+		return err
+	}
+	return nil
+}
+
+/* apiRequest is authenticated with the token of the owner of the repository */
+func (p GitHubProvider) apiRequest(method string, url string, owner string, body io.Reader) (*http.Request, error) {
+	token, err := p.tokens.Token(owner)
+	if err != nil {
+		p.logs.Error("getting github token", "owner", owner, "error", err.Error())
+		return nil, err
+	}
+	req, err := http.NewRequest(method, url, body)
+	if err != nil {
+		p.logs.Error(err.Error())
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Accept", "application/vnd.github+json")
+	req.Header.Set("X-GitHub-Api-Version", "2022-11-28")
+	return req, nil
+}
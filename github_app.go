@@ -0,0 +1,227 @@
+package gitfresh
+
+import (
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+/* staticToken is a personal access token, the same for every owner */
+type staticToken string
+
+func (t staticToken) Token(owner string) (string, error) {
+	return string(t), nil
+}
+
+type gitHubInstallation struct {
+	id      int64
+	org     bool
+	token   string
+	expires time.Time
+}
+
+/*
+GitHubApp authenticates as a GitHub App installed on the accounts of the
+repositories. A JWT signed with the private key of the app is exchanged for
+an installation token of every owner, which is kept until it is about to
+expire, so the org doesn't need personal access tokens with admin:repo_hook.
+*/
+type GitHubApp struct {
+	logs          AppLogger
+	httpClient    HttpClienter
+	apiURL        string
+	appID         int64
+	key           *rsa.PrivateKey
+	mu            sync.Mutex
+	installations map[string]*gitHubInstallation
+}
+
+func NewGitHubApp(l AppLogger, c HttpClienter, apiURL string, appID int64, privateKey string) (*GitHubApp, error) {
+	block, _ := pem.Decode([]byte(privateKey))
+	if block == nil {
+		return nil, errors.New("the GitHub App private key is not a PEM file")
+	}
+	/* GitHub gives PKCS#1 keys, the converted ones are PKCS#8 */
+	key, err := x509.ParsePKCS1PrivateKey(block.Bytes)
+	if err != nil {
+		parsed, err8 := x509.ParsePKCS8PrivateKey(block.Bytes)
+		rsaKey, ok := parsed.(*rsa.PrivateKey)
+		if err8 != nil || !ok {
+			return nil, errors.New("the GitHub App private key is not a RSA key: " + err.Error())
+		}
+		key = rsaKey
+	}
+	return &GitHubApp{
+		logs:          l,
+		httpClient:    c,
+		apiURL:        strings.TrimSuffix(apiURL, "/"),
+		appID:         appID,
+		key:           key,
+		installations: map[string]*gitHubInstallation{},
+	}, nil
+}
+
+/* JWT authenticates as the app itself, GitHub accepts them for 10 minutes at most */
+func (a *GitHubApp) JWT(now time.Time) (string, error) {
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT"})
+	claims, _ := json.Marshal(map[string]any{
+		/* Issued a minute ago in case the clock of the machine is ahead */
+		"iat": now.Add(-time.Minute).Unix(),
+		"exp": now.Add(time.Minute * 9).Unix(),
+		"iss": fmt.Sprint(a.appID),
+	})
+	unsigned := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(claims)
+	digest := sha256.Sum256([]byte(unsigned))
+	signature, err := rsa.SignPKCS1v15(nil, a.key, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", err
+	}
+	return unsigned + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+/* Token gives the installation token of the owner, a new one when it is about to expire */
+func (a *GitHubApp) Token(owner string) (string, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	installation, err := a.installation(owner)
+	if err != nil {
+		return "", err
+	}
+	if time.Until(installation.expires) > time.Second*APP_GITHUB_TOKEN_MARGIN {
+		return installation.token, nil
+	}
+	jwt, err := a.JWT(time.Now())
+	if err != nil {
+		return "", err
+	}
+	var token struct {
+		Token     string    `json:"token"`
+		ExpiresAt time.Time `json:"expires_at"`
+	}
+	url := fmt.Sprintf("%s/app/installations/%d/access_tokens", a.apiURL, installation.id)
+	if err := a.request("POST", url, jwt, http.StatusCreated, &token); err != nil {
+		return "", err
+	}
+	a.logs.Info("github app installation token created", "owner", owner, "expires", token.ExpiresAt.Format(time.RFC3339))
+	installation.token = token.Token
+	installation.expires = token.ExpiresAt
+	return installation.token, nil
+}
+
+/* IsOrganization tells if the app is installed on an organization, which can have hooks for all its repositories */
+func (a *GitHubApp) IsOrganization(owner string) (bool, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	installation, err := a.installation(owner)
+	if err != nil {
+		return false, err
+	}
+	return installation.org, nil
+}
+
+/* CheckPermissions tells the name of the app and the permissions it lacks to manage the webhooks */
+func (a *GitHubApp) CheckPermissions(orgHooks bool) (TokenCheck, error) {
+	jwt, err := a.JWT(time.Now())
+	if err != nil {
+		return TokenCheck{}, err
+	}
+	var app struct {
+		Slug        string            `json:"slug"`
+		Permissions map[string]string `json:"permissions"`
+	}
+	if err := a.request("GET", a.apiURL+"/app", jwt, http.StatusOK, &app); err != nil {
+		return TokenCheck{}, err
+	}
+	check := TokenCheck{User: app.Slug + "[bot]"}
+	if app.Permissions["repository_hooks"] != "write" {
+		check.Missing = append(check.Missing, "Webhooks read and write permission of the repositories")
+	}
+	if orgHooks && app.Permissions["organization_hooks"] != "write" {
+		check.Missing = append(check.Missing, "Webhooks read and write permission of the organizations")
+	}
+	return check, nil
+}
+
+/* installation finds the installation of the app on the account of the owner, the lock is held */
+func (a *GitHubApp) installation(owner string) (*gitHubInstallation, error) {
+	key := strings.ToLower(owner)
+	if installation, ok := a.installations[key]; ok {
+		return installation, nil
+	}
+	jwt, err := a.JWT(time.Now())
+	if err != nil {
+		return nil, err
+	}
+	var found struct {
+		ID      int64 `json:"id"`
+		Account struct {
+			Type string `json:"type"`
+		} `json:"account"`
+	}
+	err = a.request("GET", fmt.Sprintf("%s/orgs/%s/installation", a.apiURL, owner), jwt, http.StatusOK, &found)
+	if err != nil {
+		err = a.request("GET", fmt.Sprintf("%s/users/%s/installation", a.apiURL, owner), jwt, http.StatusOK, &found)
+	}
+	if err != nil {
+		return nil, errors.New("the GitHub App is not installed on " + owner + ": " + err.Error())
+	}
+	installation := &gitHubInstallation{id: found.ID, org: found.Account.Type == "Organization"}
+	a.installations[key] = installation
+	return installation, nil
+}
+
+func (a *GitHubApp) request(method string, url string, jwt string, want int, v any) error {
+	req, err := http.NewRequest(method, url, nil)
+	if err != nil {
+		a.logs.Error(err.Error())
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+jwt)
+	req.Header.Set("Accept", "application/vnd.github+json")
+	req.Header.Set("X-GitHub-Api-Version", "2022-11-28")
+	resp, err := a.httpClient.Do(req)
+	if err != nil {
+		a.logs.Error(err.Error())
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != want {
+		return errors.New("requesting " + url + ", response with " + resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+/* gitHubApps keeps the apps between the requests, so their installation tokens are reused */
+type gitHubApps struct {
+	mu   sync.Mutex
+	apps map[string]*GitHubApp
+}
+
+func (g *gitHubApps) app(l AppLogger, c HttpClienter, server GitServerConfig) (*GitHubApp, error) {
+	sum := sha256.Sum256([]byte(server.AppKey))
+	key := fmt.Sprintf("%s/%d/%x", server.Host, server.AppID, sum[:8])
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if app, ok := g.apps[key]; ok {
+		return app, nil
+	}
+	app, err := NewGitHubApp(l, c, server.APIURL, server.AppID, server.AppKey)
+	if err != nil {
+		return nil, err
+	}
+	if g.apps == nil {
+		g.apps = map[string]*GitHubApp{}
+	}
+	g.apps[key] = app
+	return app, nil
+}
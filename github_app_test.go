@@ -0,0 +1,196 @@
+package gitfresh
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func testAppKey(t *testing.T) (*rsa.PrivateKey, string) {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key, string(pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}))
+}
+
+/* testAppServer answers like the GitHub API with the app installed on the acme org and the lio user */
+func testAppServer(t *testing.T, key *rsa.PrivateKey, expires time.Duration) (*MockClient, *[]string) {
+	t.Helper()
+	calls := []string{}
+	issued := 0
+	client := &MockClient{DoFunc: func(req *http.Request) (*http.Response, error) {
+		calls = append(calls, req.Method+" "+req.URL.Path)
+		reply := func(status int, body string) (*http.Response, error) {
+			return &http.Response{StatusCode: status, Status: fmt.Sprint(status), Body: io.NopCloser(strings.NewReader(body))}, nil
+		}
+		auth := strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer ")
+		if strings.HasPrefix(req.URL.Path, "/app") || strings.HasSuffix(req.URL.Path, "/installation") {
+			parts := strings.Split(auth, ".")
+			digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+			signature, _ := base64.RawURLEncoding.DecodeString(parts[2])
+			if err := rsa.VerifyPKCS1v15(&key.PublicKey, crypto.SHA256, digest[:], signature); err != nil {
+				return reply(http.StatusUnauthorized, `{"message":"bad jwt"}`)
+			}
+		} else if !strings.HasPrefix(auth, "ghs_") {
+			return reply(http.StatusUnauthorized, `{"message":"Bad credentials"}`)
+		}
+		switch req.Method + " " + req.URL.Path {
+		case "GET /app":
+			return reply(http.StatusOK, `{"slug":"fresh","permissions":{"repository_hooks":"write","metadata":"read"}}`)
+		case "GET /orgs/acme/installation":
+			return reply(http.StatusOK, `{"id":11,"account":{"login":"acme","type":"Organization"}}`)
+		case "GET /users/lio/installation":
+			return reply(http.StatusOK, `{"id":22,"account":{"login":"lio","type":"User"}}`)
+		case "POST /app/installations/11/access_tokens", "POST /app/installations/22/access_tokens":
+			issued++
+			return reply(http.StatusCreated, fmt.Sprintf(`{"token":"ghs_%d","expires_at":"%s"}`, issued, time.Now().Add(expires).Format(time.RFC3339)))
+		case "POST /orgs/acme/hooks", "POST /repos/lio/dotfiles/hooks":
+			return reply(http.StatusCreated, `{}`)
+		}
+		return reply(http.StatusNotFound, `{"message":"Not Found"}`)
+	}}
+	return client, &calls
+}
+
+func TestGitHubApp_JWT(t *testing.T) {
+	key, pemKey := testAppKey(t)
+	app, err := NewGitHubApp(slog.Default(), &MockClient{}, GITHUB_API_URL, 1234, pemKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	jwt, err := app.JWT(now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parts := strings.Split(jwt, ".")
+	if len(parts) != 3 {
+		t.Fatalf("GitHubApp.JWT() = %s", jwt)
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	signature, _ := base64.RawURLEncoding.DecodeString(parts[2])
+	if err := rsa.VerifyPKCS1v15(&key.PublicKey, crypto.SHA256, digest[:], signature); err != nil {
+		t.Errorf("GitHubApp.JWT() signature: %v", err)
+	}
+	payload, _ := base64.RawURLEncoding.DecodeString(parts[1])
+	claims := struct {
+		Iat int64  `json:"iat"`
+		Exp int64  `json:"exp"`
+		Iss string `json:"iss"`
+	}{}
+	json.Unmarshal(payload, &claims)
+	if claims.Iss != "1234" || claims.Exp-claims.Iat > 600 || claims.Iat > now.Unix() {
+		t.Errorf("GitHubApp.JWT() claims = %+v", claims)
+	}
+	if _, err := NewGitHubApp(slog.Default(), &MockClient{}, GITHUB_API_URL, 1234, "ghp_not_a_key"); err == nil {
+		t.Error("NewGitHubApp() with a token as key, want an error")
+	}
+}
+
+func TestGitHubApp_Token(t *testing.T) {
+	key, pemKey := testAppKey(t)
+	tests := []struct {
+		name    string
+		expires time.Duration
+		want    []string
+	}{
+		{name: "cached", expires: time.Hour, want: []string{"ghs_1", "ghs_1"}},
+		/* A token about to expire is replaced before it is used */
+		{name: "refreshed", expires: time.Minute, want: []string{"ghs_1", "ghs_2"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, calls := testAppServer(t, key, tt.expires)
+			app, _ := NewGitHubApp(slog.Default(), client, GITHUB_API_URL, 1234, pemKey)
+			tokens := []string{}
+			for range 2 {
+				token, err := app.Token("acme")
+				if err != nil {
+					t.Fatal(err)
+				}
+				tokens = append(tokens, token)
+			}
+			if diff := cmp.Diff(tokens, tt.want); diff != "" {
+				t.Error("GitHubApp.Token() = ", diff)
+			}
+			installations := 0
+			for _, c := range *calls {
+				if strings.HasSuffix(c, "/installation") {
+					installations++
+				}
+			}
+			if installations != 1 {
+				t.Errorf("GitHubApp looked the installation up %d times, want 1", installations)
+			}
+		})
+	}
+	client, _ := testAppServer(t, key, time.Hour)
+	app, _ := NewGitHubApp(slog.Default(), client, GITHUB_API_URL, 1234, pemKey)
+	if _, err := app.Token("stranger"); err == nil {
+		t.Error("GitHubApp.Token() for an account without the app, want an error")
+	}
+}
+
+func TestGitServerSvc_CreateGitServerHook_GitHubApp(t *testing.T) {
+	key, pemKey := testAppKey(t)
+	client, calls := testAppServer(t, key, time.Hour)
+	svc := NewGitServerSvc(slog.Default(), client)
+	config := &AppConfig{GitHubAppID: 1234, GitHubAppKey: pemKey, GitHubOrgHooks: true, TunnelDomain: "fresh.ngrok.app"}
+	for _, repo := range []*GitRepository{
+		{Owner: "acme", Name: "api", Provider: APP_GIT_PROVIDER},
+		{Owner: "lio", Name: "dotfiles", Provider: APP_GIT_PROVIDER},
+	} {
+		if err := svc.CreateGitServerHook(repo, config); err != nil {
+			t.Errorf("GitServerSvc.CreateGitServerHook(%s) error = %v", repo.Owner, err)
+		}
+	}
+	/* The organization gets a hook for all its repositories, the users one per repository */
+	hooks := []string{}
+	for _, c := range *calls {
+		if strings.HasSuffix(c, "/hooks") {
+			hooks = append(hooks, c)
+		}
+	}
+	if diff := cmp.Diff(hooks, []string{"POST /orgs/acme/hooks", "POST /repos/lio/dotfiles/hooks"}); diff != "" {
+		t.Error("GitServerSvc.CreateGitServerHook() = ", diff)
+	}
+	/* gitfresh hooks remove asks before deleting the hook shared by the organization */
+	for owner, want := range map[string]bool{"acme": true, "lio": false} {
+		shared, err := svc.IsOrgHook(&GitRepository{Owner: owner, Name: "api", Provider: APP_GIT_PROVIDER}, config)
+		if err != nil || shared != want {
+			t.Errorf("GitServerSvc.IsOrgHook(%s) = %v, %v, want %v", owner, shared, err, want)
+		}
+	}
+}
+
+func TestGitServerSvc_CheckTokens_GitHubApp(t *testing.T) {
+	key, pemKey := testAppKey(t)
+	client, _ := testAppServer(t, key, time.Hour)
+	svc := NewGitServerSvc(slog.Default(), client)
+	/* The app can manage the hooks of the repositories but not the ones of the organizations */
+	got := svc.CheckTokens(&AppConfig{GitHubAppID: 1234, GitHubAppKey: pemKey, GitHubOrgHooks: true})
+	want := []TokenCheck{{
+		Host:    APP_GIT_PROVIDER,
+		User:    "fresh[bot]",
+		Missing: []string{"Webhooks read and write permission of the organizations"},
+	}}
+	if diff := cmp.Diff(got, want); diff != "" {
+		t.Error("GitServerSvc.CheckTokens() = ", diff)
+	}
+}
@@ -0,0 +1,283 @@
+package gitfresh
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+/* GitLab Provider */
+type GitLabProvider struct {
+	logs       AppLogger
+	httpClient HttpClienter
+	host       string
+	apiURL     string
+	webURL     string
+	token      string
+	/* matchInstance is set when other GitLab servers are configured, the deliveries must tell their instance */
+	matchInstance bool
+}
+
+type gitlabHook struct {
+	ID                    int    `json:"id,omitempty"`
+	URL                   string `json:"url"`
+	PushEvents            bool   `json:"push_events"`
+	Token                 string `json:"token,omitempty"`
+	EnableSSLVerification bool   `json:"enable_ssl_verification"`
+}
+
+type gitlabPushPayload struct {
+	ObjectKind string `json:"object_kind"`
+	Ref        string `json:"ref"`
+	After      string `json:"after"`
+	Project    struct {
+		Name              string `json:"name"`
+		PathWithNamespace string `json:"path_with_namespace"`
+	} `json:"project"`
+}
+
+func NewGitLabProvider(l AppLogger, c HttpClienter, server GitServerConfig) *GitLabProvider {
+	return &GitLabProvider{
+		logs:       l,
+		httpClient: c,
+		host:       server.Host,
+		apiURL:     strings.TrimSuffix(server.APIURL, "/"),
+		webURL:     strings.TrimSuffix(server.WebURL, "/"),
+		token:      server.Token,
+	}
+}
+
+func (p GitLabProvider) Host() string {
+	return p.host
+}
+
+func (p GitLabProvider) RepositoryURL(repo *GitRepository) string {
+	return fmt.Sprintf("%s/%s/%s", p.webURL, repo.Owner, repo.Name)
+}
+
+func (p GitLabProvider) HooksPageURL(repo *GitRepository) string {
+	return p.RepositoryURL(repo) + "/-/hooks"
+}
+
+func (p GitLabProvider) hooksURL(repo *GitRepository) string {
+	project := url.PathEscape(repo.Owner + "/" + repo.Name)
+	return fmt.Sprintf("%s/projects/%s/hooks", p.apiURL, project)
+}
+
+func (p GitLabProvider) newRequest(method, url string, body io.Reader) (*http.Request, error) {
+	req, err := http.NewRequest(method, url, body)
+	if err != nil {
+		p.logs.Error(err.Error())
+		return nil, err
+	}
+	req.Header.Set("PRIVATE-TOKEN", p.token)
+	req.Header.Set("Accept", "application/json")
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	return req, nil
+}
+
+/* CheckToken tells who the token belongs to, the hooks need the api scope */
+func (p GitLabProvider) CheckToken() (TokenCheck, error) {
+	req, err := p.newRequest("GET", p.apiURL+"/user", nil)
+	if err != nil {
+		return TokenCheck{}, err
+	}
+	user, _, err := tokenUser(p.httpClient, req, "username")
+	if err != nil {
+		return TokenCheck{}, err
+	}
+	check := TokenCheck{User: user}
+	req, err = p.newRequest("GET", p.apiURL+"/personal_access_tokens/self", nil)
+	if err != nil {
+		return check, err
+	}
+	resp, err := p.httpClient.Do(req)
+	if err != nil {
+		p.logs.Error(err.Error())
+		return check, err
+	}
+	defer resp.Body.Close()
+	/* Before GitLab 15.5 the token can't tell its scopes */
+	if resp.StatusCode != http.StatusOK {
+		check.Note = "the scopes of the token can't be read, it needs the api scope"
+		return check, nil
+	}
+	var token struct {
+		Scopes []string `json:"scopes"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&token); err != nil {
+		return check, err
+	}
+	if !slices.Contains(token.Scopes, "api") {
+		check.Missing = append(check.Missing, "api scope")
+	}
+	return check, nil
+}
+
+func (p GitLabProvider) listHooks(repo *GitRepository) ([]gitlabHook, error) {
+	req, err := p.newRequest("GET", p.hooksURL(repo), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := p.httpClient.Do(req)
+	if err != nil {
+		p.logs.Error(err.Error())
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.New("listing gitlab hooks via http, response with " + resp.Status)
+	}
+	hooks := []gitlabHook{}
+	if err := json.NewDecoder(resp.Body).Decode(&hooks); err != nil {
+		p.logs.Error(err.Error())
+		return nil, err
+	}
+	return hooks, nil
+}
+
+func (p GitLabProvider) CreateHook(repo *GitRepository, hookURL string, secret string) error {
+	/* GitLab accepts duplicated hooks, so look for ours before creating it */
+	hooks, err := p.listHooks(repo)
+	if err != nil {
+		return err
+	}
+	for _, h := range hooks {
+		if h.URL == hookURL {
+			p.logs.Info("hook already exists on this repository", "repo", repo.Name, "hook_id", h.ID)
+			return nil
+		}
+	}
+	jsonData, err := json.Marshal(gitlabHook{
+		URL:                   hookURL,
+		PushEvents:            true,
+		Token:                 secret,
+		EnableSSLVerification: true,
+	})
+	if err != nil {
+		p.logs.Error(err.Error())
+		return err
+	}
+	req, err := p.newRequest("POST", p.hooksURL(repo), bytes.NewBuffer(jsonData))
+	if err != nil {
+		return err
+	}
+	resp, err := p.httpClient.Do(req)
+	if err != nil {
+		p.logs.Error(err.Error())
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		rb, _ := io.ReadAll(resp.Body)
+		p.logs.Info(string(rb), "url", p.hooksURL(repo))
+		return errors.New("creating gitlab webhook via http, response with " + resp.Status)
+	}
+	return nil
+}
+
+func (p GitLabProvider) ListHooks(repo *GitRepository) ([]Hook, error) {
+	hooks, err := p.listHooks(repo)
+	if err != nil {
+		return nil, err
+	}
+	list := []Hook{}
+	for _, h := range hooks {
+		/* GitLab disables the failing hooks on its own, they are still listed as active */
+		list = append(list, Hook{ID: strconv.Itoa(h.ID), URL: h.URL, Active: true})
+	}
+	return list, nil
+}
+
+func (p GitLabProvider) UpdateHook(repo *GitRepository, id string, hookURL string, secret string) error {
+	jsonData, err := json.Marshal(gitlabHook{
+		URL:                   hookURL,
+		PushEvents:            true,
+		Token:                 secret,
+		EnableSSLVerification: true,
+	})
+	if err != nil {
+		p.logs.Error(err.Error())
+		return err
+	}
+	return p.send("PUT", p.hooksURL(repo)+"/"+id, bytes.NewBuffer(jsonData), http.StatusOK)
+}
+
+func (p GitLabProvider) DeleteHook(repo *GitRepository, id string) error {
+	return p.send("DELETE", p.hooksURL(repo)+"/"+id, nil, http.StatusNoContent)
+}
+
+func (p GitLabProvider) send(method string, url string, body io.Reader, want int) error {
+	req, err := p.newRequest(method, url, body)
+	if err != nil {
+		return err
+	}
+	resp, err := p.httpClient.Do(req)
+	if err != nil {
+		p.logs.Error(err.Error())
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != want {
+		rb, _ := io.ReadAll(resp.Body)
+		p.logs.Info(string(rb), "url", url)
+		return errors.New(strings.ToLower(method) + " gitlab webhook via http, response with " + resp.Status)
+	}
+	return nil
+}
+
+func (p GitLabProvider) IsDelivery(r *http.Request, body []byte) bool {
+	if r.Header.Get("X-Gitlab-Event") == "" {
+		return false
+	}
+	instance, err := url.Parse(r.Header.Get("X-Gitlab-Instance"))
+	if err != nil || instance.Host == "" {
+		return !p.matchInstance
+	}
+	return instance.Hostname() == p.host
+}
+
+func (p GitLabProvider) VerifyDelivery(r *http.Request, body []byte, secret string) error {
+	token := r.Header.Get("X-Gitlab-Token")
+	/* Two empty values compare equal, a hook without secret is never trusted */
+	if token == "" || secret == "" || subtle.ConstantTimeCompare([]byte(token), []byte(secret)) != 1 {
+		return ErrInvalidSignature
+	}
+	return nil
+}
+
+func (p GitLabProvider) ParsePush(r *http.Request, body []byte) ([]*APIPayload, error) {
+	event := r.Header.Get("X-Gitlab-Event")
+	if event != "Push Hook" {
+		p.logs.Info("ignoring gitlab event", "event", event)
+		return nil, ErrEventIgnored
+	}
+	var push gitlabPushPayload
+	if err := json.Unmarshal(body, &push); err != nil {
+		p.logs.Error(err.Error())
+		return nil, err
+	}
+	if !branchUpdate(push.Ref, push.After) {
+		p.logs.Info("ignoring gitlab push", "ref", push.Ref, "after", push.After)
+		return nil, ErrEventIgnored
+	}
+	return []*APIPayload{{
+		Ref:    push.Ref,
+		Commit: push.After,
+		Repository: APIRepository{
+			Name:     path.Base(push.Project.PathWithNamespace),
+			FullName: push.Project.PathWithNamespace,
+		},
+	}}, nil
+}
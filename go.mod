@@ -7,6 +7,7 @@ require (
 	github.com/joho/godotenv v1.5.1
 	github.com/leaanthony/clir v1.6.0
 	golang.ngrok.com/ngrok v1.9.1
+	golang.org/x/crypto v0.13.0
 )
 
 require (
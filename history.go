@@ -0,0 +1,207 @@
+package gitfresh
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"net/http"
+	"path"
+	"slices"
+	"strings"
+	"sync"
+)
+
+/* The header with the delivery id of every git server */
+var deliveryHeaders = []string{
+	"X-GitHub-Delivery",
+	"X-Gitlab-Event-UUID",
+	"X-Request-UUID",
+	"X-Gitea-Delivery",
+	"X-Forgejo-Delivery",
+}
+
+func DeliveryID(r *http.Request) string {
+	for _, h := range deliveryHeaders {
+		if id := r.Header.Get(h); id != "" {
+			return id
+		}
+	}
+	return ""
+}
+
+/* DeliveryLogSvc keeps every delivery in a JSON lines file */
+type DeliveryLogSvc struct {
+	logs      AppLogger
+	fileStore FlatAppender
+	mu        sync.Mutex
+}
+
+func NewDeliveryLogSvc(l AppLogger, f FlatAppender) *DeliveryLogSvc {
+	return &DeliveryLogSvc{
+		logs:      l,
+		fileStore: f,
+	}
+}
+
+func (svc *DeliveryLogSvc) Record(delivery Delivery) error {
+	line, err := json.Marshal(delivery)
+	if err != nil {
+		svc.logs.Error(err.Error())
+		return err
+	}
+	svc.mu.Lock()
+	defer svc.mu.Unlock()
+	_, err = svc.fileStore.Append(append(line, '\n'))
+	return err
+}
+
+/* Deliveries gives the oldest deliveries first */
+func (svc *DeliveryLogSvc) Deliveries(filter DeliveryFilter) ([]Delivery, error) {
+	svc.mu.Lock()
+	all, err := svc.read()
+	svc.mu.Unlock()
+	if err != nil {
+		return all, err
+	}
+	deliveries := []Delivery{}
+	for _, d := range all {
+		if filter.Repository != "" && !strings.EqualFold(d.Repository, filter.Repository) &&
+			!strings.EqualFold(path.Base(d.Repository), filter.Repository) {
+			continue
+		}
+		if d.Received.Before(filter.Since) {
+			continue
+		}
+		if filter.Failed && !slices.Contains([]string{UPDATE_STATUS_FAILED, UPDATE_STATUS_SKIPPED, DELIVERY_REJECTED}, d.Outcome) {
+			continue
+		}
+		deliveries = append(deliveries, d)
+	}
+	return deliveries, nil
+}
+
+/* Trim keeps the last deliveries, the agent calls it on startup so the file doesn't grow forever */
+func (svc *DeliveryLogSvc) Trim(keep int) error {
+	svc.mu.Lock()
+	defer svc.mu.Unlock()
+	all, err := svc.read()
+	if err != nil || len(all) <= keep {
+		return err
+	}
+	var content bytes.Buffer
+	for _, d := range all[len(all)-keep:] {
+		line, err := json.Marshal(d)
+		if err != nil {
+			return err
+		}
+		content.Write(append(line, '\n'))
+	}
+	_, err = svc.fileStore.Write(content.Bytes())
+	return err
+}
+
+func (svc *DeliveryLogSvc) read() ([]Delivery, error) {
+	deliveries := []Delivery{}
+	content, err := svc.fileStore.Read()
+	if errors.Is(err, fs.ErrNotExist) {
+		return deliveries, nil
+	}
+	if err != nil {
+		return deliveries, err
+	}
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	scanner.Buffer(make([]byte, 64*1024), 16<<20)
+	for scanner.Scan() {
+		d := Delivery{}
+		/* A line cut by a crash is skipped */
+		if err := json.Unmarshal(scanner.Bytes(), &d); err != nil {
+			svc.logs.Warn("skipping delivery log line", "error", err.Error())
+			continue
+		}
+		deliveries = append(deliveries, d)
+	}
+	return deliveries, scanner.Err()
+}
+
+/* DedupSvc remembers the last delivery ids, so a redelivered or retried webhook is pulled once */
+type DedupSvc struct {
+	logs      AppLogger
+	fileStore FlatFiler
+	limit     int
+	mu        sync.Mutex
+	ids       []string
+	loaded    bool
+}
+
+func NewDedupSvc(l AppLogger, f FlatFiler, limit int) *DedupSvc {
+	return &DedupSvc{
+		logs:      l,
+		fileStore: f,
+		limit:     limit,
+	}
+}
+
+/* Seen reports whether the delivery was already received, otherwise it is remembered */
+func (svc *DedupSvc) Seen(id string) (bool, error) {
+	if id == "" {
+		return false, nil
+	}
+	svc.mu.Lock()
+	defer svc.mu.Unlock()
+	if err := svc.load(); err != nil {
+		return false, err
+	}
+	if slices.Contains(svc.ids, id) {
+		return true, nil
+	}
+	svc.ids = append(svc.ids, id)
+	if len(svc.ids) > svc.limit {
+		svc.ids = slices.Clone(svc.ids[len(svc.ids)-svc.limit:])
+	}
+	return false, svc.save()
+}
+
+/* Forget lets a redelivery of a failed delivery be pulled again */
+func (svc *DedupSvc) Forget(id string) error {
+	svc.mu.Lock()
+	defer svc.mu.Unlock()
+	if err := svc.load(); err != nil {
+		return err
+	}
+	i := slices.Index(svc.ids, id)
+	if id == "" || i < 0 {
+		return nil
+	}
+	svc.ids = slices.Delete(svc.ids, i, i+1)
+	return svc.save()
+}
+
+func (svc *DedupSvc) load() error {
+	if svc.loaded {
+		return nil
+	}
+	content, err := svc.fileStore.Read()
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	if len(content) > 0 {
+		if err := json.Unmarshal(content, &svc.ids); err != nil {
+			/* A broken file only costs a duplicated pull */
+			svc.logs.Warn("resetting delivery ids", "error", err.Error())
+			svc.ids = nil
+		}
+	}
+	svc.loaded = true
+	return nil
+}
+
+func (svc *DedupSvc) save() error {
+	data, err := json.Marshal(svc.ids)
+	if err != nil {
+		return err
+	}
+	_, err = svc.fileStore.Write(data)
+	return err
+}
@@ -0,0 +1,133 @@
+package gitfresh
+
+import (
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+/* MockAppendFile keeps a flat file in memory */
+type MockAppendFile struct {
+	data []byte
+}
+
+func (f *MockAppendFile) Write(data []byte) (n int, err error) {
+	f.data = data
+	return len(data), nil
+}
+
+func (f *MockAppendFile) Read() (n []byte, err error) {
+	if f.data == nil {
+		return nil, fs.ErrNotExist
+	}
+	return f.data, nil
+}
+
+func (f *MockAppendFile) Append(data []byte) (n int, err error) {
+	f.data = append(f.data, data...)
+	return len(data), nil
+}
+
+func TestDeliveryID(t *testing.T) {
+	for _, header := range []string{"X-GitHub-Delivery", "X-Gitlab-Event-UUID", "X-Request-UUID", "X-Gitea-Delivery"} {
+		r, _ := http.NewRequest("POST", "/", nil)
+		r.Header.Set(header, "72d3162e")
+		if got := DeliveryID(r); got != "72d3162e" {
+			t.Errorf("DeliveryID() with %s = %q", header, got)
+		}
+	}
+}
+
+func TestDeliveryLogSvc_Deliveries(t *testing.T) {
+	now := time.Now()
+	file := &MockAppendFile{}
+	svc := NewDeliveryLogSvc(slog.Default(), file)
+	deliveries := []Delivery{
+		{ID: "1", Repository: "apolo96/gitfresh", Received: now.Add(-time.Hour * 2), Outcome: UPDATE_STATUS_FAILED},
+		{ID: "2", Repository: "apolo96/gitfresh", Received: now.Add(-time.Minute), Outcome: UPDATE_STATUS_UPDATED},
+		{ID: "3", Repository: "apolo96/api", Received: now, Outcome: UPDATE_STATUS_SKIPPED},
+		{ID: "4", Received: now, Outcome: DELIVERY_REJECTED},
+	}
+	for _, d := range deliveries {
+		if err := svc.Record(d); err != nil {
+			t.Fatal(err)
+		}
+	}
+	/* A line cut by a crash */
+	file.Append([]byte(`{"id":"5","repos`))
+	tests := []struct {
+		name   string
+		filter DeliveryFilter
+		want   []string
+	}{
+		{name: "all", filter: DeliveryFilter{}, want: []string{"1", "2", "3", "4"}},
+		{name: "repository", filter: DeliveryFilter{Repository: "apolo96/GitFresh"}, want: []string{"1", "2"}},
+		{name: "repository name", filter: DeliveryFilter{Repository: "api"}, want: []string{"3"}},
+		{name: "since", filter: DeliveryFilter{Since: now.Add(-time.Hour)}, want: []string{"2", "3", "4"}},
+		{name: "failed", filter: DeliveryFilter{Failed: true}, want: []string{"1", "3", "4"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			list, err := svc.Deliveries(tt.filter)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ids := []string{}
+			for _, d := range list {
+				ids = append(ids, d.ID)
+			}
+			if diff := cmp.Diff(ids, tt.want); diff != "" {
+				t.Error("DeliveryLogSvc.Deliveries() = ", diff)
+			}
+		})
+	}
+}
+
+func TestDeliveryLogSvc_Trim(t *testing.T) {
+	svc := NewDeliveryLogSvc(slog.Default(), &MockAppendFile{})
+	for _, id := range []string{"1", "2", "3"} {
+		svc.Record(Delivery{ID: id})
+	}
+	if err := svc.Trim(2); err != nil {
+		t.Fatal(err)
+	}
+	list, _ := svc.Deliveries(DeliveryFilter{})
+	if len(list) != 2 || list[0].ID != "2" {
+		t.Errorf("DeliveryLogSvc.Trim() kept %+v", list)
+	}
+}
+
+func TestDedupSvc_Seen(t *testing.T) {
+	file := &MockAppendFile{}
+	svc := NewDedupSvc(slog.Default(), file, 2)
+	for _, tt := range []struct {
+		id   string
+		want bool
+	}{
+		{"a", false},
+		{"a", true},
+		{"b", false},
+		{"c", false},
+		/* Only the last 2 ids are kept */
+		{"a", false},
+		{"", false},
+		{"", false},
+	} {
+		if seen, _ := svc.Seen(tt.id); seen != tt.want {
+			t.Errorf("DedupSvc.Seen(%q) = %v, want %v", tt.id, seen, tt.want)
+		}
+	}
+	/* The ids survive a restart of the agent */
+	restarted := NewDedupSvc(slog.Default(), file, 2)
+	if seen, _ := restarted.Seen("c"); !seen {
+		t.Error("DedupSvc.Seen() forgot the persisted ids")
+	}
+	restarted.Forget("c")
+	if seen, _ := restarted.Seen("c"); seen {
+		t.Error("DedupSvc.Forget() kept the id")
+	}
+}
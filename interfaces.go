@@ -4,6 +4,7 @@ import (
 	"context"
 	"log/slog"
 	"net/http"
+	"time"
 )
 
 type AppLogger interface {
@@ -17,3 +18,50 @@ type AppLogger interface {
 type HttpClienter interface {
 	Do(req *http.Request) (*http.Response, error)
 }
+
+type GitProvider interface {
+	Host() string
+	RepositoryURL(repo *GitRepository) string
+	HooksPageURL(repo *GitRepository) string
+	CreateHook(repo *GitRepository, hookURL string, secret string) error
+	ListHooks(repo *GitRepository) ([]Hook, error)
+	UpdateHook(repo *GitRepository, id string, hookURL string, secret string) error
+	DeleteHook(repo *GitRepository, id string) error
+	IsDelivery(r *http.Request, body []byte) bool
+	VerifyDelivery(r *http.Request, body []byte, secret string) error
+	ParsePush(r *http.Request, body []byte) ([]*APIPayload, error)
+}
+
+/* TokenSource gives the token of the requests about the repositories of an owner */
+type TokenSource interface {
+	Token(owner string) (string, error)
+}
+
+/* SecretStore keeps the tokens and webhook secrets out of config.json */
+type SecretStore interface {
+	/* Name goes in the references of config.json, so every secret is read from the store that has it */
+	Name() string
+	Get(key string) (string, error)
+	Set(key string, value string) error
+	Delete(key string) error
+}
+
+/* TokenChecker asks the git server what the token lacks to manage the webhooks */
+type TokenChecker interface {
+	CheckToken() (TokenCheck, error)
+}
+
+/* Redeliverer asks the git server to send again the deliveries the agent missed */
+type Redeliverer interface {
+	RedeliverFailed(repo *GitRepository, hookURL string, since time.Time) (int, error)
+}
+
+/* BranchHeader gives the head of a branch with conditional requests that don't count against the rate limit */
+type BranchHeader interface {
+	BranchHead(repo *GitRepository, branch string, etag string) (sha string, newETag string, err error)
+}
+
+/* OrgHooker tells when the hook of a repository is the one of its organization, shared by all its repositories */
+type OrgHooker interface {
+	IsOrgHook(repo *GitRepository) (bool, error)
+}
@@ -1,16 +1,160 @@
 package gitfresh
 
+import "time"
+
 type AppConfig struct {
-	TunnelToken    string
-	TunnelDomain   string
-	GitServerToken string
+	/* AgentMode is webhook by default, the poll and relay modes work without tunnel */
+	AgentMode       string `json:",omitempty"`
+	RelayURL        string `json:",omitempty"`
+	RelayToken      string `json:",omitempty"`
+	PollInterval    int    `json:",omitempty"`
+	PollConcurrency int    `json:",omitempty"`
+	PollGitHubAPI   bool   `json:",omitempty"`
+	/* RedeliverFailed asks GitHub to redeliver the pushes missed while the agent was down */
+	RedeliverFailed bool `json:",omitempty"`
+	/* TunnelKind is ngrok by default, see the TUNNEL_ constants */
+	TunnelKind   string `json:",omitempty"`
+	TunnelToken  string
+	TunnelDomain string
+	/* TunnelDomainAssigned tells ngrok gave the TunnelDomain, so it changes on every start of the agent */
+	TunnelDomainAssigned bool `json:",omitempty"`
+	/* PreviousTunnelDomain finds the hooks created without the InstallID marker once the domain changed */
+	PreviousTunnelDomain string `json:",omitempty"`
+	TunnelPort           int    `json:",omitempty"`
+	TunnelSSHHost        string `json:",omitempty"`
+	TunnelRemotePort     int    `json:",omitempty"`
+	GitServerToken       string
+	/* GitHubAppID and GitHubAppKey authenticate on github.com as a GitHub App instead of the GitServerToken */
+	GitHubAppID    int64  `json:",omitempty"`
+	GitHubAppKey   string `json:",omitempty"`
+	GitHubOrgHooks bool   `json:",omitempty"`
+	GitLabToken    string
+	BitbucketToken string
+	GiteaURL       string
+	GiteaToken     string
+	GitServers     []GitServerConfig `json:",omitempty"`
 	GitWorkDir     string
+	GitScanDepth   int    `json:",omitempty"`
+	GitStrategy    string `json:",omitempty"`
 	GitHookSecret  string
+	/* PreviousHookSecret is still accepted while the webhooks move to the rotated secret */
+	PreviousHookSecret *RetiringSecret `json:",omitempty"`
+	/* InstallID marks the webhooks created by this installation, see GitServerSvc.IsOwnHook */
+	InstallID  string            `json:",omitempty"`
+	Workspaces []WorkspaceConfig `json:",omitempty"`
+	/* Revision changes on every save, a new secret changes config.json even when its reference is the same */
+	Revision int64 `json:",omitempty"`
+}
+
+/* RetiringSecret is a webhook secret accepted until the time it is retired */
+type RetiringSecret struct {
+	Secret string
+	Until  time.Time
+}
+
+/*
+WorkspaceConfig is a named GitWorkDir with its own repository registry.
+Its tokens and git servers replace the top level ones when they are set.
+*/
+type WorkspaceConfig struct {
+	Name           string
+	GitWorkDir     string
+	GitScanDepth   int               `json:",omitempty"`
+	GitServerToken string            `json:",omitempty"`
+	GitServers     []GitServerConfig `json:",omitempty"`
+}
+
+type GitServerConfig struct {
+	Kind   string
+	Host   string
+	APIURL string
+	WebURL string `json:",omitempty"`
+	Token  string
+	/* A GitHub App with its PEM private key replaces the Token */
+	AppID  int64  `json:",omitempty"`
+	AppKey string `json:",omitempty"`
+	/* OrgHooks creates a single hook for all the repositories of an organization where the app is installed */
+	OrgHooks bool `json:",omitempty"`
 }
 
 type GitRepository struct {
-	Owner string
-	Name  string
+	Owner    string
+	Name     string
+	Provider string `json:",omitempty"`
+	Path     string `json:",omitempty"`
+	/* Strategy is how the working copy is updated, by default ff-only */
+	Strategy string `json:",omitempty"`
+	/* Workspace is known when the registry is loaded, every workspace has its own file */
+	Workspace string `json:"-"`
+}
+
+/* RepositoryUpdate is the last result of refreshing a clone */
+type RepositoryUpdate struct {
+	Repository string
+	Path       string
+	Branch     string
+	Status     string
+	Reason     string `json:",omitempty"`
+	Time       time.Time
+}
+
+/* Delivery is a webhook received by the agent, or a poll, and what the agent did with it */
+type Delivery struct {
+	ID         string
+	Repository string
+	Provider   string `json:",omitempty"`
+	Path       string `json:",omitempty"`
+	Ref        string `json:",omitempty"`
+	Commit     string `json:",omitempty"`
+	Received   time.Time
+	Outcome    string
+	Reason     string `json:",omitempty"`
+	Output     string `json:",omitempty"`
+	Duration   time.Duration
+}
+
+type DeliveryFilter struct {
+	Repository string
+	Since      time.Time
+	/* Failed keeps the deliveries that did not update the repository */
+	Failed bool
+}
+
+/* RefreshRequest asks the agent to update repositories without a push */
+type RefreshRequest struct {
+	Repositories []string
+	All          bool
+}
+
+/* RefreshEvent is a line of the progress streamed by the agent */
+type RefreshEvent struct {
+	Repository string
+	Path       string `json:",omitempty"`
+	Branch     string `json:",omitempty"`
+	Status     string
+	Reason     string `json:",omitempty"`
+}
+
+/* TokenCheck tells who a token belongs to and the scopes or permissions it lacks to manage the webhooks */
+type TokenCheck struct {
+	Host    string
+	User    string
+	Missing []string
+	/* Note is a doubt the git server can't answer, like the permissions of a fine-grained token */
+	Note string
+	Err  error
+}
+
+/* Hook is a repository webhook as the git server lists it */
+type Hook struct {
+	ID     string
+	URL    string
+	Active bool
+}
+
+type ScanReport struct {
+	Repos   []*GitRepository
+	Skipped []SkippedDir
 }
 
 type Webhook struct {
@@ -28,11 +172,13 @@ type Agent struct {
 /* API */
 
 type APIRepository struct {
-	Name string `json:"name"`
+	Name     string `json:"name"`
+	FullName string `json:"full_name"`
 }
 
 type APIPayload struct {
 	Ref        string        `json:"ref"`
 	Repository APIRepository `json:"repository"`
 	Commit     string        `json:"after"`
+	Provider   string        `json:"-"`
 }
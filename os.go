@@ -2,6 +2,7 @@ package gitfresh
 
 import (
 	"context"
+	"io/fs"
 	"log/slog"
 	"os"
 	"os/exec"
@@ -18,7 +19,7 @@ type OSPather interface {
 }
 
 type OSDirer interface {
-	WalkDirFunc(path string, fn func(string)) error
+	DirFS(path string) fs.FS
 }
 
 type OSCommander interface {
@@ -48,17 +49,8 @@ func (AppOS) LookProgram(cmd string) (string, error) {
 	return exec.LookPath(cmd)
 }
 
-func (AppOS) WalkDirFunc(path string, fn func(string)) error {
-	dirs, err := os.ReadDir(path)
-	if err != nil {
-		return err
-	}
-	for _, f := range dirs {
-		if f.IsDir() {
-			fn(f.Name())
-		}
-	}
-	return nil
+func (AppOS) DirFS(path string) fs.FS {
+	return os.DirFS(path)
 }
 
 func (AppOS) UserHomePath() (string, error) {
@@ -66,7 +58,7 @@ func (AppOS) UserHomePath() (string, error) {
 }
 
 func (AppOS) StartProgram(path string, args ...string) (int, error) {
-	cmd := exec.Command(path)
+	cmd := exec.Command(path, args...)
 	if err := cmd.Start(); err != nil {
 		slog.Info(os.Getwd())
 		slog.LogAttrs(
@@ -102,6 +94,10 @@ func (AppOS) StopProgram(pid int) error {
 	if err != nil {
 		return err
 	}
+	/* A SIGTERM lets the agent stop its tunnel program */
+	if runtime.GOOS != "windows" {
+		return process.Signal(syscall.SIGTERM)
+	}
 	err = process.Kill()
 	if err != nil {
 		return err
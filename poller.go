@@ -0,0 +1,204 @@
+package gitfresh
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"strings"
+	"sync"
+	"time"
+)
+
+const pollMaxBackoff = time.Hour
+
+/* PullFunc updates a clone with the pushed ref, like GitRepositorySvc.Pull */
+type PullFunc func(repo *GitRepository, ref string) error
+
+type pollState struct {
+	next     time.Time
+	failures int
+	/* etags of the GitHub branches, by branch name */
+	etags map[string]string
+}
+
+/*
+PollerSvc refreshes the repositories without webhooks, comparing the remote
+branch head with the remote-tracking ref of the clone. A repository failing
+the check waits twice as long every time, up to an hour.
+*/
+type PollerSvc struct {
+	logs      AppLogger
+	appOS     OSDirCommand
+	gitServer *GitServerSvc
+	mu        sync.Mutex
+	state     map[string]*pollState
+	now       func() time.Time
+}
+
+func NewPollerSvc(l AppLogger, a OSDirCommand, g *GitServerSvc) *PollerSvc {
+	return &PollerSvc{
+		logs:      l,
+		appOS:     a,
+		gitServer: g,
+		state:     map[string]*pollState{},
+		now:       time.Now,
+	}
+}
+
+/* Interval gives the poll interval with a 10% jitter, every repository draws its own so the clones are not checked at the same time */
+func (svc *PollerSvc) Interval(config *AppConfig) time.Duration {
+	interval := pollInterval(config)
+	jitter := time.Duration(rand.Int63n(int64(interval)/5+1)) - interval/10
+	return interval + jitter
+}
+
+/* Next gives how long until a repository is due, at most an interval so the new repositories are found */
+func (svc *PollerSvc) Next(repos []*GitRepository, config *AppConfig) time.Duration {
+	wait := pollInterval(config)
+	svc.mu.Lock()
+	defer svc.mu.Unlock()
+	for _, repo := range repos {
+		state, ok := svc.state[repo.Path]
+		if !ok {
+			return time.Second
+		}
+		wait = min(wait, state.next.Sub(svc.now()))
+	}
+	return max(wait, time.Second)
+}
+
+/* Poll checks every repository that is due, a checked repository is due again after its Interval */
+func (svc *PollerSvc) Poll(ctx context.Context, repos []*GitRepository, config *AppConfig, pull PullFunc) {
+	svc.check(ctx, repos, config, pull, false)
+}
+
+/* CatchUp checks at once every repository that is not backing off, like after the machine slept */
+func (svc *PollerSvc) CatchUp(ctx context.Context, repos []*GitRepository, config *AppConfig, pull PullFunc) {
+	svc.check(ctx, repos, config, pull, true)
+}
+
+/* check polls the repositories with the tokens and git servers of their workspace */
+func (svc *PollerSvc) check(ctx context.Context, repos []*GitRepository, config *AppConfig, pull PullFunc, all bool) {
+	limit := config.PollConcurrency
+	if limit < 1 {
+		limit = APP_POLL_CONCURRENCY
+	}
+	interval := pollInterval(config)
+	sem := make(chan struct{}, limit)
+	var wg sync.WaitGroup
+	for _, repo := range repos {
+		state := svc.repoState(repo)
+		svc.mu.Lock()
+		due := !svc.now().Before(state.next) || (all && state.failures == 0)
+		svc.mu.Unlock()
+		if !due {
+			continue
+		}
+		select {
+		case <-ctx.Done():
+			wg.Wait()
+			return
+		case sem <- struct{}{}:
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+			ws, err := Workspace(config, repo.Workspace)
+			if err == nil {
+				err = svc.poll(repo, state, ws, pull)
+			}
+			svc.mu.Lock()
+			defer svc.mu.Unlock()
+			if err == nil || errors.Is(err, ErrUpdateSkipped) {
+				state.failures = 0
+				state.next = svc.now().Add(svc.Interval(config))
+				return
+			}
+			state.failures++
+			backoff := min(interval<<state.failures, pollMaxBackoff)
+			state.next = svc.now().Add(backoff)
+			svc.logs.Warn("polling repository", "path", repo.Path, "error", err.Error(), "retry_in", backoff.String())
+		}()
+	}
+	wg.Wait()
+}
+
+func pollInterval(config *AppConfig) time.Duration {
+	interval := time.Duration(config.PollInterval) * time.Second
+	if interval <= 0 {
+		interval = APP_POLL_INTERVAL * time.Second
+	}
+	return interval
+}
+
+func (svc *PollerSvc) repoState(repo *GitRepository) *pollState {
+	svc.mu.Lock()
+	defer svc.mu.Unlock()
+	state, ok := svc.state[repo.Path]
+	if !ok {
+		state = &pollState{etags: map[string]string{}}
+		svc.state[repo.Path] = state
+	}
+	return state
+}
+
+func (svc *PollerSvc) poll(repo *GitRepository, state *pollState, config *AppConfig, pull PullFunc) error {
+	git, err := svc.appOS.LookProgram("git")
+	if err != nil {
+		return err
+	}
+	head, err := svc.appOS.RunProgram(git, repo.Path, "rev-parse", "--abbrev-ref", "HEAD")
+	if err != nil {
+		return err
+	}
+	branch := strings.TrimSpace(string(head))
+	if branch == "HEAD" {
+		svc.logs.Debug("polling skipped with detached HEAD", "path", repo.Path)
+		return nil
+	}
+	local, _ := svc.appOS.RunProgram(git, repo.Path, "rev-parse", "--verify", "--quiet", "refs/remotes/origin/"+branch)
+	svc.mu.Lock()
+	etag := state.etags[branch]
+	svc.mu.Unlock()
+	remote, etag, err := svc.remoteHead(git, repo, branch, etag, config)
+	if errors.Is(err, ErrNotModified) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if remote != "" && remote != strings.TrimSpace(string(local)) {
+		svc.logs.Info("remote branch changed", "path", repo.Path, "branch", branch, "commit", remote)
+		if err := pull(repo, "refs/heads/"+branch); err != nil && !errors.Is(err, ErrUpdateSkipped) {
+			return err
+		}
+	}
+	/* The etag is kept once the clone has the commit, otherwise a failed pull would never be retried */
+	svc.mu.Lock()
+	state.etags[branch] = etag
+	svc.mu.Unlock()
+	return nil
+}
+
+/* remoteHead uses the GitHub API when enabled, ls-remote otherwise */
+func (svc *PollerSvc) remoteHead(git string, repo *GitRepository, branch string, etag string, config *AppConfig) (string, string, error) {
+	if config.PollGitHubAPI {
+		sha, newETag, err := svc.gitServer.BranchHead(repo, branch, etag, config)
+		if err == nil || errors.Is(err, ErrNotModified) {
+			return sha, newETag, err
+		}
+		if !errors.Is(err, errors.ErrUnsupported) {
+			svc.logs.Warn("getting branch head from the api", "path", repo.Path, "error", err.Error())
+		}
+	}
+	out, err := svc.appOS.RunProgram(git, repo.Path, "ls-remote", "origin", "refs/heads/"+branch)
+	if err != nil {
+		return "", "", err
+	}
+	fields := strings.Fields(string(out))
+	if len(fields) < 1 {
+		return "", "", nil
+	}
+	return fields[0], "", nil
+}
@@ -0,0 +1,243 @@
+package gitfresh
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestPollerSvc_Poll(t *testing.T) {
+	remotes := map[string]string{"api": "2222", "web": "3333"}
+	var mu sync.Mutex
+	calls := map[string]int{}
+	appOS := &MockAppOS{
+		RunFunc: func(path string, workdir string, args ...string) ([]byte, error) {
+			repo := filepath.Base(workdir)
+			cmd := strings.Join(args, " ")
+			switch {
+			case cmd == "rev-parse --abbrev-ref HEAD":
+				return []byte("main\n"), nil
+			case strings.HasPrefix(cmd, "rev-parse --verify"):
+				return []byte("3333\n"), nil
+			case strings.HasPrefix(cmd, "ls-remote"):
+				mu.Lock()
+				calls[repo]++
+				mu.Unlock()
+				if repo == "offline" {
+					return []byte("fatal: unable to access"), errors.New("exit status 128")
+				}
+				return []byte(remotes[repo] + "\trefs/heads/main\n"), nil
+			}
+			return nil, nil
+		},
+		LookFunc: mockAppOS.LookFunc,
+	}
+	repos := []*GitRepository{
+		{Owner: "team", Name: "api", Path: "/code/api"},
+		{Owner: "team", Name: "web", Path: "/code/web"},
+		{Owner: "team", Name: "offline", Path: "/code/offline"},
+	}
+	config := &AppConfig{PollInterval: 60}
+	svc := NewPollerSvc(slog.Default(), appOS, NewGitServerSvc(slog.Default(), &MockClient{}))
+	now := time.Now()
+	svc.now = func() time.Time { return now }
+	pulled := []string{}
+	pull := func(repo *GitRepository, ref string) error {
+		mu.Lock()
+		defer mu.Unlock()
+		pulled = append(pulled, repo.Name+" "+ref)
+		return nil
+	}
+	svc.Poll(context.Background(), repos, config, pull)
+	if diff := cmp.Diff(pulled, []string{"api refs/heads/main"}); diff != "" {
+		t.Error("PollerSvc.Poll() pulled = ", diff)
+	}
+	/* The checked repositories are due again after an interval and its jitter, the offline one backs off for two */
+	now = now.Add(time.Second * 30)
+	svc.Poll(context.Background(), repos, config, pull)
+	if calls["offline"] != 1 || calls["web"] != 1 {
+		t.Errorf("PollerSvc.Poll() ls-remote calls before the interval = %v", calls)
+	}
+	now = now.Add(time.Second * 40)
+	svc.Poll(context.Background(), repos, config, pull)
+	if calls["offline"] != 1 || calls["web"] != 2 {
+		t.Errorf("PollerSvc.Poll() ls-remote calls = %v", calls)
+	}
+	now = now.Add(time.Second * 70)
+	svc.Poll(context.Background(), repos, config, pull)
+	if calls["offline"] != 2 {
+		t.Errorf("PollerSvc.Poll() offline polled %d times after the backoff", calls["offline"])
+	}
+}
+
+func TestPollerSvc_Poll_Concurrency(t *testing.T) {
+	var mu sync.Mutex
+	running, maxRunning := 0, 0
+	appOS := &MockAppOS{
+		RunFunc: func(path string, workdir string, args ...string) ([]byte, error) {
+			if args[0] != "ls-remote" {
+				return []byte("main\n"), nil
+			}
+			mu.Lock()
+			running++
+			maxRunning = max(maxRunning, running)
+			mu.Unlock()
+			time.Sleep(time.Millisecond * 20)
+			mu.Lock()
+			running--
+			mu.Unlock()
+			return nil, nil
+		},
+		LookFunc: mockAppOS.LookFunc,
+	}
+	repos := []*GitRepository{}
+	for _, name := range []string{"a", "b", "c", "d", "e", "f"} {
+		repos = append(repos, &GitRepository{Owner: "team", Name: name, Path: "/code/" + name})
+	}
+	svc := NewPollerSvc(slog.Default(), appOS, NewGitServerSvc(slog.Default(), &MockClient{}))
+	svc.Poll(context.Background(), repos, &AppConfig{PollConcurrency: 2}, func(repo *GitRepository, ref string) error {
+		return nil
+	})
+	if maxRunning != 2 {
+		t.Errorf("PollerSvc.Poll() ran %d checks at the same time, want 2", maxRunning)
+	}
+}
+
+func TestPollerSvc_Poll_GitHubAPI(t *testing.T) {
+	requests := []string{}
+	client := &MockClient{DoFunc: func(req *http.Request) (*http.Response, error) {
+		requests = append(requests, req.URL.Path+" "+req.Header.Get("If-None-Match"))
+		if req.Header.Get("If-None-Match") == `"e1"` {
+			return &http.Response{StatusCode: http.StatusNotModified, Body: io.NopCloser(strings.NewReader(""))}, nil
+		}
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			Header:     http.Header{"Etag": []string{`"e1"`}},
+			Body:       io.NopCloser(strings.NewReader(`{"name":"main","commit":{"sha":"4444"}}`)),
+		}, nil
+	}}
+	git := []string{}
+	appOS := &MockAppOS{
+		RunFunc: func(path string, workdir string, args ...string) ([]byte, error) {
+			git = append(git, args[0])
+			if args[0] == "rev-parse" && args[1] == "--abbrev-ref" {
+				return []byte("main\n"), nil
+			}
+			return []byte("3333\n"), nil
+		},
+		LookFunc: mockAppOS.LookFunc,
+	}
+	repos := []*GitRepository{{Owner: "apolo96", Name: "gitfresh", Provider: "github.com", Path: "/code/gitfresh"}}
+	config := &AppConfig{GitServerToken: "ghp", PollGitHubAPI: true}
+	svc := NewPollerSvc(slog.Default(), appOS, NewGitServerSvc(slog.Default(), client))
+	pulls := 0
+	pull := func(repo *GitRepository, ref string) error {
+		pulls++
+		return nil
+	}
+	now := time.Now()
+	svc.now = func() time.Time { return now }
+	svc.Poll(context.Background(), repos, config, pull)
+	now = now.Add(time.Hour)
+	svc.Poll(context.Background(), repos, config, pull)
+	want := []string{"/repos/apolo96/gitfresh/branches/main ", `/repos/apolo96/gitfresh/branches/main "e1"`}
+	if diff := cmp.Diff(requests, want); diff != "" {
+		t.Error("PollerSvc.Poll() requests = ", diff)
+	}
+	if pulls != 1 {
+		t.Errorf("PollerSvc.Poll() pulled %d times, want 1", pulls)
+	}
+	if slices.Contains(git, "ls-remote") {
+		t.Error("PollerSvc.Poll() used ls-remote with the GitHub API enabled")
+	}
+}
+
+func TestPollerSvc_Next(t *testing.T) {
+	var mu sync.Mutex
+	checks := 0
+	appOS := &MockAppOS{
+		RunFunc: func(path string, workdir string, args ...string) ([]byte, error) {
+			if args[0] == "ls-remote" {
+				mu.Lock()
+				checks++
+				mu.Unlock()
+			}
+			return []byte("main\n"), nil
+		},
+		LookFunc: mockAppOS.LookFunc,
+	}
+	repos := []*GitRepository{}
+	for i := range 20 {
+		repos = append(repos, &GitRepository{Owner: "team", Name: fmt.Sprint(i), Path: fmt.Sprint("/code/", i)})
+	}
+	config := &AppConfig{PollInterval: 100}
+	svc := NewPollerSvc(slog.Default(), appOS, NewGitServerSvc(slog.Default(), &MockClient{}))
+	now := time.Now()
+	svc.now = func() time.Time { return now }
+	if got := svc.Next(repos, config); got != time.Second {
+		t.Errorf("PollerSvc.Next() = %v before the first poll, want 1s", got)
+	}
+	svc.Poll(context.Background(), repos, config, func(repo *GitRepository, ref string) error { return nil })
+	/* Every repository draws its own jitter */
+	next := map[time.Time]bool{}
+	for _, state := range svc.state {
+		if d := state.next.Sub(now); d < time.Second*90 || d > time.Second*110 {
+			t.Errorf("PollerSvc.Poll() scheduled a repository in %v, want 100s with a 10%% jitter", d)
+		}
+		next[state.next] = true
+	}
+	if len(next) < 2 {
+		t.Error("PollerSvc.Poll() scheduled every repository at the same time")
+	}
+	if got := svc.Next(repos, config); got < time.Second*90 || got > time.Second*110 {
+		t.Errorf("PollerSvc.Next() = %v, want the first repository due", got)
+	}
+	/* The catch-up checks the repositories that are not due yet */
+	svc.Poll(context.Background(), repos, config, func(repo *GitRepository, ref string) error { return nil })
+	svc.CatchUp(context.Background(), repos, config, func(repo *GitRepository, ref string) error { return nil })
+	if checks != 40 {
+		t.Errorf("PollerSvc checked the repositories %d times, want 40", checks)
+	}
+}
+
+func TestPollerSvc_Poll_Workspace(t *testing.T) {
+	tokens := []string{}
+	client := &MockClient{DoFunc: func(req *http.Request) (*http.Response, error) {
+		tokens = append(tokens, req.Header.Get("Authorization"))
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			Body:       io.NopCloser(strings.NewReader(`{"name":"main","commit":{"sha":"3333"}}`)),
+		}, nil
+	}}
+	appOS := &MockAppOS{
+		RunFunc: func(path string, workdir string, args ...string) ([]byte, error) {
+			if args[0] == "rev-parse" && args[1] == "--abbrev-ref" {
+				return []byte("main\n"), nil
+			}
+			return []byte("3333\n"), nil
+		},
+		LookFunc: mockAppOS.LookFunc,
+	}
+	repos := []*GitRepository{{Owner: "client", Name: "shop", Provider: "github.com", Path: "/client/shop", Workspace: "client"}}
+	config := &AppConfig{
+		GitServerToken: "ghp_personal",
+		PollGitHubAPI:  true,
+		Workspaces:     []WorkspaceConfig{{Name: "client", GitWorkDir: "/client", GitServerToken: "ghp_client"}},
+	}
+	svc := NewPollerSvc(slog.Default(), appOS, NewGitServerSvc(slog.Default(), client))
+	svc.Poll(context.Background(), repos, config, func(repo *GitRepository, ref string) error { return nil })
+	if diff := cmp.Diff(tokens, []string{"Bearer ghp_client"}); diff != "" {
+		t.Error("PollerSvc.Poll() authorization = ", diff)
+	}
+}
@@ -0,0 +1,12 @@
+package gitfresh
+
+import "strings"
+
+/*
+branchUpdate tells the pushes the agent pulls. A deleted branch is pushed with
+the zero commit and has nothing to fetch, the tags don't move any branch.
+*/
+func branchUpdate(ref string, commit string) bool {
+	deleted := commit != "" && strings.Trim(commit, "0") == ""
+	return strings.HasPrefix(ref, "refs/heads/") && !deleted
+}
@@ -0,0 +1,64 @@
+package gitfresh
+
+import (
+	"errors"
+	"net/url"
+	"strings"
+)
+
+type RemoteURL struct {
+	Host  string
+	Owner string
+	Name  string
+}
+
+var ErrRemoteURL = errors.New("unsupported git remote url")
+
+/*
+ParseRemoteURL understands every git remote form:
+https://[user[:token]@]host[:port]/owner/repo.git
+ssh://[user@]host[:port]/owner/repo.git
+git://host[:port]/owner/repo.git
+[user@]host:owner/repo.git (scp-like syntax)
+Owner keeps the whole namespace, like the nested GitLab groups "group/subgroup"
+*/
+func ParseRemoteURL(raw string) (*RemoteURL, error) {
+	raw = strings.TrimSpace(raw)
+	if raw == "" {
+		return nil, ErrRemoteURL
+	}
+	var host, path string
+	if strings.Contains(raw, "://") {
+		u, err := url.Parse(raw)
+		if err != nil {
+			return nil, errors.Join(ErrRemoteURL, err)
+		}
+		switch u.Scheme {
+		case "https", "http", "ssh", "git", "git+ssh", "ssh+git":
+		default:
+			return nil, ErrRemoteURL
+		}
+		host, path = u.Hostname(), u.Path
+	} else {
+		/* scp-like syntax, the colon must come before any slash */
+		colon := strings.Index(raw, ":")
+		slash := strings.Index(raw, "/")
+		if colon < 1 || (slash >= 0 && slash < colon) {
+			return nil, ErrRemoteURL
+		}
+		host, path = raw[:colon], raw[colon+1:]
+		if at := strings.LastIndex(host, "@"); at >= 0 {
+			host = host[at+1:]
+		}
+	}
+	path = strings.TrimSuffix(strings.Trim(path, "/"), ".git")
+	slash := strings.LastIndex(path, "/")
+	if host == "" || slash < 1 || slash == len(path)-1 {
+		return nil, ErrRemoteURL
+	}
+	return &RemoteURL{
+		Host:  strings.ToLower(host),
+		Owner: path[:slash],
+		Name:  path[slash+1:],
+	}, nil
+}
@@ -0,0 +1,396 @@
+package gitfresh
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	crand "crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/pbkdf2"
+)
+
+var ErrSecretNotFound = errors.New("secret not found")
+var ErrSecretsLocked = errors.New("the vault can't be opened, check the GITFRESH_PASSPHRASE")
+
+/* The tokens in config.json are replaced by a reference like gitfresh-secret:keyring/GitServerToken */
+const SECRET_REF = "gitfresh-secret:"
+
+/*
+secretFields gives the tokens and webhook secrets of the config by the key
+they are stored with, the values can be changed through the pointers.
+*/
+func secretFields(config *AppConfig) map[string]*string {
+	fields := map[string]*string{
+		"TunnelToken":    &config.TunnelToken,
+		"RelayToken":     &config.RelayToken,
+		"GitServerToken": &config.GitServerToken,
+		"GitLabToken":    &config.GitLabToken,
+		"BitbucketToken": &config.BitbucketToken,
+		"GiteaToken":     &config.GiteaToken,
+		"GitHookSecret":  &config.GitHookSecret,
+		"GitHubAppKey":   &config.GitHubAppKey,
+	}
+	if config.PreviousHookSecret != nil {
+		fields["PreviousHookSecret"] = &config.PreviousHookSecret.Secret
+	}
+	/* The servers are keyed by their position, the host may be empty or repeated */
+	for i := range config.GitServers {
+		fields[fmt.Sprintf("GitServers/%d/Token", i)] = &config.GitServers[i].Token
+		fields[fmt.Sprintf("GitServers/%d/AppKey", i)] = &config.GitServers[i].AppKey
+	}
+	for i, ws := range config.Workspaces {
+		fields["Workspaces/"+ws.Name+"/GitServerToken"] = &config.Workspaces[i].GitServerToken
+		for j := range ws.GitServers {
+			fields[fmt.Sprintf("Workspaces/%s/GitServers/%d/Token", ws.Name, j)] = &config.Workspaces[i].GitServers[j].Token
+			fields[fmt.Sprintf("Workspaces/%s/GitServers/%d/AppKey", ws.Name, j)] = &config.Workspaces[i].GitServers[j].AppKey
+		}
+	}
+	return fields
+}
+
+/* cloneConfig copies the config deep enough to replace its secrets */
+func cloneConfig(config *AppConfig) *AppConfig {
+	c := *config
+	c.GitServers = slices.Clone(config.GitServers)
+	c.Workspaces = slices.Clone(config.Workspaces)
+	for i := range c.Workspaces {
+		c.Workspaces[i].GitServers = slices.Clone(c.Workspaces[i].GitServers)
+	}
+	if config.PreviousHookSecret != nil {
+		previous := *config.PreviousHookSecret
+		c.PreviousHookSecret = &previous
+	}
+	return &c
+}
+
+/* NewSecretStores gives the Secret Service keyring when the desktop session has one, the vault otherwise */
+func NewSecretStores(l AppLogger, path string) []SecretStore {
+	vault := NewVaultStore(
+		&FlatFile{Name: APP_VAULT_FILE, Path: path},
+		&FlatFile{Name: APP_VAULT_KEY_FILE, Path: path},
+		os.Getenv(APP_PASSPHRASE_ENV),
+	)
+	keyring, err := NewKeyringStore()
+	if err != nil {
+		l.Debug("keyring not available", "error", err.Error())
+		return []SecretStore{vault}
+	}
+	return []SecretStore{keyring, vault}
+}
+
+/* KeyringStore keeps the secrets in the Secret Service of the desktop session through secret-tool */
+type KeyringStore struct {
+	run func(stdin string, args ...string) ([]byte, error)
+}
+
+func NewKeyringStore() (*KeyringStore, error) {
+	if os.Getenv("DBUS_SESSION_BUS_ADDRESS") == "" {
+		return nil, errors.New("there is not a D-Bus session")
+	}
+	path, err := exec.LookPath("secret-tool")
+	if err != nil {
+		return nil, err
+	}
+	k := &KeyringStore{run: func(stdin string, args ...string) ([]byte, error) {
+		cmd := exec.Command(path, args...)
+		cmd.Stdin = strings.NewReader(stdin)
+		var stderr bytes.Buffer
+		cmd.Stderr = &stderr
+		out, err := cmd.Output()
+		if err != nil && stderr.Len() > 0 {
+			return out, errors.New(strings.TrimSpace(stderr.String()))
+		}
+		return out, err
+	}}
+	/* A locked or missing Secret Service fails with a message, a missing secret without one */
+	if _, err := k.Get("probe"); err != nil && !errors.Is(err, ErrSecretNotFound) {
+		return nil, err
+	}
+	return k, nil
+}
+
+func (k *KeyringStore) Name() string {
+	return "keyring"
+}
+
+func (k *KeyringStore) Get(key string) (string, error) {
+	out, err := k.run("", "lookup", "service", APP_SECRET_SERVICE, "key", key)
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return "", ErrSecretNotFound
+	}
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSuffix(string(out), "\n"), nil
+}
+
+func (k *KeyringStore) Set(key string, value string) error {
+	_, err := k.run(value, "store", "--label=gitfresh "+key, "service", APP_SECRET_SERVICE, "key", key)
+	return err
+}
+
+func (k *KeyringStore) Delete(key string) error {
+	_, err := k.run("", "clear", "service", APP_SECRET_SERVICE, "key", key)
+	return err
+}
+
+/* vaultFile is the content of vault.json, every secret is sealed with its own nonce */
+type vaultFile struct {
+	/* KDF tells where the key comes from, Check is sealed with the key so a wrong key is refused */
+	KDF     string `json:",omitempty"`
+	Salt    []byte
+	Check   []byte `json:",omitempty"`
+	Secrets map[string][]byte
+}
+
+/* vaultCheck is the additional data of the Check, no secret can be stored with this key */
+const vaultCheck = "gitfresh-vault-check"
+
+/*
+VaultStore encrypts the secrets at rest with AES-GCM. The key is derived from
+the passphrase when there is one, or read from a key file only the user can
+read, so the vault is safe to copy around with the config.
+*/
+type VaultStore struct {
+	fileStore  FlatFiler
+	keyStore   FlatFiler
+	passphrase string
+	mu         sync.Mutex
+	/* The key derivation is slow on purpose, it is done once for the salt of the vault */
+	key     []byte
+	keySalt []byte
+}
+
+func NewVaultStore(f FlatFiler, k FlatFiler, passphrase string) *VaultStore {
+	return &VaultStore{
+		fileStore:  f,
+		keyStore:   k,
+		passphrase: passphrase,
+	}
+}
+
+func (v *VaultStore) Name() string {
+	return "vault"
+}
+
+func (v *VaultStore) Get(key string) (string, error) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	vault, err := v.read()
+	if err != nil {
+		return "", err
+	}
+	sealed, ok := vault.Secrets[key]
+	if !ok {
+		return "", ErrSecretNotFound
+	}
+	aead, err := v.open(vault)
+	if err != nil {
+		return "", err
+	}
+	return unseal(aead, key, sealed)
+}
+
+func (v *VaultStore) Set(key string, value string) error {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	vault, err := v.read()
+	if err != nil {
+		return err
+	}
+	aead, err := v.open(vault)
+	if err != nil {
+		return err
+	}
+	sealed, err := seal(aead, key, value)
+	if err != nil {
+		return err
+	}
+	vault.Secrets[key] = sealed
+	return v.write(vault)
+}
+
+/* Delete doesn't need the key, a vault sealed with another one can be cleaned too */
+func (v *VaultStore) Delete(key string) error {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	vault, err := v.read()
+	if err != nil {
+		return err
+	}
+	if _, ok := vault.Secrets[key]; !ok {
+		return nil
+	}
+	delete(vault.Secrets, key)
+	return v.write(vault)
+}
+
+func (v *VaultStore) read() (*vaultFile, error) {
+	vault := &vaultFile{Secrets: map[string][]byte{}}
+	content, err := v.fileStore.Read()
+	if errors.Is(err, fs.ErrNotExist) {
+		vault.Salt = make([]byte, 16)
+		_, err := crand.Read(vault.Salt)
+		return vault, err
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(content, vault); err != nil {
+		return nil, err
+	}
+	if vault.Secrets == nil {
+		vault.Secrets = map[string][]byte{}
+	}
+	return vault, nil
+}
+
+func (v *VaultStore) write(vault *vaultFile) error {
+	content, err := json.MarshalIndent(vault, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = v.fileStore.Write(content)
+	return err
+}
+
+/* kdf tells how this store makes the key */
+func (v *VaultStore) kdf() string {
+	if v.passphrase != "" {
+		return APP_VAULT_KDF_PASSPHRASE
+	}
+	return APP_VAULT_KDF_KEY_FILE
+}
+
+/*
+open gives the cipher of the vault, refusing a key other than the one it was
+sealed with, otherwise a run without the passphrase would seal the new secrets
+with a new key file. The vaults of older versions are checked with one of their
+secrets, they get the KDF and the Check on the next write.
+*/
+func (v *VaultStore) open(vault *vaultFile) (cipher.AEAD, error) {
+	if vault.KDF == APP_VAULT_KDF_PASSPHRASE && v.passphrase == "" {
+		return nil, fmt.Errorf("%w, the vault was sealed with a passphrase", ErrSecretsLocked)
+	}
+	if vault.KDF == APP_VAULT_KDF_KEY_FILE && v.passphrase != "" {
+		return nil, fmt.Errorf("%w, the vault was sealed with the %s file, unset %s", ErrSecretsLocked, APP_VAULT_KEY_FILE, APP_PASSPHRASE_ENV)
+	}
+	/* The key file is only created for a new vault */
+	created := vault.KDF == "" && len(vault.Secrets) == 0
+	aead, err := v.cipher(vault.Salt, created)
+	if err != nil {
+		return nil, err
+	}
+	if vault.Check != nil {
+		if _, err := unseal(aead, vaultCheck, vault.Check); err != nil {
+			return nil, err
+		}
+		return aead, nil
+	}
+	for key, sealed := range vault.Secrets {
+		if _, err := unseal(aead, key, sealed); err != nil {
+			return nil, err
+		}
+		break
+	}
+	vault.KDF = v.kdf()
+	vault.Check, err = seal(aead, vaultCheck, "")
+	if err != nil {
+		return nil, err
+	}
+	return aead, nil
+}
+
+func (v *VaultStore) cipher(salt []byte, create bool) (cipher.AEAD, error) {
+	/* A vault.json written by another process has another salt */
+	if v.key == nil || !bytes.Equal(salt, v.keySalt) {
+		key, err := v.deriveKey(salt, create)
+		if err != nil {
+			return nil, err
+		}
+		v.key = key
+		v.keySalt = slices.Clone(salt)
+	}
+	block, err := aes.NewCipher(v.key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+/* deriveKey uses the passphrase, or the key file which is created with the vault */
+func (v *VaultStore) deriveKey(salt []byte, create bool) ([]byte, error) {
+	if v.passphrase != "" {
+		return pbkdf2.Key([]byte(v.passphrase), salt, APP_VAULT_ITERATIONS, 32, sha256.New), nil
+	}
+	key, err := v.keyStore.Read()
+	if err == nil && len(key) == 32 {
+		return key, nil
+	}
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+	if err == nil {
+		return nil, errors.New("the vault key file is corrupted")
+	}
+	if !create {
+		return nil, fmt.Errorf("%w, the %s file is missing", ErrSecretsLocked, APP_VAULT_KEY_FILE)
+	}
+	key = make([]byte, 32)
+	if _, err := crand.Read(key); err != nil {
+		return nil, err
+	}
+	if _, err := v.keyStore.Write(key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+/* seal encrypts the value bound to its key, so a sealed value can't be moved to another field */
+func seal(aead cipher.AEAD, key string, value string) ([]byte, error) {
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := crand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, []byte(value), []byte(key)), nil
+}
+
+func unseal(aead cipher.AEAD, key string, sealed []byte) (string, error) {
+	if len(sealed) < aead.NonceSize() {
+		return "", ErrSecretsLocked
+	}
+	nonce, data := sealed[:aead.NonceSize()], sealed[aead.NonceSize():]
+	plain, err := aead.Open(nil, nonce, data, []byte(key))
+	if err != nil {
+		return "", ErrSecretsLocked
+	}
+	return string(plain), nil
+}
+
+/* SecureAppFolder lets only the user read the files of ~/.gitfresh, older versions created them readable by everyone */
+func SecureAppFolder(path string) error {
+	return filepath.WalkDir(path, func(p string, d fs.DirEntry, err error) error {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return os.Chmod(p, 0700)
+		}
+		return os.Chmod(p, 0600)
+	})
+}
@@ -0,0 +1,404 @@
+package gitfresh
+
+import (
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+/* MockSecretStore keeps the secrets in memory */
+type MockSecretStore struct {
+	name    string
+	secrets map[string]string
+}
+
+func (s *MockSecretStore) Name() string {
+	return s.name
+}
+
+func (s *MockSecretStore) Get(key string) (string, error) {
+	v, ok := s.secrets[key]
+	if !ok {
+		return "", ErrSecretNotFound
+	}
+	return v, nil
+}
+
+func (s *MockSecretStore) Set(key string, value string) error {
+	s.secrets[key] = value
+	return nil
+}
+
+func (s *MockSecretStore) Delete(key string) error {
+	delete(s.secrets, key)
+	return nil
+}
+
+func TestAppConfigSvc_Secrets(t *testing.T) {
+	file := &MockAppendFile{}
+	keyring := &MockSecretStore{name: "keyring", secrets: map[string]string{}}
+	svc := NewAppConfigSvc(slog.Default(), file, keyring)
+	config := &AppConfig{
+		TunnelToken:    "ngrok-token",
+		GitServerToken: "ghp_secret",
+		GitHookSecret:  "s3cr3t",
+		GitWorkDir:     "/code",
+		GitServers:     []GitServerConfig{{Kind: "gitlab", Host: "gitlab.company.com", Token: "glpat"}},
+		Workspaces:     []WorkspaceConfig{{Name: "work", GitWorkDir: "/work", GitServerToken: "ghp_work"}},
+	}
+	if err := svc.CreateConfigFile(config); err != nil {
+		t.Fatal(err)
+	}
+	for _, secret := range []string{"ngrok-token", "ghp_secret", "s3cr3t", "glpat", "ghp_work"} {
+		if strings.Contains(string(file.data), secret) {
+			t.Errorf("AppConfigSvc.CreateConfigFile() wrote %s in config.json", secret)
+		}
+	}
+	if config.GitServerToken != "ghp_secret" {
+		t.Error("AppConfigSvc.CreateConfigFile() changed the config of the caller")
+	}
+	got, err := svc.ReadConfigFile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(got, config); diff != "" {
+		t.Error("AppConfigSvc.ReadConfigFile() = ", diff)
+	}
+	/* Without the store the references can't be read */
+	if _, err := NewAppConfigSvc(slog.Default(), file, &MockSecretStore{name: "vault"}).ReadConfigFile(); err == nil {
+		t.Error("AppConfigSvc.ReadConfigFile() without the keyring, want an error")
+	}
+}
+
+func TestAppConfigSvc_Secrets_SameHost(t *testing.T) {
+	file := &MockAppendFile{}
+	vault := &MockSecretStore{name: "vault", secrets: map[string]string{}}
+	svc := NewAppConfigSvc(slog.Default(), file, vault)
+	/* Servers without Host and with the same Host keep their own tokens */
+	config := &AppConfig{
+		GitServers: []GitServerConfig{
+			{Kind: "gitea", WebURL: "https://git.one.com", Token: "one"},
+			{Kind: "gitea", WebURL: "https://git.two.com", Token: "two"},
+			{Kind: "gitlab", Host: "gitlab.company.com", Token: "glpat-a"},
+			{Kind: "gitlab", Host: "gitlab.company.com", Token: "glpat-b"},
+		},
+	}
+	if err := svc.CreateConfigFile(config); err != nil {
+		t.Fatal(err)
+	}
+	got, err := svc.ReadConfigFile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tokens := []string{}
+	for _, s := range got.GitServers {
+		tokens = append(tokens, s.Token)
+	}
+	if diff := cmp.Diff(tokens, []string{"one", "two", "glpat-a", "glpat-b"}); diff != "" {
+		t.Error("AppConfigSvc.ReadConfigFile() tokens = ", diff)
+	}
+}
+
+func TestAppConfigSvc_MigrateSecrets(t *testing.T) {
+	plain, _ := json.Marshal(&AppConfig{GitServerToken: "ghp_plain", GitHookSecret: "s3cr3t", GitWorkDir: "/code"})
+	file := &MockAppendFile{data: plain}
+	vault := &MockSecretStore{name: "vault", secrets: map[string]string{}}
+	svc := NewAppConfigSvc(slog.Default(), file, vault)
+	config, err := svc.ReadConfigFile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.GitServerToken != "ghp_plain" {
+		t.Errorf("AppConfigSvc.ReadConfigFile() GitServerToken = %s", config.GitServerToken)
+	}
+	if strings.Contains(string(file.data), "ghp_plain") || vault.secrets["GitServerToken"] != "ghp_plain" {
+		t.Errorf("AppConfigSvc.ReadConfigFile() didn't move the secrets to the vault: %s", file.data)
+	}
+	/* The hooks created from now on carry the install marker */
+	saved := AppConfig{}
+	json.Unmarshal(file.data, &saved)
+	if config.InstallID == "" || saved.InstallID != config.InstallID {
+		t.Errorf("AppConfigSvc.ReadConfigFile() InstallID = %q, saved %q", config.InstallID, saved.InstallID)
+	}
+}
+
+func TestAppConfigSvc_DeleteSecrets(t *testing.T) {
+	file := &MockAppendFile{}
+	keyring := &MockSecretStore{name: "keyring", secrets: map[string]string{}}
+	vault := &MockSecretStore{name: "vault", secrets: map[string]string{}}
+	svc := NewAppConfigSvc(slog.Default(), file, keyring, vault)
+	config := &AppConfig{
+		GitServerToken:     "ghp_secret",
+		GitHookSecret:      "s3cr3t",
+		PreviousHookSecret: &RetiringSecret{Secret: "old", Until: time.Now()},
+		GitServers: []GitServerConfig{
+			{Kind: "gitlab", Host: "gitlab.one.com", Token: "glpat-one"},
+			{Kind: "gitlab", Host: "gitlab.two.com", Token: "glpat-two"},
+		},
+		Workspaces: []WorkspaceConfig{{Name: "work", GitWorkDir: "/work", GitServerToken: "ghp_work"}},
+	}
+	if err := svc.CreateConfigFile(config); err != nil {
+		t.Fatal(err)
+	}
+	/* The retired secret, the second server and the workspace are gone */
+	config.PreviousHookSecret = nil
+	config.GitServers = config.GitServers[1:]
+	config.Workspaces = nil
+	if err := svc.CreateConfigFile(config); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{"GitServerToken": "ghp_secret", "GitHookSecret": "s3cr3t", "GitServers/0/Token": "glpat-two"}
+	if diff := cmp.Diff(keyring.secrets, want); diff != "" {
+		t.Error("AppConfigSvc.CreateConfigFile() kept the secrets = ", diff)
+	}
+	/* A copy left in another store by an older version is deleted too */
+	vault.secrets["GitServerToken"] = "ghp_secret"
+	if err := svc.DeleteSecrets(); err != nil {
+		t.Fatal(err)
+	}
+	if len(keyring.secrets) > 0 || len(vault.secrets) > 0 {
+		t.Errorf("AppConfigSvc.DeleteSecrets() left %v and %v", keyring.secrets, vault.secrets)
+	}
+}
+
+/* countingStore counts the secrets read from the store */
+type countingStore struct {
+	*MockSecretStore
+	gets int
+}
+
+func (s *countingStore) Get(key string) (string, error) {
+	s.gets++
+	return s.MockSecretStore.Get(key)
+}
+
+func TestAppConfigSvc_LoadConfigFile(t *testing.T) {
+	file := &MockAppendFile{}
+	keyring := &countingStore{MockSecretStore: &MockSecretStore{name: "keyring", secrets: map[string]string{}}}
+	svc := NewAppConfigSvc(slog.Default(), file, keyring)
+	if err := svc.CreateConfigFile(&AppConfig{GitServerToken: "ghp_secret", GitHookSecret: "s3cr3t"}); err != nil {
+		t.Fatal(err)
+	}
+	for range 3 {
+		config, err := svc.LoadConfigFile()
+		if err != nil || config.GitHookSecret != "s3cr3t" {
+			t.Fatalf("AppConfigSvc.LoadConfigFile() = %v, %v", config, err)
+		}
+		/* The copy of a caller doesn't change the cache */
+		config.GitHookSecret = "changed"
+	}
+	if keyring.gets != 2 {
+		t.Errorf("AppConfigSvc.LoadConfigFile() read %d secrets, want 2 from the first load", keyring.gets)
+	}
+	/* A new secret with the same reference is seen on the next load */
+	if err := NewAppConfigSvc(slog.Default(), file, keyring).CreateConfigFile(&AppConfig{GitServerToken: "ghp_secret", GitHookSecret: "n3w"}); err != nil {
+		t.Fatal(err)
+	}
+	if config, _ := svc.LoadConfigFile(); config.GitHookSecret != "n3w" {
+		t.Errorf("AppConfigSvc.LoadConfigFile() after a save GitHookSecret = %s, want n3w", config.GitHookSecret)
+	}
+}
+
+func TestAppConfigSvc_UpdateConfigFile(t *testing.T) {
+	file := &MockAppendFile{}
+	agent := NewAppConfigSvc(slog.Default(), file)
+	cli := NewAppConfigSvc(slog.Default(), file)
+	if err := cli.CreateConfigFile(&AppConfig{GitHookSecret: "s3cr3t"}); err != nil {
+		t.Fatal(err)
+	}
+	stale, _ := cli.ReadConfigFile()
+	if err := agent.UpdateConfigFile(func(config *AppConfig) bool {
+		config.TunnelDomain = "https://b2.ngrok-free.app"
+		return true
+	}); err != nil {
+		t.Fatal(err)
+	}
+	/* The CLI would lose the domain saved by the agent */
+	stale.GitHookSecret = "n3w"
+	if err := cli.CreateConfigFile(stale); !errors.Is(err, ErrConfigChanged) {
+		t.Errorf("AppConfigSvc.CreateConfigFile() with a stale config error = %v, want %v", err, ErrConfigChanged)
+	}
+	/* The CLI saves config.json while the agent changes it, the change is applied again */
+	calls := 0
+	err := agent.UpdateConfigFile(func(config *AppConfig) bool {
+		calls++
+		if calls == 1 {
+			latest, _ := cli.ReadConfigFile()
+			latest.GitHookSecret = "n3w"
+			if err := cli.CreateConfigFile(latest); err != nil {
+				t.Fatal(err)
+			}
+		}
+		config.TunnelDomainAssigned = true
+		return true
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	config, _ := agent.ReadConfigFile()
+	if calls != 2 || config.GitHookSecret != "n3w" || !config.TunnelDomainAssigned || config.TunnelDomain != "https://b2.ngrok-free.app" {
+		t.Errorf("AppConfigSvc.UpdateConfigFile() = %+v after %d calls", config, calls)
+	}
+}
+
+func TestVaultStore(t *testing.T) {
+	file, key := &MockAppendFile{}, &MockAppendFile{}
+	tests := []struct {
+		name       string
+		passphrase string
+	}{
+		{name: "key file"},
+		{name: "passphrase", passphrase: "correct horse battery staple"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			file.data, key.data = nil, nil
+			vault := NewVaultStore(file, key, tt.passphrase)
+			if err := vault.Set("GitServerToken", "ghp_secret"); err != nil {
+				t.Fatal(err)
+			}
+			if strings.Contains(string(file.data), "ghp_secret") {
+				t.Error("VaultStore.Set() wrote the secret in plain text")
+			}
+			/* Another process opens the same vault */
+			got, err := NewVaultStore(file, key, tt.passphrase).Get("GitServerToken")
+			if err != nil || got != "ghp_secret" {
+				t.Errorf("VaultStore.Get() = %q, %v", got, err)
+			}
+			if _, err := vault.Get("GitLabToken"); !errors.Is(err, ErrSecretNotFound) {
+				t.Errorf("VaultStore.Get() missing secret error = %v", err)
+			}
+			if tt.passphrase == "" && len(key.data) != 32 {
+				t.Errorf("VaultStore saved a key of %d bytes", len(key.data))
+			}
+		})
+	}
+	if _, err := NewVaultStore(file, key, "wrong").Get("GitServerToken"); !errors.Is(err, ErrSecretsLocked) {
+		t.Errorf("VaultStore.Get() with a wrong passphrase error = %v, want %v", err, ErrSecretsLocked)
+	}
+}
+
+func TestKeyringStore(t *testing.T) {
+	secrets := map[string]string{}
+	keyring := &KeyringStore{run: func(stdin string, args ...string) ([]byte, error) {
+		key := args[len(args)-1]
+		switch args[0] {
+		case "store":
+			secrets[key] = stdin
+		case "lookup":
+			v, ok := secrets[key]
+			if !ok {
+				/* secret-tool exits with 1 and no message */
+				return nil, &exec.ExitError{}
+			}
+			return []byte(v), nil
+		case "clear":
+			delete(secrets, key)
+		}
+		return nil, nil
+	}}
+	if err := keyring.Set("GiteaToken", "gitea"); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := keyring.Get("GiteaToken"); err != nil || got != "gitea" {
+		t.Errorf("KeyringStore.Get() = %q, %v", got, err)
+	}
+	keyring.Delete("GiteaToken")
+	if _, err := keyring.Get("GiteaToken"); !errors.Is(err, ErrSecretNotFound) {
+		t.Errorf("KeyringStore.Get() after Delete() error = %v", err)
+	}
+}
+
+/* The vaults sealed with a passphrase by older versions open with the same key */
+func TestVaultStore_KnownAnswer(t *testing.T) {
+	file := &MockAppendFile{data: []byte(`{"Salt":"CFKfHaT9bR0ixT1a5GIIRg==","Secrets":{"GitServerToken":"2G3XUaKvKyGqIpDs2i6kWDVzdWYpART5Qa46kDt8lX1NbPAzhWg0Oc54/whr"}}`)}
+	got, err := NewVaultStore(file, &MockAppendFile{}, "correct horse battery staple").Get("GitServerToken")
+	if err != nil || got != "ghp_sealed_before" {
+		t.Errorf("VaultStore.Get() = %q, %v", got, err)
+	}
+}
+
+func TestVaultStore_KDF(t *testing.T) {
+	passphrase := "correct horse battery staple"
+	file, key := &MockAppendFile{}, &MockAppendFile{}
+	if err := NewVaultStore(file, key, passphrase).Set("GitServerToken", "ghp_secret"); err != nil {
+		t.Fatal(err)
+	}
+	/* An agent started without the passphrase doesn't create a key file sealing the new secrets */
+	if err := NewVaultStore(file, key, "").Set("GitLabToken", "glpat"); !errors.Is(err, ErrSecretsLocked) {
+		t.Errorf("VaultStore.Set() without the passphrase error = %v, want %v", err, ErrSecretsLocked)
+	}
+	if _, err := NewVaultStore(file, key, "").Get("GitServerToken"); !errors.Is(err, ErrSecretsLocked) {
+		t.Errorf("VaultStore.Get() without the passphrase error = %v, want %v", err, ErrSecretsLocked)
+	}
+	if err := NewVaultStore(file, key, "wrong").Set("GitLabToken", "glpat"); !errors.Is(err, ErrSecretsLocked) {
+		t.Errorf("VaultStore.Set() with a wrong passphrase error = %v, want %v", err, ErrSecretsLocked)
+	}
+	if key.data != nil {
+		t.Error("VaultStore created a key file for a vault sealed with a passphrase")
+	}
+	/* A vault sealed with the key file refuses a passphrase */
+	keyFile := &MockAppendFile{}
+	if err := NewVaultStore(keyFile, key, "").Set("GitServerToken", "ghp_secret"); err != nil {
+		t.Fatal(err)
+	}
+	if err := NewVaultStore(keyFile, key, passphrase).Set("GitLabToken", "glpat"); !errors.Is(err, ErrSecretsLocked) {
+		t.Errorf("VaultStore.Set() with a passphrase error = %v, want %v", err, ErrSecretsLocked)
+	}
+	/* The key file is not created again once it is lost */
+	key.data = nil
+	if err := NewVaultStore(keyFile, key, "").Set("GitLabToken", "glpat"); !errors.Is(err, ErrSecretsLocked) || key.data != nil {
+		t.Errorf("VaultStore.Set() without the key file error = %v, want %v", err, ErrSecretsLocked)
+	}
+}
+
+func TestVaultStore_Upgrade(t *testing.T) {
+	sealed := []byte(`{"Salt":"CFKfHaT9bR0ixT1a5GIIRg==","Secrets":{"GitServerToken":"2G3XUaKvKyGqIpDs2i6kWDVzdWYpART5Qa46kDt8lX1NbPAzhWg0Oc54/whr"}}`)
+	file, key := &MockAppendFile{data: sealed}, &MockAppendFile{}
+	if err := NewVaultStore(file, key, "").Set("GitLabToken", "glpat"); !errors.Is(err, ErrSecretsLocked) || key.data != nil {
+		t.Errorf("VaultStore.Set() on a vault of an older version without the key error = %v, want %v", err, ErrSecretsLocked)
+	}
+	vault := NewVaultStore(file, key, "correct horse battery staple")
+	if err := vault.Set("GitLabToken", "glpat"); err != nil {
+		t.Fatal(err)
+	}
+	saved := vaultFile{}
+	json.Unmarshal(file.data, &saved)
+	if saved.KDF != APP_VAULT_KDF_PASSPHRASE || saved.Check == nil {
+		t.Errorf("VaultStore.Set() saved KDF %q and check %v", saved.KDF, saved.Check)
+	}
+	/* Another process replaced vault.json, its salt gives another key */
+	other := &MockAppendFile{}
+	if err := NewVaultStore(other, key, "correct horse battery staple").Set("GitServerToken", "ghp_other"); err != nil {
+		t.Fatal(err)
+	}
+	file.data = other.data
+	if got, err := vault.Get("GitServerToken"); err != nil || got != "ghp_other" {
+		t.Errorf("VaultStore.Get() after vault.json changed = %q, %v", got, err)
+	}
+}
+
+func TestSecureAppFolder(t *testing.T) {
+	path := filepath.Join(t.TempDir(), APP_FOLDER)
+	os.MkdirAll(path, 0755)
+	os.WriteFile(filepath.Join(path, APP_CONFIG_FILE_NAME), []byte("{}"), 0644)
+	if err := SecureAppFolder(path); err != nil {
+		t.Fatal(err)
+	}
+	dir, _ := os.Stat(path)
+	file, _ := os.Stat(filepath.Join(path, APP_CONFIG_FILE_NAME))
+	if dir.Mode().Perm() != 0700 || file.Mode().Perm() != 0600 {
+		t.Errorf("SecureAppFolder() = %v %v", dir.Mode().Perm(), file.Mode().Perm())
+	}
+	if err := SecureAppFolder(filepath.Join(path, "missing")); err != nil {
+		t.Errorf("SecureAppFolder() without folder error = %v", err)
+	}
+}
@@ -3,16 +3,21 @@ package gitfresh
 import (
 	"bytes"
 	"context"
+	crand "crypto/rand"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"io/fs"
 	"log/slog"
-	"math/rand"
 	"net/http"
+	"net/url"
 	"path/filepath"
+	"slices"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -24,82 +29,440 @@ var DevMode string = devModeOff
 type GitServerSvc struct {
 	logs       AppLogger
 	httpClient HttpClienter
+	apps       *gitHubApps
 }
 
 func NewGitServerSvc(l AppLogger, c HttpClienter) *GitServerSvc {
 	return &GitServerSvc{
 		logs:       l,
 		httpClient: c,
+		apps:       &gitHubApps{},
 	}
 }
 
+var ErrEventIgnored = errors.New("webhook event ignored")
+var ErrInvalidSignature = errors.New("invalid webhook signature")
+var ErrUnknownDelivery = errors.New("unknown webhook sender")
+var ErrUpdateSkipped = errors.New("update skipped")
+var ErrNotModified = errors.New("not modified")
+var ErrConfigChanged = errors.New("config.json was saved by another gitfresh process since it was read")
+
+/*
+GitServers merges the tokens typed for the public providers
+with the extra instances (GitHub Enterprise, self-hosted GitLab...)
+*/
+func GitServers(config *AppConfig) []GitServerConfig {
+	servers := []GitServerConfig{}
+	if config.GitServerToken != "" || config.GitHubAppID != 0 || len(config.GitServers) < 1 {
+		servers = append(servers, GitServerConfig{
+			Kind:     GIT_PROVIDER_GITHUB,
+			Host:     APP_GIT_PROVIDER,
+			APIURL:   GITHUB_API_URL,
+			Token:    config.GitServerToken,
+			AppID:    config.GitHubAppID,
+			AppKey:   config.GitHubAppKey,
+			OrgHooks: config.GitHubOrgHooks,
+		})
+	}
+	if config.GitLabToken != "" {
+		servers = append(servers, GitServerConfig{
+			Kind:   GIT_PROVIDER_GITLAB,
+			Host:   APP_GITLAB_PROVIDER,
+			APIURL: GITLAB_API_URL,
+			Token:  config.GitLabToken,
+		})
+	}
+	if config.BitbucketToken != "" {
+		servers = append(servers, GitServerConfig{
+			Kind:   GIT_PROVIDER_BITBUCKET,
+			Host:   APP_BITBUCKET_PROVIDER,
+			APIURL: BITBUCKET_API_URL,
+			Token:  config.BitbucketToken,
+		})
+	}
+	if config.GiteaURL != "" {
+		servers = append(servers, GitServerConfig{
+			Kind:   GIT_PROVIDER_GITEA,
+			WebURL: config.GiteaURL,
+			Token:  config.GiteaToken,
+		})
+	}
+	servers = append(servers, config.GitServers...)
+	for i := range servers {
+		servers[i] = withServerDefaults(servers[i])
+	}
+	return servers
+}
+
+/* GitServerHost gives the host the remotes are matched with, taken from the WebURL when it is not set */
+func GitServerHost(server GitServerConfig) string {
+	if server.Host != "" {
+		return server.Host
+	}
+	if u, err := url.Parse(server.WebURL); err == nil {
+		return u.Hostname()
+	}
+	return ""
+}
+
+func withServerDefaults(server GitServerConfig) GitServerConfig {
+	server.Host = GitServerHost(server)
+	if server.WebURL == "" {
+		server.WebURL = "https://" + server.Host
+	}
+	if server.APIURL != "" {
+		return server
+	}
+	switch server.Kind {
+	case GIT_PROVIDER_GITHUB:
+		server.APIURL = server.WebURL + "/api/v3"
+		if server.Host == APP_GIT_PROVIDER {
+			server.APIURL = GITHUB_API_URL
+		}
+	case GIT_PROVIDER_GITLAB:
+		server.APIURL = server.WebURL + "/api/v4"
+	case GIT_PROVIDER_BITBUCKET:
+		server.APIURL = BITBUCKET_API_URL
+	case GIT_PROVIDER_GITEA:
+		server.APIURL = strings.TrimSuffix(server.WebURL, "/") + "/api/v1"
+	}
+	return server
+}
+
+/*
+AllGitServers adds the git servers of the named workspaces to the ones of the
+default workspace, the agent receives the deliveries of all of them. The first
+server of every host is kept, the workspaces share the webhook secret.
+*/
+func AllGitServers(config *AppConfig) []GitServerConfig {
+	servers := []GitServerConfig{}
+	seen := map[string]bool{}
+	for _, name := range WorkspaceNames(config) {
+		ws, err := Workspace(config, name)
+		if err != nil {
+			continue
+		}
+		for _, server := range GitServers(ws) {
+			if seen[server.Kind+"/"+server.Host] {
+				continue
+			}
+			seen[server.Kind+"/"+server.Host] = true
+			servers = append(servers, server)
+		}
+	}
+	return servers
+}
+
+func (svc GitServerSvc) Providers(config *AppConfig) []GitProvider {
+	return svc.providers(GitServers(config))
+}
+
+func (svc GitServerSvc) providers(servers []GitServerConfig) []GitProvider {
+	providers := []GitProvider{}
+	gitlabs := 0
+	for _, server := range servers {
+		if server.Kind == GIT_PROVIDER_GITLAB {
+			gitlabs++
+		}
+	}
+	for _, server := range servers {
+		p, err := svc.newProvider(server)
+		if err != nil {
+			svc.logs.Error("loading git provider", "kind", server.Kind, "host", server.Host, "error", err.Error())
+			continue
+		}
+		if gitlab, ok := p.(*GitLabProvider); ok {
+			gitlab.matchInstance = gitlabs > 1
+		}
+		providers = append(providers, p)
+	}
+	return providers
+}
+
+func (svc GitServerSvc) newProvider(server GitServerConfig) (GitProvider, error) {
+	switch server.Kind {
+	case GIT_PROVIDER_GITHUB:
+		p := NewGitHubProvider(svc.logs, svc.httpClient, server)
+		if server.AppID != 0 {
+			app, err := svc.apps.app(svc.logs, svc.httpClient, server)
+			if err != nil {
+				return nil, err
+			}
+			p.tokens = app
+		}
+		return p, nil
+	case GIT_PROVIDER_GITLAB:
+		return NewGitLabProvider(svc.logs, svc.httpClient, server), nil
+	case GIT_PROVIDER_BITBUCKET:
+		return NewBitbucketProvider(svc.logs, svc.httpClient, server), nil
+	case GIT_PROVIDER_GITEA:
+		return NewGiteaProvider(svc.logs, svc.httpClient, server), nil
+	}
+	return nil, errors.New("git provider kind not supported " + server.Kind)
+}
+
+/*
+CheckTokens asks every git server who its token belongs to and the scopes or
+permissions it lacks to manage the webhooks, the servers without token are skipped
+*/
+func (svc GitServerSvc) CheckTokens(config *AppConfig) []TokenCheck {
+	checks := []TokenCheck{}
+	for _, server := range GitServers(config) {
+		if server.Token == "" && server.AppID == 0 {
+			continue
+		}
+		check := TokenCheck{}
+		p, err := svc.newProvider(server)
+		if err == nil {
+			checker, ok := p.(TokenChecker)
+			if !ok {
+				continue
+			}
+			check, err = checker.CheckToken()
+		}
+		check.Host = server.Host
+		check.Err = err
+		checks = append(checks, check)
+	}
+	return checks
+}
+
+func (svc GitServerSvc) ProviderHosts(config *AppConfig) []string {
+	hosts := []string{}
+	for _, p := range svc.Providers(config) {
+		hosts = append(hosts, p.Host())
+	}
+	return hosts
+}
+
+func (svc GitServerSvc) provider(host string, config *AppConfig) (GitProvider, error) {
+	if host == "" {
+		host = APP_GIT_PROVIDER
+	}
+	for _, p := range svc.Providers(config) {
+		if p.Host() == host {
+			return p, nil
+		}
+	}
+	return nil, errors.New("git provider not configured " + host)
+}
+
+/* BranchHead asks the git server for the branch head, errors.ErrUnsupported when the provider can't */
+func (svc GitServerSvc) BranchHead(repo *GitRepository, branch string, etag string, config *AppConfig) (string, string, error) {
+	provider, err := svc.provider(repo.Provider, config)
+	if err != nil {
+		return "", "", err
+	}
+	header, ok := provider.(BranchHeader)
+	if !ok {
+		return "", "", errors.ErrUnsupported
+	}
+	return header.BranchHead(repo, branch, etag)
+}
+
+func (svc GitServerSvc) RepositoryURL(repo *GitRepository, config *AppConfig) string {
+	provider, err := svc.provider(repo.Provider, config)
+	if err != nil {
+		return fmt.Sprintf("https://%s/%s/%s", repo.Provider, repo.Owner, repo.Name)
+	}
+	return provider.RepositoryURL(repo)
+}
+
+func (svc GitServerSvc) HooksPageURL(repo *GitRepository, config *AppConfig) string {
+	provider, err := svc.provider(repo.Provider, config)
+	if err != nil {
+		return svc.RepositoryURL(repo, config)
+	}
+	return provider.HooksPageURL(repo)
+}
+
 func (svc GitServerSvc) CreateGitServerHook(repo *GitRepository, config *AppConfig) error {
-	url := fmt.Sprintf("https://api.github.com/repos/%s/%s/hooks", repo.Owner, repo.Name)
-	if !strings.Contains(config.TunnelDomain, "https://") {
-		config.TunnelDomain = "https://" + config.TunnelDomain
-	}
-	webhook := Webhook{
-		Name:   "web",
-		Active: true,
-		Events: []string{"push"},
-		Config: map[string]string{
-			"url":          config.TunnelDomain,
-			"content_type": "json",
-			"secret":       config.GitHookSecret,
-			"insecure_ssl": "0",
-		},
-	}
-	jsonData, err := json.Marshal(webhook)
+	provider, err := svc.provider(repo.Provider, config)
 	if err != nil {
-		svc.logs.Error(err.Error())
+		svc.logs.Error(err.Error(), "repo", repo.Name)
 		return err
 	}
-	req, err := http.NewRequest("POST", url, bytes.NewBuffer(jsonData))
+	return provider.CreateHook(repo, svc.HookURL(config), config.GitHookSecret)
+}
+
+/*
+HookURL gives the URL the webhooks of the agent are sent to. The install id
+goes in the query, so the hooks of this installation are found once the
+tunnel domain changed, while the hooks of the teammates are left alone.
+*/
+func (svc GitServerSvc) HookURL(config *AppConfig) string {
+	/* The relay receives the webhooks of the whole team, so every repository has one hook */
+	if config.AgentMode == AGENT_MODE_RELAY {
+		return strings.TrimSuffix(config.RelayURL, "/") + "/"
+	}
+	hookURL := config.TunnelDomain
+	/* Without a tunnel the agent address may be plain http */
+	if !strings.Contains(hookURL, "://") {
+		hookURL = "https://" + hookURL
+	}
+	if config.InstallID == "" {
+		return hookURL
+	}
+	return strings.TrimSuffix(hookURL, "/") + "/?" + HOOK_MARKER + "=" + config.InstallID
+}
+
+/* IsOwnHook tells the hooks with the marker of this installation or sending to the agent, now or before */
+func (svc GitServerSvc) IsOwnHook(hook Hook, config *AppConfig) bool {
+	u, err := url.Parse(hook.URL)
+	if err != nil {
+		return false
+	}
+	marker := u.Query().Get(HOOK_MARKER)
+	if config.InstallID != "" && marker == config.InstallID {
+		return true
+	}
+	if hookBase(hook.URL) == hookBase(svc.HookURL(config)) {
+		return true
+	}
+	/* The hooks of older versions have no marker and still send to the domain the agent had before */
+	if marker != "" || config.PreviousTunnelDomain == "" {
+		return false
+	}
+	previous := *config
+	previous.TunnelDomain = config.PreviousTunnelDomain
+	return hookBase(hook.URL) == hookBase(svc.HookURL(&previous))
+}
+
+/* hookBase drops the query and the trailing slash of a hook URL */
+func hookBase(hookURL string) string {
+	base, _, _ := strings.Cut(hookURL, "?")
+	return strings.TrimSuffix(base, "/")
+}
+
+/* OwnHooks lists the hooks of the repository created by this installation */
+func (svc GitServerSvc) OwnHooks(repo *GitRepository, config *AppConfig) ([]Hook, error) {
+	provider, err := svc.provider(repo.Provider, config)
+	if err != nil {
+		return nil, err
+	}
+	hooks, err := provider.ListHooks(repo)
+	if err != nil {
+		return nil, err
+	}
+	own := []Hook{}
+	for _, h := range hooks {
+		if svc.IsOwnHook(h, config) {
+			own = append(own, h)
+		}
+	}
+	return own, nil
+}
+
+/* UpdateGitServerHook points the hook to the agent with the current secret */
+func (svc GitServerSvc) UpdateGitServerHook(repo *GitRepository, hook Hook, config *AppConfig) error {
+	provider, err := svc.provider(repo.Provider, config)
 	if err != nil {
-		svc.logs.Error(err.Error())
 		return err
 	}
-	req.Header.Set("Authorization", "Bearer "+config.GitServerToken)
-	req.Header.Set("Accept", "*/*")
-	req.Header.Set("X-GitHub-Api-Version", "2022-11-28")
+	return provider.UpdateHook(repo, hook.ID, svc.HookURL(config), config.GitHookSecret)
+}
 
-	resp, err := svc.httpClient.Do(req)
+/* IsOrgHook tells when the hook of the repository is shared by every repository of its organization */
+func (svc GitServerSvc) IsOrgHook(repo *GitRepository, config *AppConfig) (bool, error) {
+	provider, err := svc.provider(repo.Provider, config)
+	if err != nil {
+		return false, err
+	}
+	hooker, ok := provider.(OrgHooker)
+	if !ok {
+		return false, nil
+	}
+	return hooker.IsOrgHook(repo)
+}
+
+func (svc GitServerSvc) DeleteGitServerHook(repo *GitRepository, hook Hook, config *AppConfig) error {
+	provider, err := svc.provider(repo.Provider, config)
 	if err != nil {
-		svc.logs.Error(err.Error())
 		return err
 	}
-	defer resp.Body.Close()
-	if resp.StatusCode != http.StatusCreated {
-		svc.logs.Info(string(jsonData))
-		svc.logs.Info(url)
-		rb, _ := io.ReadAll(resp.Body)
-		svc.logs.Info(string(rb))
-		if resp.StatusCode == http.StatusUnprocessableEntity {
-			var errResponse struct {
-				Message string `json:"message"`
-				Errors  []struct {
-					Resource string `json:"resource"`
-					Code     string `json:"code"`
-					Message  string `json:"message"`
-				}
-				DocumentationURL string `json:"documentation_url"`
-			}
-			err := json.Unmarshal(rb, &errResponse)
-			if err != nil {
-				svc.logs.Error(err.Error())
-			}
-			for _, e := range errResponse.Errors {
-				if e.Resource == "Hook" {
-					if strings.Contains(e.Message, "already exists") {
-						svc.logs.Info(e.Message, "repo", repo.Name)
-						return nil
-					}
-				}
+	return provider.DeleteHook(repo, hook.ID)
+}
+
+/*
+SyncGitServerHook points the hook of this installation to the agent with the
+current secret, creating it when missing. The duplicated hooks are deleted.
+*/
+func (svc GitServerSvc) SyncGitServerHook(repo *GitRepository, config *AppConfig) (string, error) {
+	hooks, err := svc.OwnHooks(repo, config)
+	if err != nil {
+		return "", err
+	}
+	if len(hooks) == 0 {
+		return HOOK_CREATED, svc.CreateGitServerHook(repo, config)
+	}
+	/* The hook already sending to the agent is kept */
+	keep := 0
+	for i, h := range hooks {
+		if h.URL == svc.HookURL(config) {
+			keep = i
+		}
+	}
+	for i, h := range hooks {
+		if i == keep {
+			continue
+		}
+		if err := svc.DeleteGitServerHook(repo, h, config); err != nil {
+			return "", err
+		}
+	}
+	/* The secret can't be read back, so the hook is always updated */
+	return HOOK_UPDATED, svc.UpdateGitServerHook(repo, hooks[keep], config)
+}
+
+/* NewInstallID gives the random id marking the webhooks of an installation */
+func NewInstallID() string {
+	id := make([]byte, 6)
+	crand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+/* RedeliverFailed gives how many deliveries were sent again, errors.ErrUnsupported when the provider can't */
+func (svc GitServerSvc) RedeliverFailed(repo *GitRepository, since time.Time, config *AppConfig) (int, error) {
+	provider, err := svc.provider(repo.Provider, config)
+	if err != nil {
+		return 0, err
+	}
+	redeliverer, ok := provider.(Redeliverer)
+	if !ok {
+		return 0, errors.ErrUnsupported
+	}
+	return redeliverer.RedeliverFailed(repo, svc.HookURL(config), since)
+}
+
+func (svc GitServerSvc) ParseWebhook(r *http.Request, config *AppConfig) ([]*APIPayload, error) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		svc.logs.Error(err.Error())
+		return nil, err
+	}
+	/* A repository of a named workspace may be hosted on a server only that workspace has */
+	for _, p := range svc.providers(AllGitServers(config)) {
+		if !p.IsDelivery(r, body) {
+			continue
+		}
+		/* The hooks not updated yet by a rotation send the previous secret */
+		err := ErrInvalidSignature
+		for _, secret := range HookSecrets(config, time.Now()) {
+			if err = p.VerifyDelivery(r, body, secret); !errors.Is(err, ErrInvalidSignature) {
+				break
 			}
 		}
-		return errors.New("creating webhook via http, response with " + resp.Status)
+		if err != nil {
+			svc.logs.Warn("rejecting webhook", "provider", p.Host(), "error", err.Error())
+			return nil, err
+		}
+		payloads, err := p.ParsePush(r, body)
+		for _, payload := range payloads {
+			payload.Provider = p.Host()
+		}
+		return payloads, err
 	}
-	return nil
+	return nil, ErrUnknownDelivery
 }
 
 /* Agent */
@@ -215,20 +578,130 @@ func (svc AgentSvc) CheckAgentStatus(tick *time.Ticker) (Agent, error) {
 	return agent, nil
 }
 
+/* Deliveries asks the running agent for its delivery log */
+func (svc AgentSvc) Deliveries(filter DeliveryFilter) ([]Delivery, error) {
+	deliveries := []Delivery{}
+	query := url.Values{}
+	if filter.Repository != "" {
+		query.Set("repo", filter.Repository)
+	}
+	if !filter.Since.IsZero() {
+		query.Set("since", filter.Since.Format(time.RFC3339))
+	}
+	if filter.Failed {
+		query.Set("failed", "true")
+	}
+	req, err := http.NewRequest("GET", "http://"+API_AGENT_HOST+"/deliveries?"+query.Encode(), nil)
+	if err != nil {
+		return deliveries, err
+	}
+	resp, err := svc.httpClient.Do(req)
+	if err != nil {
+		return deliveries, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return deliveries, errors.New("http response " + resp.Status)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&deliveries); err != nil {
+		svc.logs.Error(err.Error())
+		return deliveries, err
+	}
+	return deliveries, nil
+}
+
+/* Refresh asks the running agent to update repositories, progress gets every line streamed back */
+func (svc AgentSvc) Refresh(refresh RefreshRequest, progress func(RefreshEvent)) error {
+	body, err := json.Marshal(refresh)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", "http://"+API_AGENT_HOST+"/refresh", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := svc.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(resp.Body)
+		return errors.New(strings.TrimSpace(string(msg)))
+	}
+	decoder := json.NewDecoder(resp.Body)
+	for {
+		event := RefreshEvent{}
+		err := decoder.Decode(&event)
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			svc.logs.Error(err.Error())
+			return err
+		}
+		progress(event)
+	}
+}
+
 /* AppConfig */
+/*
+AppConfigSvc keeps the config in config.json. With secret stores the tokens
+are saved in the first one and config.json only has references to them.
+*/
 type AppConfigSvc struct {
 	logs      AppLogger
 	fileStore FlatFiler
+	secrets   []SecretStore
+	cache     *configCache
+}
+
+/* configCache keeps the last config read with the content of config.json it came from */
+type configCache struct {
+	mu      sync.Mutex
+	content []byte
+	config  *AppConfig
 }
 
-func NewAppConfigSvc(l AppLogger, f FlatFiler) *AppConfigSvc {
+func NewAppConfigSvc(l AppLogger, f FlatFiler, s ...SecretStore) *AppConfigSvc {
 	return &AppConfigSvc{
 		logs:      l,
 		fileStore: f,
+		secrets:   s,
+		cache:     &configCache{},
 	}
 }
 
+/*
+CreateConfigFile saves the config. A config read before another process saved
+config.json is refused with ErrConfigChanged, so the agent and the CLI don't
+overwrite each other, see UpdateConfigFile.
+*/
 func (svc AppConfigSvc) CreateConfigFile(config *AppConfig) error {
+	if config.Revision != 0 && svc.revision() != config.Revision {
+		svc.logs.Warn("config file changed since it was read", "revision", config.Revision)
+		return ErrConfigChanged
+	}
+	config.Revision = time.Now().UnixNano()
+	if config.InstallID == "" {
+		config.InstallID = NewInstallID()
+	}
+	previous := svc.secretRefs()
+	if len(svc.secrets) > 0 {
+		config = cloneConfig(config)
+		store := svc.secrets[0]
+		for key, value := range secretFields(config) {
+			if *value == "" || strings.HasPrefix(*value, SECRET_REF) {
+				continue
+			}
+			if err := store.Set(key, *value); err != nil {
+				svc.logs.Error("saving secret", "key", key, "store", store.Name(), "error", err.Error())
+				return err
+			}
+			*value = SECRET_REF + store.Name() + "/" + key
+		}
+	}
 	content, err := json.MarshalIndent(config, "", "  ")
 	svc.logs.Debug("parsing config parameters", "data", string(content))
 	if err != nil {
@@ -241,9 +714,96 @@ func (svc AppConfigSvc) CreateConfigFile(config *AppConfig) error {
 		return err
 	}
 	svc.logs.Info("config file created successfully")
+	/* The secrets of the retired webhook secret and of the removed servers and workspaces are deleted */
+	saved := map[string]bool{}
+	for _, value := range secretFields(config) {
+		if ref, ok := strings.CutPrefix(*value, SECRET_REF); ok {
+			saved[ref] = true
+		}
+	}
+	for _, ref := range previous {
+		if saved[ref] {
+			continue
+		}
+		name, key, _ := strings.Cut(ref, "/")
+		for _, store := range svc.secrets {
+			if store.Name() != name {
+				continue
+			}
+			if err := store.Delete(key); err != nil && !errors.Is(err, ErrSecretNotFound) {
+				svc.logs.Warn("deleting secret", "key", key, "store", name, "error", err.Error())
+			}
+		}
+	}
 	return nil
 }
 
+/*
+UpdateConfigFile applies a change to the last saved config, the change is
+applied again when another process saves config.json meanwhile. change tells
+if there is something to save.
+*/
+func (svc AppConfigSvc) UpdateConfigFile(change func(config *AppConfig) bool) error {
+	for attempt := 1; ; attempt++ {
+		config, err := svc.ReadConfigFile()
+		if err != nil {
+			return err
+		}
+		if !change(config) {
+			return nil
+		}
+		err = svc.CreateConfigFile(config)
+		if !errors.Is(err, ErrConfigChanged) || attempt == APP_CONFIG_ATTEMPTS {
+			return err
+		}
+	}
+}
+
+/* revision gives the Revision of config.json, 0 when it doesn't exist yet */
+func (svc AppConfigSvc) revision() int64 {
+	file, err := svc.fileStore.Read()
+	if err != nil {
+		return 0
+	}
+	saved := struct{ Revision int64 }{}
+	if err := json.Unmarshal(file, &saved); err != nil {
+		return 0
+	}
+	return saved.Revision
+}
+
+/* DeleteSecrets deletes the secrets of config.json from every store, so gitfresh uninstall -purge leaves nothing in the keyring */
+func (svc AppConfigSvc) DeleteSecrets() error {
+	errs := []error{}
+	for key := range svc.secretRefs() {
+		for _, store := range svc.secrets {
+			if err := store.Delete(key); err != nil && !errors.Is(err, ErrSecretNotFound) {
+				errs = append(errs, fmt.Errorf("deleting %s from the %s: %w", key, store.Name(), err))
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+/* secretRefs gives the references of config.json by key, without reading the secrets */
+func (svc AppConfigSvc) secretRefs() map[string]string {
+	refs := map[string]string{}
+	file, err := svc.fileStore.Read()
+	if err != nil {
+		return refs
+	}
+	config := &AppConfig{}
+	if err := json.Unmarshal(file, config); err != nil {
+		return refs
+	}
+	for key, value := range secretFields(config) {
+		if ref, ok := strings.CutPrefix(*value, SECRET_REF); ok {
+			refs[key] = ref
+		}
+	}
+	return refs
+}
+
 func (svc AppConfigSvc) ReadConfigFile() (*AppConfig, error) {
 	config := &AppConfig{}
 	file, err := svc.fileStore.Read()
@@ -253,9 +813,109 @@ func (svc AppConfigSvc) ReadConfigFile() (*AppConfig, error) {
 	if err := json.Unmarshal(file, &config); err != nil {
 		return config, err
 	}
+	/* The configs of older versions have no install id, so the hooks get the marker from now on */
+	migrate := config.InstallID == ""
+	for key, value := range secretFields(config) {
+		if *value == "" || len(svc.secrets) == 0 {
+			continue
+		}
+		ref, ok := strings.CutPrefix(*value, SECRET_REF)
+		/* The configs of older versions have the tokens in plain text */
+		if !ok {
+			migrate = true
+			continue
+		}
+		secret, err := svc.secret(ref)
+		if err != nil {
+			svc.logs.Error("reading secret", "key", key, "ref", ref, "error", err.Error())
+			return config, err
+		}
+		*value = secret
+	}
+	if migrate {
+		svc.logs.Info("moving the config of an older version")
+		if err := svc.CreateConfigFile(config); err != nil {
+			return config, err
+		}
+	}
 	return config, nil
 }
 
+/*
+LoadConfigFile gives the config read last time while config.json doesn't change,
+so the agent doesn't read every secret from the keyring or the vault on every delivery
+*/
+func (svc AppConfigSvc) LoadConfigFile() (*AppConfig, error) {
+	file, err := svc.fileStore.Read()
+	if err != nil {
+		return &AppConfig{}, err
+	}
+	svc.cache.mu.Lock()
+	defer svc.cache.mu.Unlock()
+	if svc.cache.config == nil || !bytes.Equal(file, svc.cache.content) {
+		config, err := svc.ReadConfigFile()
+		if err != nil {
+			return config, err
+		}
+		svc.cache.content = file
+		svc.cache.config = config
+	}
+	/* Every caller gets its own copy to change */
+	return cloneConfig(svc.cache.config), nil
+}
+
+/* secret reads a reference like keyring/GitServerToken from its store */
+func (svc AppConfigSvc) secret(ref string) (string, error) {
+	name, key, _ := strings.Cut(ref, "/")
+	for _, store := range svc.secrets {
+		if store.Name() == name {
+			return store.Get(key)
+		}
+	}
+	return "", errors.New("the secrets are in the " + name + ", which is not available")
+}
+
+func WorkspaceNames(config *AppConfig) []string {
+	names := []string{APP_DEFAULT_WORKSPACE}
+	for _, ws := range config.Workspaces {
+		names = append(names, ws.Name)
+	}
+	return names
+}
+
+/* Workspace returns a copy of the config with the workspace settings applied */
+func Workspace(config *AppConfig, name string) (*AppConfig, error) {
+	ws := *config
+	ws.Workspaces = nil
+	if name == "" || name == APP_DEFAULT_WORKSPACE {
+		return &ws, nil
+	}
+	for _, w := range config.Workspaces {
+		if w.Name != name {
+			continue
+		}
+		ws.GitWorkDir = w.GitWorkDir
+		if w.GitScanDepth > 0 {
+			ws.GitScanDepth = w.GitScanDepth
+		}
+		if w.GitServerToken != "" {
+			ws.GitServerToken = w.GitServerToken
+		}
+		if len(w.GitServers) > 0 {
+			ws.GitServers = w.GitServers
+		}
+		return &ws, nil
+	}
+	return nil, errors.New("workspace not found " + name)
+}
+
+func RepositoriesFileName(workspace string) string {
+	if workspace == "" || workspace == APP_DEFAULT_WORKSPACE {
+		return APP_REPOS_FILE_NAME
+	}
+	return "repositories-" + workspace + ".json"
+}
+
 /* GitRepository */
 type GitRepositorySvc struct {
 	logs      AppLogger
@@ -271,37 +931,52 @@ func NewGitRepositorySvc(l AppLogger, a OSDirCommand, f FlatFiler) *GitRepositor
 	}
 }
 
-func (gr GitRepositorySvc) ScanRepositories(workdir string, gitProvider string) ([]*GitRepository, error) {
-	repos := []*GitRepository{}
-	fn := func(dirname string) {
-		workdir := filepath.Join(workdir, dirname)
-		git, _ := gr.appOS.LookProgram("git")
+func (gr GitRepositorySvc) ScanRepositories(workdir string, gitProviders ...string) ([]*GitRepository, error) {
+	report, err := gr.ScanWorkspace(workdir, APP_SCAN_DEPTH, gitProviders...)
+	return report.Repos, err
+}
+
+func (gr GitRepositorySvc) ScanWorkspace(workdir string, depth int, gitProviders ...string) (*ScanReport, error) {
+	report := &ScanReport{Repos: []*GitRepository{}, Skipped: []SkippedDir{}}
+	dirs, skipped, err := FindRepositories(gr.appOS.DirFS(workdir), depth)
+	if err != nil {
+		gr.logs.Error(err.Error())
+		return report, err
+	}
+	report.Skipped = skipped
+	git, _ := gr.appOS.LookProgram("git")
+	for _, dir := range dirs {
+		workdir := filepath.Join(workdir, filepath.FromSlash(dir))
 		url, err := gr.appOS.RunProgram(git, workdir, "remote", "get-url", "origin")
 		if err != nil {
 			gr.logs.Error("executing git command", "error", err.Error(), "path", git, "workdir", workdir)
-			return
+			report.Skipped = append(report.Skipped, SkippedDir{Path: dir, Reason: "without origin remote"})
+			continue
 		}
 		gr.logs.Info("repository remote url " + string(url))
-		surl := strings.Split(string(url), "/")
-		if len(surl) < 4 {
-			err = errors.New("getting repository info")
-			gr.logs.Error(err.Error())
-			return
+		remote, err := ParseRemoteURL(string(url))
+		if err != nil {
+			gr.logs.Error("getting repository info", "error", err.Error(), "workdir", workdir)
+			report.Skipped = append(report.Skipped, SkippedDir{Path: dir, Reason: "unsupported origin url"})
+			continue
 		}
-		if gitProvider != surl[2] {
-			err = errors.New("privider not suported" + surl[2])
+		if !slices.Contains(gitProviders, remote.Host) {
+			err = errors.New("provider not supported " + remote.Host)
 			gr.logs.Error(err.Error())
-			return
+			report.Skipped = append(report.Skipped, SkippedDir{Path: dir, Reason: "git server not configured " + remote.Host})
+			continue
 		}
-		name := strings.ReplaceAll(strings.ReplaceAll(surl[4], ".git", ""), "\n", "")
-		repos = append(repos, &GitRepository{Owner: surl[3], Name: name})
+		report.Repos = append(report.Repos, &GitRepository{
+			Owner:    remote.Owner,
+			Name:     remote.Name,
+			Provider: remote.Host,
+			Path:     workdir,
+		})
 	}
-	err := gr.appOS.WalkDirFunc(workdir, fn)
-	if err != nil {
-		gr.logs.Error(err.Error())
-		return repos, err
+	for _, s := range report.Skipped {
+		gr.logs.Info("skipping directory", "path", s.Path, "reason", s.Reason)
 	}
-	return repos, nil
+	return report, nil
 }
 
 func (gr GitRepositorySvc) SaveRepositories(repos []*GitRepository) (n int, err error) {
@@ -319,14 +994,202 @@ func (gr GitRepositorySvc) SaveRepositories(repos []*GitRepository) (n int, err
 	return n, nil
 }
 
-func (gr GitRepositorySvc) Pull(workdir, repoName, branch string) error {
+func (gr GitRepositorySvc) LoadRepositories() ([]*GitRepository, error) {
+	repos := []*GitRepository{}
+	content, err := gr.fileStore.Read()
+	if err != nil {
+		return repos, err
+	}
+	if err := json.Unmarshal(content, &repos); err != nil {
+		gr.logs.Error(err.Error())
+		return repos, err
+	}
+	return repos, nil
+}
+
+/*
+MatchRepositories returns every clone of owner/name hosted on provider,
+ignoring the case like the git servers do
+*/
+func MatchRepositories(repos []*GitRepository, provider, fullName string) []*GitRepository {
+	if provider == "" {
+		provider = APP_GIT_PROVIDER
+	}
+	matches := []*GitRepository{}
+	for _, r := range repos {
+		host := r.Provider
+		if host == "" {
+			host = APP_GIT_PROVIDER
+		}
+		if host == provider && strings.EqualFold(r.Owner+"/"+r.Name, fullName) {
+			matches = append(matches, r)
+		}
+	}
+	return matches
+}
+
+/* KeepStrategies copies the strategy chosen for every clone into the rescanned repositories */
+func KeepStrategies(saved []*GitRepository, scanned []*GitRepository) {
+	for _, r := range scanned {
+		for _, s := range saved {
+			if s.Path == r.Path && r.Strategy == "" {
+				r.Strategy = s.Strategy
+			}
+		}
+	}
+}
+
+/* CurrentBranch gives the ref of the checked out branch, or ErrUpdateSkipped with a detached HEAD */
+func (gr GitRepositorySvc) CurrentBranch(repo *GitRepository) (string, error) {
+	git, err := gr.appOS.LookProgram("git")
+	if err != nil {
+		return "", err
+	}
+	head, err := gr.git(git, repo.Path, "rev-parse", "--abbrev-ref", "HEAD")
+	if err != nil {
+		return "", err
+	}
+	branch := strings.TrimSpace(string(head))
+	if branch == "HEAD" {
+		return "", fmt.Errorf("%w: detached HEAD", ErrUpdateSkipped)
+	}
+	return "refs/heads/" + branch, nil
+}
+
+/*
+Pull refreshes the clone with the pushed ref following the repository strategy.
+The working copy is only touched when the pushed branch is checked out, other
+branches are fetched so a push never merges into the branch being worked on.
+When the working copy is left as it is, the error wraps ErrUpdateSkipped.
+It gives the output of the git commands for the delivery log.
+*/
+func (gr GitRepositorySvc) Pull(repo *GitRepository, ref string) (string, error) {
+	if repo.Path == "" {
+		return "", errors.New("repository without local path " + repo.Owner + "/" + repo.Name)
+	}
+	branch, ok := strings.CutPrefix(ref, "refs/heads/")
+	if !ok || branch == "" {
+		gr.logs.Info("ignoring push for non branch ref", "ref", ref, "workspace", repo.Path)
+		return "", nil
+	}
 	git, err := gr.appOS.LookProgram("git")
 	if err != nil {
 		slog.Error("which git path", "error", err.Error())
+		return "", err
+	}
+	session := &gitSession{gr: gr, git: git, workspace: repo.Path}
+	err = gr.pull(session, repo, branch)
+	return session.output.String(), err
+}
+
+func (gr GitRepositorySvc) pull(s *gitSession, repo *GitRepository, branch string) error {
+	if repo.Strategy == GIT_STRATEGY_FETCH_ONLY {
+		_, err := s.run("fetch", "origin", branch)
+		return err
+	}
+	/* A rebase or merge leaves HEAD detached or half done, only the remote-tracking ref is safe */
+	if op := gr.operationInProgress(s); op != "" {
+		if _, err := s.run("fetch", "origin", branch); err != nil {
+			return err
+		}
+		return fmt.Errorf("%w: %s in progress", ErrUpdateSkipped, op)
+	}
+	head, err := s.run("rev-parse", "--abbrev-ref", "HEAD")
+	if err != nil {
 		return err
 	}
-	workspace := filepath.Join(workdir, repoName)
-	out, err := gr.appOS.RunProgram(git, workspace, "pull", "origin", branch)
+	switch strings.TrimSpace(string(head)) {
+	case branch:
+	case "HEAD":
+		if err := gr.fetchBranch(s, branch); err != nil {
+			return err
+		}
+		return fmt.Errorf("%w: detached HEAD", ErrUpdateSkipped)
+	default:
+		return gr.fetchBranch(s, branch)
+	}
+	switch repo.Strategy {
+	case GIT_STRATEGY_AUTOSTASH:
+		_, err = s.run("pull", "--rebase", "--autostash", "origin", branch)
+		return err
+	case GIT_STRATEGY_SKIP_DIRTY:
+		status, err := s.run("status", "--porcelain", "--untracked-files=no")
+		if err != nil {
+			return err
+		}
+		if len(bytes.TrimSpace(status)) > 0 {
+			if _, err := s.run("fetch", "origin", branch); err != nil {
+				return err
+			}
+			return fmt.Errorf("%w: uncommitted changes", ErrUpdateSkipped)
+		}
+	}
+	/* git refuses the fast-forward when it would overwrite uncommitted changes */
+	_, err = s.run("pull", "--ff-only", "origin", branch)
+	return err
+}
+
+/* fetchBranch updates a branch that is not checked out */
+func (gr GitRepositorySvc) fetchBranch(s *gitSession, branch string) error {
+	/* Without a local branch only the remote-tracking ref is updated */
+	if _, err := gr.appOS.RunProgram(s.git, s.workspace, "rev-parse", "--verify", "--quiet", "refs/heads/"+branch); err == nil {
+		/* git refuses to move the local branch when it is not a fast-forward */
+		if _, err := s.run("fetch", "origin", branch+":"+branch); err == nil {
+			return nil
+		}
+	}
+	_, err := s.run("fetch", "origin", branch)
+	return err
+}
+
+/* gitSession keeps the output of the git commands run by a pull */
+type gitSession struct {
+	gr        GitRepositorySvc
+	git       string
+	workspace string
+	output    strings.Builder
+}
+
+func (s *gitSession) run(args ...string) ([]byte, error) {
+	out, err := s.gr.git(s.git, s.workspace, args...)
+	fmt.Fprintf(&s.output, "$ git %s\n%s", strings.Join(args, " "), out)
+	return out, err
+}
+
+/*
+operationInProgress looks for the state files git keeps while an operation waits for the user.
+Linked worktrees and submodules have a .git file, git tells where their git dir is.
+*/
+func (gr GitRepositorySvc) operationInProgress(s *gitSession) string {
+	out, err := gr.appOS.RunProgram(s.git, s.workspace, "rev-parse", "--git-dir")
+	if err != nil {
+		return ""
+	}
+	dir := strings.TrimSpace(string(out))
+	if dir == "" {
+		return ""
+	}
+	if !filepath.IsAbs(dir) {
+		dir = filepath.Join(s.workspace, dir)
+	}
+	fsys := gr.appOS.DirFS(dir)
+	operations := []struct{ file, name string }{
+		{"rebase-merge", "rebase"},
+		{"rebase-apply", "rebase"},
+		{"MERGE_HEAD", "merge"},
+		{"CHERRY_PICK_HEAD", "cherry-pick"},
+		{"REVERT_HEAD", "revert"},
+	}
+	for _, op := range operations {
+		if _, err := fs.Stat(fsys, op.file); err == nil {
+			return op.name
+		}
+	}
+	return ""
+}
+
+func (gr GitRepositorySvc) git(git string, workspace string, args ...string) ([]byte, error) {
+	out, err := gr.appOS.RunProgram(git, workspace, args...)
 	if err != nil {
 		gr.logs.LogAttrs(
 			context.Background(),
@@ -335,19 +1198,106 @@ func (gr GitRepositorySvc) Pull(workdir, repoName, branch string) error {
 			slog.String("error", err.Error()),
 			slog.String("path", git),
 			slog.String("workspace", workspace),
+			slog.Any("args", args),
 			slog.String("stdout", string(out)),
 		)
+		return out, err
+	}
+	return out, nil
+}
+
+/* Updates */
+type UpdateSvc struct {
+	logs      AppLogger
+	fileStore FlatFiler
+	mu        sync.Mutex
+}
+
+func NewUpdateSvc(l AppLogger, f FlatFiler) *UpdateSvc {
+	return &UpdateSvc{
+		logs:      l,
+		fileStore: f,
+	}
+}
+
+/* Record keeps the last update of every clone, so a skipped update is visible until the next push */
+func (svc *UpdateSvc) Record(repo *GitRepository, ref string, pullErr error) error {
+	update := RepositoryUpdate{
+		Repository: repo.Owner + "/" + repo.Name,
+		Path:       repo.Path,
+		Branch:     strings.TrimPrefix(ref, "refs/heads/"),
+		Time:       time.Now(),
+	}
+	update.Status, update.Reason = PullOutcome(pullErr)
+	svc.mu.Lock()
+	defer svc.mu.Unlock()
+	/* The file does not exist until the first update */
+	updates, _ := svc.Updates()
+	updates = slices.DeleteFunc(updates, func(u RepositoryUpdate) bool {
+		return u.Path == update.Path
+	})
+	updates = append(updates, update)
+	content, err := json.MarshalIndent(updates, "", "  ")
+	if err != nil {
+		svc.logs.Error(err.Error())
 		return err
 	}
-	return nil
+	_, err = svc.fileStore.Write(content)
+	return err
+}
+
+/* PullOutcome gives the update status of a pull and the reason when it is not updated */
+func PullOutcome(pullErr error) (string, string) {
+	switch {
+	case errors.Is(pullErr, ErrUpdateSkipped):
+		return UPDATE_STATUS_SKIPPED, strings.TrimPrefix(pullErr.Error(), ErrUpdateSkipped.Error()+": ")
+	case pullErr != nil:
+		return UPDATE_STATUS_FAILED, pullErr.Error()
+	}
+	return UPDATE_STATUS_UPDATED, ""
 }
 
+func (svc *UpdateSvc) Updates() ([]RepositoryUpdate, error) {
+	updates := []RepositoryUpdate{}
+	content, err := svc.fileStore.Read()
+	if err != nil {
+		return updates, err
+	}
+	if err := json.Unmarshal(content, &updates); err != nil {
+		svc.logs.Error(err.Error())
+		return updates, err
+	}
+	return updates, nil
+}
+
+/* WebHookSecret gives a random secret of 256 bits */
 func WebHookSecret() string {
-	const alpha = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
-	rand.New(rand.NewSource(time.Now().UnixNano()))
-	secret := make([]byte, 10)
-	for i := range secret {
-		secret[i] = alpha[rand.Intn(len(alpha))]
+	secret := make([]byte, 32)
+	if _, err := crand.Read(secret); err != nil {
+		panic("reading random secret: " + err.Error())
+	}
+	return hex.EncodeToString(secret)
+}
+
+/* HookSecrets gives the secrets the webhooks may be signed with, the current one first */
+func HookSecrets(config *AppConfig, now time.Time) []string {
+	secrets := []string{config.GitHookSecret}
+	previous := config.PreviousHookSecret
+	if previous != nil && previous.Secret != "" && now.Before(previous.Until) {
+		secrets = append(secrets, previous.Secret)
+	}
+	return secrets
+}
+
+/*
+EdgeVerifiesGitHub tells if ngrok can check the signatures at the edge. Its verifier
+only knows the deliveries of github.com signed with a single secret, so the other
+git servers and the rotations are left to the handler.
+*/
+func EdgeVerifiesGitHub(config *AppConfig, now time.Time) bool {
+	servers := AllGitServers(config)
+	if len(servers) != 1 || servers[0].Kind != GIT_PROVIDER_GITHUB || servers[0].Host != APP_GIT_PROVIDER {
+		return false
 	}
-	return string(secret)
+	return len(HookSecrets(config, now)) == 1
 }
@@ -1,20 +1,31 @@
 package gitfresh
 
 import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"io/fs"
 	"log/slog"
 	"math/rand"
 	"net/http"
+	"net/http/httptest"
+	"net/url"
 	"os"
 	"path/filepath"
 	"reflect"
+	"slices"
+	"strconv"
 	"strings"
 	"testing"
+	"testing/fstest"
 	"time"
 
 	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
 )
 
 /* MockFlatFile */
@@ -37,7 +48,7 @@ func (f *MockFlatFile) Read() (n []byte, err error) {
 type MockAppOS struct {
 	RunFunc          func(path string, workdir string, args ...string) ([]byte, error)
 	LookFunc         func(cmd string) (string, error)
-	WalkFuncMock     func(path string, fn func(string)) error
+	DirFSFunc        func(path string) fs.FS
 	StartFunc        func(path string, args ...string) (int, error)
 	StopProgramFunc  func(pid int) error
 	UserHomePathFunc func() (string, error)
@@ -68,8 +79,8 @@ func (m *MockAppOS) LookProgram(cmd string) (string, error) {
 	return m.LookFunc(cmd)
 }
 
-func (m *MockAppOS) WalkDirFunc(path string, fn func(string)) error {
-	return m.WalkFuncMock(path, fn)
+func (m *MockAppOS) DirFS(path string) fs.FS {
+	return m.DirFSFunc(path)
 }
 
 /* MockClient */
@@ -118,11 +129,12 @@ func TestMain(m *testing.M) {
 		LookFunc: func(cmd string) (string, error) {
 			return "/bin/cmd", nil
 		},
-		WalkFuncMock: func(path string, fn func(string)) error {
+		DirFSFunc: func(path string) fs.FS {
+			fsys := fstest.MapFS{}
 			for i := range tnum {
-				fn(fmt.Sprint("folder", i))
+				fsys[fmt.Sprint("folder", i, "/.git/HEAD")] = &fstest.MapFile{}
 			}
-			return nil
+			return fsys
 		},
 		FindProgramFunc: func(pid int) (bool, error) {
 			return true, nil
@@ -150,10 +162,12 @@ func TestGitRepositorySvc_ScanRepositories(t *testing.T) {
 		gitProvider string
 	}
 	tcomparableRepos := make([]*GitRepository, 0, tnum)
-	for i := tnum; i > 0; i-- {
+	for i := range tnum {
 		tcomparableRepos = append(tcomparableRepos, &GitRepository{
-			Name:  "gitfresh",
-			Owner: "apolo96",
+			Name:     "gitfresh",
+			Owner:    "apolo96",
+			Provider: "github.com",
+			Path:     filepath.Join("mipc/user/work/code", fmt.Sprint("folder", i)),
 		})
 	}
 	tests := []struct {
@@ -496,3 +510,1157 @@ func TestGitServerSvc_CreateGitServerHook(t *testing.T) {
 		})
 	}
 }
+
+func TestGitServerSvc_CreateGitServerHook_GitLab(t *testing.T) {
+	var created map[string]any
+	mockClient := &MockClient{DoFunc: func(req *http.Request) (*http.Response, error) {
+		if req.URL.EscapedPath() != "/api/v4/projects/apolo96%2Fgitfresh/hooks" {
+			t.Errorf("unexpected gitlab url %s", req.URL.EscapedPath())
+		}
+		if req.Header.Get("PRIVATE-TOKEN") != "glpat-token" {
+			t.Errorf("unexpected gitlab token %q", req.Header.Get("PRIVATE-TOKEN"))
+		}
+		if req.Method == "GET" {
+			return &http.Response{
+				StatusCode: 200,
+				Body:       io.NopCloser(strings.NewReader(`[{"id":1,"url":"https://other.tunnel.app"}]`)),
+			}, nil
+		}
+		if err := json.NewDecoder(req.Body).Decode(&created); err != nil {
+			t.Fatal(err)
+		}
+		return &http.Response{
+			StatusCode: 201,
+			Body:       io.NopCloser(strings.NewReader("")),
+		}, nil
+	}}
+	svc := NewGitServerSvc(
+		slog.New(slog.NewJSONHandler(os.Stderr, &slog.HandlerOptions{Level: slog.LevelDebug})),
+		mockClient,
+	)
+	repo := &GitRepository{Owner: "apolo96", Name: "gitfresh", Provider: APP_GITLAB_PROVIDER}
+	config := &AppConfig{GitLabToken: "glpat-token", TunnelDomain: "fresh.tunnel.app", GitHookSecret: "s3cr3t"}
+	if err := svc.CreateGitServerHook(repo, config); err != nil {
+		t.Fatalf("GitServerSvc.CreateGitServerHook() error = %v", err)
+	}
+	if created["url"] != "https://fresh.tunnel.app" || created["token"] != "s3cr3t" || created["push_events"] != true {
+		t.Errorf("GitServerSvc.CreateGitServerHook() sent %v", created)
+	}
+	if err := svc.CreateGitServerHook(repo, &AppConfig{TunnelDomain: "fresh.tunnel.app"}); err == nil {
+		t.Error("GitServerSvc.CreateGitServerHook() without gitlab token should fail")
+	}
+}
+
+func TestGitServerSvc_ParseWebhook(t *testing.T) {
+	config := &AppConfig{
+		GitServerToken: "ghp",
+		GitLabToken:    "glpat",
+		BitbucketToken: "bbat",
+		GiteaURL:       "https://git.company.com",
+		GiteaToken:     "gitea",
+		GitHookSecret:  "s3cr3t",
+		/* A second Forgejo instance, its deliveries must not be claimed by git.company.com */
+		GitServers: []GitServerConfig{{Kind: GIT_PROVIDER_GITEA, WebURL: "https://forge.other.org", Token: "forgejo"}},
+	}
+	giteaPush := `{"ref":"refs/heads/main","after":"0a1b2c3d","repository":{"name":"api","full_name":"team/api","html_url":"https://git.company.com/team/api"}}`
+	giteaMac := hmac.New(sha256.New, []byte("s3cr3t"))
+	giteaMac.Write([]byte(giteaPush))
+	giteaSignature := hex.EncodeToString(giteaMac.Sum(nil))
+	forgejoPush := `{"ref":"refs/heads/dev","after":"7e6d5c4b","repository":{"name":"web","full_name":"ops/web","clone_url":"https://forge.other.org/ops/web.git"}}`
+	forgejoMac := hmac.New(sha256.New, []byte("s3cr3t"))
+	forgejoMac.Write([]byte(forgejoPush))
+	forgejoSignature := hex.EncodeToString(forgejoMac.Sum(nil))
+	bitbucketPush := `{"repository":{"name":"Git Fresh","full_name":"apolo96/gitfresh"},"push":{"changes":[` +
+		`{"new":{"type":"branch","name":"main","target":{"hash":"1f2e3d4c"}}},` +
+		`{"new":{"type":"tag","name":"v1.0.0","target":{"hash":"1f2e3d4c"}}},` +
+		`{"new":null},` +
+		`{"new":{"type":"branch","name":"develop","target":{"hash":"5a6b7c8d"}}}]}}`
+	mac := hmac.New(sha256.New, []byte("s3cr3t"))
+	mac.Write([]byte(bitbucketPush))
+	bitbucketSignature := "sha256=" + hex.EncodeToString(mac.Sum(nil))
+	githubPush := `{"ref":"refs/heads/main","after":"9a8b7c6d","repository":{"name":"gitfresh","full_name":"apolo96/gitfresh"}}`
+	githubMac := hmac.New(sha256.New, []byte("s3cr3t"))
+	githubMac.Write([]byte(githubPush))
+	githubSignature := "sha256=" + hex.EncodeToString(githubMac.Sum(nil))
+	pingMac := hmac.New(sha256.New, []byte("s3cr3t"))
+	pingMac.Write([]byte(`{}`))
+	gitlabPush := `{"object_kind":"push","ref":"refs/heads/main","after":"4c3f1e0d","project":{"name":"Git Fresh","path_with_namespace":"group/sub/gitfresh"}}`
+	/* Deleting a branch and pushing a tag leave nothing to pull */
+	githubDelete := `{"ref":"refs/heads/feature","after":"0000000000000000000000000000000000000000","deleted":true,"repository":{"name":"gitfresh","full_name":"apolo96/gitfresh"}}`
+	githubDeleteMac := hmac.New(sha256.New, []byte("s3cr3t"))
+	githubDeleteMac.Write([]byte(githubDelete))
+	githubTag := `{"ref":"refs/tags/v1.0.0","after":"9a8b7c6d","repository":{"name":"gitfresh","full_name":"apolo96/gitfresh"}}`
+	githubTagMac := hmac.New(sha256.New, []byte("s3cr3t"))
+	githubTagMac.Write([]byte(githubTag))
+	giteaDelete := `{"ref":"refs/heads/old","after":"0000000000000000000000000000000000000000","repository":{"name":"api","full_name":"team/api","html_url":"https://git.company.com/team/api"}}`
+	giteaDeleteMac := hmac.New(sha256.New, []byte("s3cr3t"))
+	giteaDeleteMac.Write([]byte(giteaDelete))
+	tests := []struct {
+		name    string
+		headers map[string]string
+		body    string
+		want    []*APIPayload
+		wantErr error
+	}{
+		{
+			name:    "github push",
+			headers: map[string]string{"X-GitHub-Event": "push", "X-Hub-Signature-256": githubSignature},
+			body:    githubPush,
+			want:    []*APIPayload{{Ref: "refs/heads/main", Commit: "9a8b7c6d", Repository: APIRepository{Name: "gitfresh", FullName: "apolo96/gitfresh"}, Provider: "github.com"}},
+		},
+		{
+			name:    "github push with tampered body",
+			headers: map[string]string{"X-GitHub-Event": "push", "X-Hub-Signature-256": githubSignature},
+			body:    strings.Replace(githubPush, "main", "prod", 1),
+			wantErr: ErrInvalidSignature,
+		},
+		{
+			name:    "github unsigned push",
+			headers: map[string]string{"X-GitHub-Event": "push"},
+			body:    githubPush,
+			wantErr: ErrInvalidSignature,
+		},
+		{
+			name:    "github ping is ignored",
+			headers: map[string]string{"X-GitHub-Event": "ping", "X-Hub-Signature-256": "sha256=" + hex.EncodeToString(pingMac.Sum(nil))},
+			body:    `{}`,
+			wantErr: ErrEventIgnored,
+		},
+		{
+			name:    "github branch deletion is ignored",
+			headers: map[string]string{"X-GitHub-Event": "push", "X-Hub-Signature-256": "sha256=" + hex.EncodeToString(githubDeleteMac.Sum(nil))},
+			body:    githubDelete,
+			wantErr: ErrEventIgnored,
+		},
+		{
+			name:    "github tag push is ignored",
+			headers: map[string]string{"X-GitHub-Event": "push", "X-Hub-Signature-256": "sha256=" + hex.EncodeToString(githubTagMac.Sum(nil))},
+			body:    githubTag,
+			wantErr: ErrEventIgnored,
+		},
+		{
+			name:    "gitlab push",
+			headers: map[string]string{"X-Gitlab-Event": "Push Hook", "X-Gitlab-Token": "s3cr3t"},
+			body:    gitlabPush,
+			want:    []*APIPayload{{Ref: "refs/heads/main", Commit: "4c3f1e0d", Repository: APIRepository{Name: "gitfresh", FullName: "group/sub/gitfresh"}, Provider: "gitlab.com"}},
+		},
+		{
+			name:    "gitlab push with wrong token",
+			headers: map[string]string{"X-Gitlab-Event": "Push Hook", "X-Gitlab-Token": "guess"},
+			body:    gitlabPush,
+			wantErr: ErrInvalidSignature,
+		},
+		{
+			name:    "gitlab branch deletion is ignored",
+			headers: map[string]string{"X-Gitlab-Event": "Push Hook", "X-Gitlab-Token": "s3cr3t"},
+			body:    `{"object_kind":"push","ref":"refs/heads/feature","after":"0000000000000000000000000000000000000000","project":{"name":"Git Fresh","path_with_namespace":"group/sub/gitfresh"}}`,
+			wantErr: ErrEventIgnored,
+		},
+		{
+			name:    "gitlab tag push is ignored",
+			headers: map[string]string{"X-Gitlab-Event": "Tag Push Hook", "X-Gitlab-Token": "s3cr3t"},
+			body:    `{"object_kind":"tag_push","ref":"refs/tags/v1.0.0","after":"4c3f1e0d","project":{"name":"Git Fresh","path_with_namespace":"group/sub/gitfresh"}}`,
+			wantErr: ErrEventIgnored,
+		},
+		{
+			name:    "bitbucket push with several changes",
+			headers: map[string]string{"X-Event-Key": "repo:push", "X-Hub-Signature": bitbucketSignature},
+			body:    bitbucketPush,
+			want: []*APIPayload{
+				{Ref: "refs/heads/main", Commit: "1f2e3d4c", Repository: APIRepository{Name: "gitfresh", FullName: "apolo96/gitfresh"}, Provider: "bitbucket.org"},
+				{Ref: "refs/heads/develop", Commit: "5a6b7c8d", Repository: APIRepository{Name: "gitfresh", FullName: "apolo96/gitfresh"}, Provider: "bitbucket.org"},
+			},
+		},
+		{
+			name:    "bitbucket push with tampered signature",
+			headers: map[string]string{"X-Event-Key": "repo:push", "X-Hub-Signature": "sha256=00ff"},
+			body:    bitbucketPush,
+			wantErr: ErrInvalidSignature,
+		},
+		{
+			name:    "bitbucket unsigned push",
+			headers: map[string]string{"X-Event-Key": "repo:push"},
+			body:    bitbucketPush,
+			wantErr: ErrInvalidSignature,
+		},
+		{
+			name:    "gitea push with github compatible headers",
+			headers: map[string]string{"X-Gitea-Event": "push", "X-GitHub-Event": "push", "X-Gitea-Signature": giteaSignature},
+			body:    giteaPush,
+			want:    []*APIPayload{{Ref: "refs/heads/main", Commit: "0a1b2c3d", Repository: APIRepository{Name: "api", FullName: "team/api"}, Provider: "git.company.com"}},
+		},
+		{
+			name:    "gitea branch deletion is ignored",
+			headers: map[string]string{"X-Gitea-Event": "push", "X-Gitea-Signature": hex.EncodeToString(giteaDeleteMac.Sum(nil))},
+			body:    giteaDelete,
+			wantErr: ErrEventIgnored,
+		},
+		{
+			name:    "forgejo push from the second instance",
+			headers: map[string]string{"X-Forgejo-Event": "push", "X-Forgejo-Signature": forgejoSignature},
+			body:    forgejoPush,
+			want:    []*APIPayload{{Ref: "refs/heads/dev", Commit: "7e6d5c4b", Repository: APIRepository{Name: "web", FullName: "ops/web"}, Provider: "forge.other.org"}},
+		},
+		{
+			name:    "forgejo push with tampered signature",
+			headers: map[string]string{"X-Forgejo-Event": "push", "X-Forgejo-Signature": giteaSignature},
+			body:    `{"ref":"refs/heads/main","after":"ffffffff","repository":{"name":"api"}}`,
+			wantErr: ErrInvalidSignature,
+		},
+		{
+			name:    "unknown sender",
+			body:    `{}`,
+			wantErr: ErrUnknownDelivery,
+		},
+	}
+	svc := NewGitServerSvc(
+		slog.New(slog.NewJSONHandler(os.Stderr, &slog.HandlerOptions{Level: slog.LevelDebug})),
+		&MockClient{},
+	)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, _ := http.NewRequest("POST", "/", strings.NewReader(tt.body))
+			for k, v := range tt.headers {
+				req.Header.Set(k, v)
+			}
+			got, err := svc.ParseWebhook(req, config)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("GitServerSvc.ParseWebhook() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if diff := cmp.Diff(got, tt.want); diff != "" {
+				t.Error("GitServerSvc.ParseWebhook() = ", diff)
+			}
+		})
+	}
+}
+
+func TestGitServerSvc_ParseWebhook_EmptySecret(t *testing.T) {
+	/* An empty token equals an empty secret, the delivery is rejected anyway */
+	config := &AppConfig{GitLabToken: "glpat"}
+	req, _ := http.NewRequest("POST", "/", strings.NewReader(`{"object_kind":"push","ref":"refs/heads/main","project":{"path_with_namespace":"group/gitfresh"}}`))
+	req.Header.Set("X-Gitlab-Event", "Push Hook")
+	if _, err := NewGitServerSvc(slog.Default(), &MockClient{}).ParseWebhook(req, config); !errors.Is(err, ErrInvalidSignature) {
+		t.Errorf("GitServerSvc.ParseWebhook() without secret error = %v, want %v", err, ErrInvalidSignature)
+	}
+}
+
+func TestGitServerSvc_ParseWebhook_GitLabInstances(t *testing.T) {
+	config := &AppConfig{
+		GitLabToken:   "glpat",
+		GitHookSecret: "s3cr3t",
+		GitServers:    []GitServerConfig{{Kind: GIT_PROVIDER_GITLAB, Host: "gitlab.company.com", Token: "glpat-company"}},
+	}
+	push := `{"object_kind":"push","ref":"refs/heads/main","after":"4c3f1e0d","project":{"name":"api","path_with_namespace":"team/api"}}`
+	tests := []struct {
+		name     string
+		instance string
+		want     string
+		wantErr  error
+	}{
+		{name: "gitlab.com", instance: "https://gitlab.com", want: APP_GITLAB_PROVIDER},
+		{name: "self-managed", instance: "https://gitlab.company.com", want: "gitlab.company.com"},
+		/* Without the instance header none of them can claim it */
+		{name: "unknown instance", wantErr: ErrUnknownDelivery},
+	}
+	svc := NewGitServerSvc(slog.Default(), &MockClient{})
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, _ := http.NewRequest("POST", "/", strings.NewReader(push))
+			req.Header.Set("X-Gitlab-Event", "Push Hook")
+			req.Header.Set("X-Gitlab-Token", "s3cr3t")
+			if tt.instance != "" {
+				req.Header.Set("X-Gitlab-Instance", tt.instance)
+			}
+			got, err := svc.ParseWebhook(req, config)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("GitServerSvc.ParseWebhook() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && got[0].Provider != tt.want {
+				t.Errorf("GitServerSvc.ParseWebhook() provider = %s, want %s", got[0].Provider, tt.want)
+			}
+		})
+	}
+}
+
+func TestGitServerSvc_ParseWebhook_Workspace(t *testing.T) {
+	/* The self-managed GitLab is only configured in the work workspace */
+	config := &AppConfig{
+		GitServerToken: "ghp",
+		GitHookSecret:  "s3cr3t",
+		Workspaces: []WorkspaceConfig{{
+			Name:       "work",
+			GitWorkDir: "/work",
+			GitServers: []GitServerConfig{{Kind: GIT_PROVIDER_GITLAB, Host: "gitlab.company.com", Token: "glpat-company"}},
+		}},
+	}
+	push := `{"object_kind":"push","ref":"refs/heads/main","after":"4c3f1e0d","project":{"name":"api","path_with_namespace":"team/api"}}`
+	req, _ := http.NewRequest("POST", "/", strings.NewReader(push))
+	req.Header.Set("X-Gitlab-Event", "Push Hook")
+	req.Header.Set("X-Gitlab-Token", "s3cr3t")
+	req.Header.Set("X-Gitlab-Instance", "https://gitlab.company.com")
+	got, err := NewGitServerSvc(slog.Default(), &MockClient{}).ParseWebhook(req, config)
+	if err != nil {
+		t.Fatalf("GitServerSvc.ParseWebhook() error = %v", err)
+	}
+	if got[0].Provider != "gitlab.company.com" {
+		t.Errorf("GitServerSvc.ParseWebhook() provider = %s", got[0].Provider)
+	}
+}
+
+func TestGitServerSvc_CreateGitServerHook_Bitbucket(t *testing.T) {
+	var created map[string]any
+	mockClient := &MockClient{DoFunc: func(req *http.Request) (*http.Response, error) {
+		if req.URL.String() != "https://api.bitbucket.org/2.0/repositories/apolo96/gitfresh/hooks" {
+			t.Errorf("unexpected bitbucket url %s", req.URL)
+		}
+		if user, pass, ok := req.BasicAuth(); !ok || user != "lio" || pass != "app-password" {
+			t.Errorf("unexpected bitbucket credentials %q", req.Header.Get("Authorization"))
+		}
+		if req.Method == "GET" {
+			return &http.Response{
+				StatusCode: 200,
+				Body:       io.NopCloser(strings.NewReader(`{"values":[]}`)),
+			}, nil
+		}
+		if err := json.NewDecoder(req.Body).Decode(&created); err != nil {
+			t.Fatal(err)
+		}
+		return &http.Response{
+			StatusCode: 201,
+			Body:       io.NopCloser(strings.NewReader("")),
+		}, nil
+	}}
+	svc := NewGitServerSvc(
+		slog.New(slog.NewJSONHandler(os.Stderr, &slog.HandlerOptions{Level: slog.LevelDebug})),
+		mockClient,
+	)
+	repo := &GitRepository{Owner: "apolo96", Name: "gitfresh", Provider: APP_BITBUCKET_PROVIDER}
+	config := &AppConfig{BitbucketToken: "lio:app-password", TunnelDomain: "fresh.tunnel.app", GitHookSecret: "s3cr3t"}
+	if err := svc.CreateGitServerHook(repo, config); err != nil {
+		t.Fatalf("GitServerSvc.CreateGitServerHook() error = %v", err)
+	}
+	if created["url"] != "https://fresh.tunnel.app" || created["secret"] != "s3cr3t" {
+		t.Errorf("GitServerSvc.CreateGitServerHook() sent %v", created)
+	}
+	if events, _ := created["events"].([]any); len(events) != 1 || events[0] != "repo:push" {
+		t.Errorf("GitServerSvc.CreateGitServerHook() events = %v", created["events"])
+	}
+}
+
+func TestGitServerSvc_CreateGitServerHook_Gitea(t *testing.T) {
+	hooks := []map[string]any{}
+	forge := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/v1/repos/team/api/hooks" {
+			http.NotFound(w, r)
+			return
+		}
+		if r.Header.Get("Authorization") != "token gitea-token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if r.Method == "POST" {
+			hook := map[string]any{}
+			json.NewDecoder(r.Body).Decode(&hook)
+			hook["id"] = len(hooks) + 1
+			hooks = append(hooks, hook)
+			w.WriteHeader(http.StatusCreated)
+		}
+		json.NewEncoder(w).Encode(hooks)
+	}))
+	defer forge.Close()
+	svc := NewGitServerSvc(
+		slog.New(slog.NewJSONHandler(os.Stderr, &slog.HandlerOptions{Level: slog.LevelDebug})),
+		forge.Client(),
+	)
+	u, _ := url.Parse(forge.URL)
+	repo := &GitRepository{Owner: "team", Name: "api", Provider: u.Hostname()}
+	config := &AppConfig{GiteaURL: forge.URL, GiteaToken: "gitea-token", TunnelDomain: "fresh.tunnel.app", GitHookSecret: "s3cr3t"}
+	for range 2 {
+		if err := svc.CreateGitServerHook(repo, config); err != nil {
+			t.Fatalf("GitServerSvc.CreateGitServerHook() error = %v", err)
+		}
+	}
+	if len(hooks) != 1 {
+		t.Fatalf("GitServerSvc.CreateGitServerHook() created %d hooks, want 1", len(hooks))
+	}
+	hookConfig, _ := hooks[0]["config"].(map[string]any)
+	if hooks[0]["type"] != "gitea" || hookConfig["url"] != "https://fresh.tunnel.app" || hookConfig["secret"] != "s3cr3t" {
+		t.Errorf("GitServerSvc.CreateGitServerHook() sent %v", hooks[0])
+	}
+	if got := svc.ProviderHosts(config); !slices.Contains(got, u.Hostname()) {
+		t.Errorf("GitServerSvc.ProviderHosts() = %v, want %s", got, u.Hostname())
+	}
+}
+
+func TestGitRepositorySvc_ScanRepositories_Remotes(t *testing.T) {
+	remotes := map[string]string{
+		"api":     "https://git.company.com:3000/team/api.git\n",
+		"web":     "git@github.com:team/web.git\n",
+		"infra":   "ssh://git@git.company.com:2222/platform/infra/terraform.git\n",
+		"archive": "https://gitlab.com/team/archive.git\n",
+		"local":   "/srv/mirrors/local.git\n",
+	}
+	appOS := &MockAppOS{
+		RunFunc: func(path string, workdir string, args ...string) ([]byte, error) {
+			return []byte(remotes[filepath.Base(workdir)]), nil
+		},
+		LookFunc: mockAppOS.LookFunc,
+		DirFSFunc: func(path string) fs.FS {
+			fsys := fstest.MapFS{}
+			for _, dir := range []string{"api", "web", "infra", "archive", "local"} {
+				fsys[dir+"/.git/HEAD"] = &fstest.MapFile{}
+			}
+			return fsys
+		},
+	}
+	gr := NewGitRepositorySvc(
+		slog.New(slog.NewJSONHandler(os.Stderr, &slog.HandlerOptions{Level: slog.LevelDebug})),
+		appOS,
+		tfileStoreRepo,
+	)
+	got, err := gr.ScanRepositories("mipc/user/work/code", "github.com", "git.company.com")
+	if err != nil {
+		t.Fatalf("GitRepositorySvc.ScanRepositories() error = %v", err)
+	}
+	want := []*GitRepository{
+		{Owner: "team", Name: "api", Provider: "git.company.com", Path: "mipc/user/work/code/api"},
+		{Owner: "platform/infra", Name: "terraform", Provider: "git.company.com", Path: "mipc/user/work/code/infra"},
+		{Owner: "team", Name: "web", Provider: "github.com", Path: "mipc/user/work/code/web"},
+	}
+	if diff := cmp.Diff(got, want); diff != "" {
+		t.Error("GitRepositorySvc.ScanRepositories() = ", diff)
+	}
+}
+
+func TestGitServerSvc_GitHubEnterprise(t *testing.T) {
+	var gotURL, gotToken string
+	mockClient := &MockClient{DoFunc: func(req *http.Request) (*http.Response, error) {
+		gotURL = req.URL.String()
+		gotToken = req.Header.Get("Authorization")
+		return &http.Response{
+			StatusCode: 201,
+			Body:       io.NopCloser(strings.NewReader("")),
+		}, nil
+	}}
+	svc := NewGitServerSvc(
+		slog.New(slog.NewJSONHandler(os.Stderr, &slog.HandlerOptions{Level: slog.LevelDebug})),
+		mockClient,
+	)
+	config := &AppConfig{
+		GitServerToken: "ghp-public",
+		GitServers: []GitServerConfig{
+			{Kind: GIT_PROVIDER_GITHUB, Host: "ghe.company.com", Token: "ghp-enterprise"},
+		},
+		TunnelDomain:  "fresh.tunnel.app",
+		GitHookSecret: "s3cr3t",
+	}
+	if got := svc.ProviderHosts(config); !cmp.Equal(got, []string{"github.com", "ghe.company.com"}) {
+		t.Errorf("GitServerSvc.ProviderHosts() = %v", got)
+	}
+	repo := &GitRepository{Owner: "platform", Name: "api", Provider: "ghe.company.com"}
+	if err := svc.CreateGitServerHook(repo, config); err != nil {
+		t.Fatalf("GitServerSvc.CreateGitServerHook() error = %v", err)
+	}
+	if gotURL != "https://ghe.company.com/api/v3/repos/platform/api/hooks" || gotToken != "Bearer ghp-enterprise" {
+		t.Errorf("GitServerSvc.CreateGitServerHook() requested %s with %s", gotURL, gotToken)
+	}
+	public := &GitRepository{Owner: "apolo96", Name: "gitfresh", Provider: "github.com"}
+	if err := svc.CreateGitServerHook(public, config); err != nil {
+		t.Fatalf("GitServerSvc.CreateGitServerHook() error = %v", err)
+	}
+	if gotURL != "https://api.github.com/repos/apolo96/gitfresh/hooks" || gotToken != "Bearer ghp-public" {
+		t.Errorf("GitServerSvc.CreateGitServerHook() requested %s with %s", gotURL, gotToken)
+	}
+	if got := svc.HooksPageURL(repo, config); got != "https://ghe.company.com/platform/api/settings/hooks" {
+		t.Errorf("GitServerSvc.HooksPageURL() = %s", got)
+	}
+	providers := svc.Providers(config)
+	req, _ := http.NewRequest("POST", "/", strings.NewReader(""))
+	req.Header.Set("X-GitHub-Event", "push")
+	req.Header.Set("X-GitHub-Enterprise-Host", "ghe.company.com")
+	if providers[0].IsDelivery(req, nil) || !providers[1].IsDelivery(req, nil) {
+		t.Error("enterprise delivery should only match the ghe.company.com provider")
+	}
+}
+
+func TestWorkspace(t *testing.T) {
+	config := &AppConfig{
+		GitServerToken: "ghp-personal",
+		GitWorkDir:     "/home/lio/oss",
+		GitHookSecret:  "s3cr3t",
+		Workspaces: []WorkspaceConfig{
+			{
+				Name:           "work",
+				GitWorkDir:     "/home/lio/work",
+				GitScanDepth:   2,
+				GitServerToken: "ghp-work",
+				GitServers:     []GitServerConfig{{Kind: GIT_PROVIDER_GITHUB, Host: "ghe.company.com", Token: "ghp-ghe"}},
+			},
+		},
+	}
+	if got := WorkspaceNames(config); !cmp.Equal(got, []string{"default", "work"}) {
+		t.Errorf("WorkspaceNames() = %v", got)
+	}
+	def, err := Workspace(config, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if def.GitWorkDir != "/home/lio/oss" || def.GitServerToken != "ghp-personal" || def.Workspaces != nil {
+		t.Errorf("Workspace(default) = %+v", def)
+	}
+	work, err := Workspace(config, "work")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &AppConfig{
+		GitServerToken: "ghp-work",
+		GitWorkDir:     "/home/lio/work",
+		GitScanDepth:   2,
+		GitHookSecret:  "s3cr3t",
+		GitServers:     []GitServerConfig{{Kind: GIT_PROVIDER_GITHUB, Host: "ghe.company.com", Token: "ghp-ghe"}},
+	}
+	if diff := cmp.Diff(work, want); diff != "" {
+		t.Error("Workspace(work) = ", diff)
+	}
+	if _, err := Workspace(config, "missing"); err == nil {
+		t.Error("Workspace(missing) should fail")
+	}
+	if RepositoriesFileName("work") != "repositories-work.json" || RepositoriesFileName("") != APP_REPOS_FILE_NAME {
+		t.Error("RepositoriesFileName() should keep the default registry name")
+	}
+}
+
+func TestMatchRepositories(t *testing.T) {
+	repos := []*GitRepository{
+		{Owner: "apolo96", Name: "gitfresh", Path: "/code/gitfresh"},
+		{Owner: "upstream", Name: "gitfresh", Provider: "github.com", Path: "/code/upstream/gitfresh"},
+		{Owner: "upstream", Name: "gitfresh", Provider: "github.com", Path: "/code/review/gitfresh"},
+		{Owner: "upstream", Name: "gitfresh", Provider: "ghe.company.com", Path: "/work/gitfresh"},
+	}
+	tests := []struct {
+		name     string
+		provider string
+		fullName string
+		want     []string
+	}{
+		{"fork and upstream do not collide", "github.com", "apolo96/gitfresh", []string{"/code/gitfresh"}},
+		{"every clone is returned ignoring case", "github.com", "Upstream/GitFresh", []string{"/code/upstream/gitfresh", "/code/review/gitfresh"}},
+		{"same owner/name on another host", "ghe.company.com", "upstream/gitfresh", []string{"/work/gitfresh"}},
+		{"not registered", "github.com", "someone/else", []string{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := []string{}
+			for _, r := range MatchRepositories(repos, tt.provider, tt.fullName) {
+				got = append(got, r.Path)
+			}
+			if diff := cmp.Diff(got, tt.want); diff != "" {
+				t.Error("MatchRepositories() = ", diff)
+			}
+		})
+	}
+}
+
+func TestGitRepositorySvc_Pull(t *testing.T) {
+	tests := []struct {
+		name     string
+		ref      string
+		branch   string
+		strategy string
+		refs     []string
+		files    []string
+		gitDir   string
+		dirty    bool
+		ffError  bool
+		want     []string
+		wantErr  error
+	}{
+		{
+			name:   "pushed branch is checked out",
+			ref:    "refs/heads/main",
+			branch: "main",
+			want:   []string{"rev-parse --git-dir", "rev-parse --abbrev-ref HEAD", "pull --ff-only origin main"},
+		},
+		{
+			name:   "local branch is fast-forwarded",
+			ref:    "refs/heads/feature",
+			branch: "main",
+			refs:   []string{"refs/heads/feature"},
+			want: []string{
+				"rev-parse --git-dir",
+				"rev-parse --abbrev-ref HEAD",
+				"rev-parse --verify --quiet refs/heads/feature",
+				"fetch origin feature:feature",
+			},
+		},
+		{
+			name:    "diverged local branch only updates the remote-tracking ref",
+			ref:     "refs/heads/feature",
+			branch:  "main",
+			refs:    []string{"refs/heads/feature"},
+			ffError: true,
+			want: []string{
+				"rev-parse --git-dir",
+				"rev-parse --abbrev-ref HEAD",
+				"rev-parse --verify --quiet refs/heads/feature",
+				"fetch origin feature:feature",
+				"fetch origin feature",
+			},
+		},
+		{
+			name:   "branch without local copy",
+			ref:    "refs/heads/feature",
+			branch: "main",
+			want: []string{
+				"rev-parse --git-dir",
+				"rev-parse --abbrev-ref HEAD",
+				"rev-parse --verify --quiet refs/heads/feature",
+				"fetch origin feature",
+			},
+		},
+		{
+			name:   "tags are ignored",
+			ref:    "refs/tags/v1.0.0",
+			branch: "main",
+			want:   []string{},
+		},
+		{
+			name:     "skip if dirty with uncommitted changes",
+			ref:      "refs/heads/main",
+			branch:   "main",
+			strategy: GIT_STRATEGY_SKIP_DIRTY,
+			dirty:    true,
+			want: []string{
+				"rev-parse --git-dir",
+				"rev-parse --abbrev-ref HEAD",
+				"status --porcelain --untracked-files=no",
+				"fetch origin main",
+			},
+			wantErr: ErrUpdateSkipped,
+		},
+		{
+			name:     "skip if dirty with a clean tree",
+			ref:      "refs/heads/main",
+			branch:   "main",
+			strategy: GIT_STRATEGY_SKIP_DIRTY,
+			want: []string{
+				"rev-parse --git-dir",
+				"rev-parse --abbrev-ref HEAD",
+				"status --porcelain --untracked-files=no",
+				"pull --ff-only origin main",
+			},
+		},
+		{
+			name:     "autostash and rebase",
+			ref:      "refs/heads/main",
+			branch:   "main",
+			strategy: GIT_STRATEGY_AUTOSTASH,
+			dirty:    true,
+			want:     []string{"rev-parse --git-dir", "rev-parse --abbrev-ref HEAD", "pull --rebase --autostash origin main"},
+		},
+		{
+			name:     "fetch only",
+			ref:      "refs/heads/main",
+			branch:   "main",
+			strategy: GIT_STRATEGY_FETCH_ONLY,
+			want:     []string{"fetch origin main"},
+		},
+		{
+			name:     "rebase in progress",
+			ref:      "refs/heads/main",
+			branch:   "HEAD",
+			strategy: GIT_STRATEGY_AUTOSTASH,
+			files:    []string{"rebase-merge/head-name"},
+			want:     []string{"rev-parse --git-dir", "fetch origin main"},
+			wantErr:  ErrUpdateSkipped,
+		},
+		{
+			name:    "merge in progress",
+			ref:     "refs/heads/main",
+			branch:  "main",
+			files:   []string{"MERGE_HEAD"},
+			want:    []string{"rev-parse --git-dir", "fetch origin main"},
+			wantErr: ErrUpdateSkipped,
+		},
+		{
+			/* A linked worktree has a .git file pointing to its git dir in the main clone */
+			name:    "merge in progress in a linked worktree",
+			ref:     "refs/heads/main",
+			branch:  "main",
+			files:   []string{"MERGE_HEAD"},
+			gitDir:  "/code/gitfresh-main/.git/worktrees/gitfresh",
+			want:    []string{"rev-parse --git-dir", "fetch origin main"},
+			wantErr: ErrUpdateSkipped,
+		},
+		{
+			name:    "detached HEAD",
+			ref:     "refs/heads/main",
+			branch:  "HEAD",
+			refs:    []string{"refs/heads/main"},
+			want:    []string{"rev-parse --git-dir", "rev-parse --abbrev-ref HEAD", "rev-parse --verify --quiet refs/heads/main", "fetch origin main:main"},
+			wantErr: ErrUpdateSkipped,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := []string{}
+			appOS := &MockAppOS{
+				RunFunc: func(path string, workdir string, args ...string) ([]byte, error) {
+					if workdir != "/code/gitfresh" {
+						t.Errorf("git run in %s", workdir)
+					}
+					cmd := strings.Join(args, " ")
+					got = append(got, cmd)
+					switch {
+					case cmd == "rev-parse --git-dir" && tt.gitDir != "":
+						return []byte(tt.gitDir + "\n"), nil
+					case cmd == "rev-parse --git-dir":
+						return []byte(".git\n"), nil
+					case cmd == "rev-parse --abbrev-ref HEAD":
+						return []byte(tt.branch + "\n"), nil
+					case strings.HasPrefix(cmd, "rev-parse --verify") && !slices.Contains(tt.refs, args[3]):
+						return nil, errors.New("exit status 1")
+					case strings.HasPrefix(cmd, "status") && tt.dirty:
+						return []byte(" M services.go\n"), nil
+					case strings.Contains(cmd, ":") && tt.ffError:
+						return []byte("! [rejected] feature -> feature (non-fast-forward)"), errors.New("exit status 1")
+					}
+					return nil, nil
+				},
+				LookFunc: mockAppOS.LookFunc,
+				DirFSFunc: func(path string) fs.FS {
+					fsys := fstest.MapFS{"HEAD": &fstest.MapFile{}}
+					gitDir := tt.gitDir
+					if gitDir == "" {
+						gitDir = "/code/gitfresh/.git"
+					}
+					if path != gitDir {
+						return fstest.MapFS{}
+					}
+					for _, f := range tt.files {
+						fsys[f] = &fstest.MapFile{}
+					}
+					return fsys
+				},
+			}
+			gr := NewGitRepositorySvc(slog.Default(), appOS, tfileStoreRepo)
+			repo := &GitRepository{Owner: "apolo96", Name: "gitfresh", Path: "/code/gitfresh", Strategy: tt.strategy}
+			if _, err := gr.Pull(repo, tt.ref); !errors.Is(err, tt.wantErr) {
+				t.Fatalf("GitRepositorySvc.Pull() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if diff := cmp.Diff(got, tt.want); diff != "" {
+				t.Error("GitRepositorySvc.Pull() git commands = ", diff)
+			}
+		})
+	}
+}
+
+func TestUpdateSvc_Record(t *testing.T) {
+	var saved []byte
+	fileStore := &MockFlatFile{
+		WriteFunc: func(data []byte) (n int, err error) {
+			saved = data
+			return len(data), nil
+		},
+		ReadFunc: func() (n []byte, err error) {
+			if saved == nil {
+				return nil, os.ErrNotExist
+			}
+			return saved, nil
+		},
+	}
+	svc := NewUpdateSvc(slog.Default(), fileStore)
+	repo := &GitRepository{Owner: "apolo96", Name: "gitfresh", Path: "/code/gitfresh"}
+	other := &GitRepository{Owner: "apolo96", Name: "api", Path: "/code/api"}
+	if err := svc.Record(repo, "refs/heads/main", fmt.Errorf("%w: uncommitted changes", ErrUpdateSkipped)); err != nil {
+		t.Fatal(err)
+	}
+	if err := svc.Record(other, "refs/heads/main", errors.New("exit status 128")); err != nil {
+		t.Fatal(err)
+	}
+	if err := svc.Record(repo, "refs/heads/main", nil); err != nil {
+		t.Fatal(err)
+	}
+	updates, err := svc.Updates()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := []string{}
+	for _, u := range updates {
+		got = append(got, strings.Join([]string{u.Path, u.Branch, u.Status, u.Reason}, "|"))
+	}
+	want := []string{
+		"/code/api|main|failed|exit status 128",
+		"/code/gitfresh|main|updated|",
+	}
+	if diff := cmp.Diff(got, want); diff != "" {
+		t.Error("UpdateSvc.Updates() = ", diff)
+	}
+}
+
+func TestAgentSvc_Refresh(t *testing.T) {
+	stream := `{"Repository":"apolo96/gitfresh","Branch":"main","Status":"queued"}
+{"Repository":"apolo96/gitfresh","Branch":"main","Status":"skipped","Reason":"uncommitted changes"}
+`
+	var sent RefreshRequest
+	client := &MockClient{DoFunc: func(req *http.Request) (*http.Response, error) {
+		json.NewDecoder(req.Body).Decode(&sent)
+		return &http.Response{StatusCode: http.StatusOK, Body: io.NopCloser(strings.NewReader(stream))}, nil
+	}}
+	svc := NewAgentSvc(slog.Default(), mockAppOS, &MockFlatFile{}, client)
+	events := []RefreshEvent{}
+	err := svc.Refresh(RefreshRequest{Repositories: []string{"gitfresh"}}, func(event RefreshEvent) {
+		events = append(events, event)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []RefreshEvent{
+		{Repository: "apolo96/gitfresh", Branch: "main", Status: REFRESH_QUEUED},
+		{Repository: "apolo96/gitfresh", Branch: "main", Status: UPDATE_STATUS_SKIPPED, Reason: "uncommitted changes"},
+	}
+	if diff := cmp.Diff(events, want); diff != "" {
+		t.Error("AgentSvc.Refresh() events = ", diff)
+	}
+	if diff := cmp.Diff(sent.Repositories, []string{"gitfresh"}); diff != "" {
+		t.Error("AgentSvc.Refresh() request = ", diff)
+	}
+}
+
+func TestGitServerSvc_RedeliverFailed(t *testing.T) {
+	now := time.Now().UTC()
+	deliveries := fmt.Sprintf(`[
+		{"id":5,"guid":"g3","delivered_at":"%[1]s","status_code":502,"event":"push"},
+		{"id":4,"guid":"g2","delivered_at":"%[1]s","status_code":200,"event":"push"},
+		{"id":3,"guid":"g2","delivered_at":"%[2]s","status_code":0,"event":"push"},
+		{"id":2,"guid":"g1","delivered_at":"%[3]s","status_code":502,"event":"push"},
+		{"id":1,"guid":"g0","delivered_at":"%[1]s","status_code":200,"event":"ping"}
+	]`, now.Format(time.RFC3339), now.Add(-time.Minute).Format(time.RFC3339), now.Add(-time.Hour*5).Format(time.RFC3339))
+	redelivered := []string{}
+	client := &MockClient{DoFunc: func(req *http.Request) (*http.Response, error) {
+		body := ""
+		switch {
+		case req.Method == "GET" && req.URL.Path == "/repos/apolo96/gitfresh/hooks":
+			body = `[{"id":7,"config":{"url":"https://old.ngrok.app"}},{"id":9,"config":{"url":"https://fresh.ngrok.app"}}]`
+		case req.Method == "GET" && req.URL.Path == "/repos/apolo96/gitfresh/hooks/9/deliveries":
+			body = deliveries
+		case req.Method == "POST":
+			redelivered = append(redelivered, req.URL.Path)
+			return &http.Response{StatusCode: http.StatusAccepted, Body: io.NopCloser(strings.NewReader("{}"))}, nil
+		default:
+			return &http.Response{StatusCode: http.StatusNotFound, Status: "404 Not Found", Body: io.NopCloser(strings.NewReader(""))}, nil
+		}
+		return &http.Response{StatusCode: http.StatusOK, Body: io.NopCloser(strings.NewReader(body))}, nil
+	}}
+	svc := NewGitServerSvc(slog.Default(), client)
+	config := &AppConfig{GitServerToken: "ghp", TunnelDomain: "fresh.ngrok.app"}
+	repo := &GitRepository{Owner: "apolo96", Name: "gitfresh", Provider: APP_GIT_PROVIDER}
+	n, err := svc.RedeliverFailed(repo, now.Add(-time.Hour), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	/* g2 succeeded on a later attempt and g1 failed before the window */
+	want := []string{"/repos/apolo96/gitfresh/hooks/9/deliveries/5/attempts"}
+	if diff := cmp.Diff(redelivered, want); diff != "" || n != 1 {
+		t.Errorf("GitServerSvc.RedeliverFailed() = %d, %s", n, diff)
+	}
+	config.TunnelDomain = "gone.ngrok.app"
+	if _, err := svc.RedeliverFailed(repo, now.Add(-time.Hour), config); err == nil {
+		t.Error("GitServerSvc.RedeliverFailed() without our hook, want an error")
+	}
+}
+
+func TestGitServerSvc_OwnHooks(t *testing.T) {
+	calls := []string{}
+	client := &MockClient{DoFunc: func(req *http.Request) (*http.Response, error) {
+		calls = append(calls, req.Method+" "+req.URL.Path)
+		switch req.Method {
+		case "GET":
+			body := `[
+				{"id":1,"active":true,"config":{"url":"https://old.ngrok.app/?gitfresh=a1b2c3"}},
+				{"id":2,"active":true,"config":{"url":"https://teammate.ngrok.app/?gitfresh=ffffff"}},
+				{"id":3,"active":false,"config":{"url":"https://fresh.ngrok.app/"}},
+				{"id":4,"active":true,"config":{"url":"https://ci.example.com/hook"}},
+				{"id":5,"active":true,"config":{"url":"https://gone.ngrok.app"}},
+				{"id":6,"active":true,"config":{"url":"https://gone.ngrok.app/?gitfresh=ffffff"}}
+			]`
+			return &http.Response{StatusCode: http.StatusOK, Body: io.NopCloser(strings.NewReader(body))}, nil
+		case "PATCH":
+			hook := map[string]any{}
+			json.NewDecoder(req.Body).Decode(&hook)
+			config, _ := hook["config"].(map[string]any)
+			if config["url"] != "https://fresh.ngrok.app/?gitfresh=a1b2c3" || config["secret"] != "s3cr3t" {
+				t.Errorf("GitServerSvc.UpdateGitServerHook() sent %v", hook)
+			}
+			return &http.Response{StatusCode: http.StatusOK, Body: io.NopCloser(strings.NewReader("{}"))}, nil
+		case "DELETE":
+			return &http.Response{StatusCode: http.StatusNoContent, Body: io.NopCloser(strings.NewReader(""))}, nil
+		}
+		return &http.Response{StatusCode: http.StatusNotFound, Status: "404 Not Found", Body: io.NopCloser(strings.NewReader(""))}, nil
+	}}
+	svc := NewGitServerSvc(slog.Default(), client)
+	config := &AppConfig{
+		GitServerToken:       "ghp",
+		TunnelDomain:         "fresh.ngrok.app",
+		PreviousTunnelDomain: "https://gone.ngrok.app",
+		GitHookSecret:        "s3cr3t",
+		InstallID:            "a1b2c3",
+	}
+	repo := &GitRepository{Owner: "apolo96", Name: "gitfresh", Provider: APP_GIT_PROVIDER}
+	if got := svc.HookURL(config); got != "https://fresh.ngrok.app/?gitfresh=a1b2c3" {
+		t.Errorf("GitServerSvc.HookURL() = %s", got)
+	}
+	hooks, err := svc.OwnHooks(repo, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	/* The hooks of the teammates and other services are left alone, the one of an older version is found by its domain */
+	ids := []string{}
+	for _, h := range hooks {
+		ids = append(ids, h.ID)
+	}
+	if diff := cmp.Diff(ids, []string{"1", "3", "5"}); diff != "" {
+		t.Error("GitServerSvc.OwnHooks() = ", diff)
+	}
+	if err := svc.UpdateGitServerHook(repo, hooks[0], config); err != nil {
+		t.Error(err)
+	}
+	if err := svc.DeleteGitServerHook(repo, hooks[1], config); err != nil {
+		t.Error(err)
+	}
+	want := []string{"GET /repos/apolo96/gitfresh/hooks", "PATCH /repos/apolo96/gitfresh/hooks/1", "DELETE /repos/apolo96/gitfresh/hooks/3"}
+	if diff := cmp.Diff(calls, want); diff != "" {
+		t.Error("GitServerSvc hooks calls = ", diff)
+	}
+}
+
+func TestGitServerSvc_DeleteGitServerHook_Gitea(t *testing.T) {
+	hooks := map[string]string{"1": "https://fresh.tunnel.app/?gitfresh=a1b2c3", "2": "https://other.tunnel.app/"}
+	forge := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == "GET" && r.URL.Path == "/api/v1/repos/team/api/hooks":
+			list := []map[string]any{}
+			for id, hookURL := range hooks {
+				n, _ := strconv.Atoi(id)
+				list = append(list, map[string]any{"id": n, "active": true, "config": map[string]string{"url": hookURL}})
+			}
+			json.NewEncoder(w).Encode(list)
+		case r.Method == "DELETE" && strings.HasPrefix(r.URL.Path, "/api/v1/repos/team/api/hooks/"):
+			delete(hooks, strings.TrimPrefix(r.URL.Path, "/api/v1/repos/team/api/hooks/"))
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer forge.Close()
+	svc := NewGitServerSvc(slog.Default(), forge.Client())
+	u, _ := url.Parse(forge.URL)
+	repo := &GitRepository{Owner: "team", Name: "api", Provider: u.Hostname()}
+	config := &AppConfig{GiteaURL: forge.URL, GiteaToken: "gitea-token", TunnelDomain: "new.tunnel.app", InstallID: "a1b2c3"}
+	own, err := svc.OwnHooks(repo, config)
+	if err != nil || len(own) != 1 {
+		t.Fatalf("GitServerSvc.OwnHooks() = %v, %v", own, err)
+	}
+	if err := svc.DeleteGitServerHook(repo, own[0], config); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := hooks["2"]; !ok || len(hooks) != 1 {
+		t.Errorf("GitServerSvc.DeleteGitServerHook() left %v", hooks)
+	}
+}
+
+func TestGitServerSvc_SyncGitServerHook(t *testing.T) {
+	listed := ""
+	calls := []string{}
+	client := &MockClient{DoFunc: func(req *http.Request) (*http.Response, error) {
+		if req.Method == "GET" {
+			return &http.Response{StatusCode: http.StatusOK, Body: io.NopCloser(strings.NewReader(listed))}, nil
+		}
+		calls = append(calls, req.Method+" "+req.URL.Path)
+		status := map[string]int{"POST": http.StatusCreated, "PATCH": http.StatusOK, "DELETE": http.StatusNoContent}[req.Method]
+		return &http.Response{StatusCode: status, Body: io.NopCloser(strings.NewReader("{}"))}, nil
+	}}
+	svc := NewGitServerSvc(slog.Default(), client)
+	config := &AppConfig{GitServerToken: "ghp", TunnelDomain: "https://b2.ngrok-free.app", InstallID: "a1b2c3"}
+	repo := &GitRepository{Owner: "apolo96", Name: "gitfresh", Provider: APP_GIT_PROVIDER}
+	tests := []struct {
+		name   string
+		hooks  string
+		status string
+		calls  []string
+	}{
+		{
+			name:   "tunnel changed",
+			hooks:  `[{"id":1,"active":true,"config":{"url":"https://a1.ngrok-free.app/?gitfresh=a1b2c3"}}]`,
+			status: HOOK_UPDATED,
+			calls:  []string{"PATCH /repos/apolo96/gitfresh/hooks/1"},
+		},
+		{
+			name: "duplicated",
+			hooks: `[{"id":1,"active":true,"config":{"url":"https://a1.ngrok-free.app/?gitfresh=a1b2c3"}},
+				{"id":2,"active":true,"config":{"url":"https://b2.ngrok-free.app/?gitfresh=a1b2c3"}}]`,
+			status: HOOK_UPDATED,
+			calls:  []string{"DELETE /repos/apolo96/gitfresh/hooks/1", "PATCH /repos/apolo96/gitfresh/hooks/2"},
+		},
+		{
+			name:   "missing",
+			hooks:  `[{"id":3,"active":true,"config":{"url":"https://ci.example.com/hook"}}]`,
+			status: HOOK_CREATED,
+			calls:  []string{"POST /repos/apolo96/gitfresh/hooks"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			listed, calls = tt.hooks, []string{}
+			status, err := svc.SyncGitServerHook(repo, config)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if status != tt.status {
+				t.Errorf("GitServerSvc.SyncGitServerHook() = %s, want %s", status, tt.status)
+			}
+			if diff := cmp.Diff(calls, tt.calls); diff != "" {
+				t.Error("GitServerSvc.SyncGitServerHook() calls = ", diff)
+			}
+		})
+	}
+}
+
+func TestGitServerSvc_ParseWebhook_PreviousSecret(t *testing.T) {
+	push := `{"ref":"refs/heads/main","after":"9a8b7c6d","repository":{"name":"gitfresh","full_name":"apolo96/gitfresh"}}`
+	sign := func(secret string) string {
+		mac := hmac.New(sha256.New, []byte(secret))
+		mac.Write([]byte(push))
+		return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+	}
+	svc := NewGitServerSvc(slog.Default(), &MockClient{})
+	tests := []struct {
+		name    string
+		secret  string
+		until   time.Time
+		wantErr error
+	}{
+		{name: "new secret", secret: "n3w", until: time.Now().Add(time.Hour)},
+		{name: "previous secret in the grace window", secret: "0ld", until: time.Now().Add(time.Hour)},
+		{name: "previous secret retired", secret: "0ld", until: time.Now().Add(-time.Second), wantErr: ErrInvalidSignature},
+		{name: "unknown secret", secret: "guess", until: time.Now().Add(time.Hour), wantErr: ErrInvalidSignature},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := &AppConfig{
+				GitServerToken:     "ghp",
+				GitHookSecret:      "n3w",
+				PreviousHookSecret: &RetiringSecret{Secret: "0ld", Until: tt.until},
+			}
+			r, _ := http.NewRequest("POST", "/", strings.NewReader(push))
+			r.Header.Set("X-GitHub-Event", "push")
+			r.Header.Set("X-Hub-Signature-256", sign(tt.secret))
+			_, err := svc.ParseWebhook(r, config)
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("GitServerSvc.ParseWebhook() error = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestEdgeVerifiesGitHub(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		name   string
+		config *AppConfig
+		want   bool
+	}{
+		{name: "github.com only", config: &AppConfig{GitServerToken: "ghp", GitHookSecret: "s3cr3t"}, want: true},
+		{name: "gitlab only", config: &AppConfig{GitServers: []GitServerConfig{{Kind: GIT_PROVIDER_GITLAB, Host: "gitlab.company.com", Token: "glpat"}}, GitHookSecret: "s3cr3t"}},
+		{name: "gitea only", config: &AppConfig{GitServers: []GitServerConfig{{Kind: GIT_PROVIDER_GITEA, WebURL: "https://git.company.com", Token: "gitea"}}, GitHookSecret: "s3cr3t"}},
+		{name: "github enterprise only", config: &AppConfig{GitServers: []GitServerConfig{{Kind: GIT_PROVIDER_GITHUB, Host: "ghe.company.com", Token: "ghp"}}, GitHookSecret: "s3cr3t"}},
+		{name: "github and gitlab", config: &AppConfig{GitServerToken: "ghp", GitLabToken: "glpat", GitHookSecret: "s3cr3t"}},
+		{
+			name: "gitlab in a workspace",
+			config: &AppConfig{GitServerToken: "ghp", GitHookSecret: "s3cr3t", Workspaces: []WorkspaceConfig{
+				{Name: "work", GitServers: []GitServerConfig{{Kind: GIT_PROVIDER_GITLAB, Host: "gitlab.company.com", Token: "glpat"}}},
+			}},
+		},
+		{
+			name:   "secret rotation",
+			config: &AppConfig{GitServerToken: "ghp", GitHookSecret: "n3w", PreviousHookSecret: &RetiringSecret{Secret: "0ld", Until: now.Add(time.Hour)}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := EdgeVerifiesGitHub(tt.config, now); got != tt.want {
+				t.Errorf("EdgeVerifiesGitHub() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWebHookSecret(t *testing.T) {
+	a, b := WebHookSecret(), WebHookSecret()
+	if len(a) != 64 || a == b {
+		t.Errorf("WebHookSecret() = %s, %s", a, b)
+	}
+}
+
+func TestGitServerSvc_CheckTokens(t *testing.T) {
+	client := &MockClient{DoFunc: func(req *http.Request) (*http.Response, error) {
+		reply := func(status int, scopes string, body string) (*http.Response, error) {
+			header := http.Header{}
+			if scopes != "" {
+				header.Set("X-OAuth-Scopes", scopes)
+			}
+			return &http.Response{StatusCode: status, Status: fmt.Sprint(status), Header: header, Body: io.NopCloser(strings.NewReader(body))}, nil
+		}
+		switch req.Header.Get("Authorization") + req.Header.Get("PRIVATE-TOKEN") + " " + req.URL.Path {
+		case "Bearer ghp_hooks /user":
+			return reply(http.StatusOK, "repo, read:org", `{"login":"lio"}`)
+		case "Bearer ghp_gist /user":
+			return reply(http.StatusOK, "gist, read:user", `{"login":"lio"}`)
+		case "Bearer github_pat /user":
+			return reply(http.StatusOK, "", `{"login":"lio"}`)
+		case "glpat /api/v4/user":
+			return reply(http.StatusOK, "", `{"username":"lio"}`)
+		case "glpat /api/v4/personal_access_tokens/self":
+			return reply(http.StatusOK, "", `{"scopes":["read_api","read_repository"]}`)
+		}
+		return reply(http.StatusUnauthorized, "", `{"message":"Bad credentials"}`)
+	}}
+	svc := NewGitServerSvc(slog.Default(), client)
+	tests := []struct {
+		name   string
+		config *AppConfig
+		want   []TokenCheck
+	}{
+		{
+			name:   "classic token",
+			config: &AppConfig{GitServerToken: "ghp_hooks"},
+			want:   []TokenCheck{{Host: APP_GIT_PROVIDER, User: "lio"}},
+		},
+		{
+			name:   "missing scope",
+			config: &AppConfig{GitServerToken: "ghp_gist", GitLabToken: "glpat"},
+			want: []TokenCheck{
+				{Host: APP_GIT_PROVIDER, User: "lio", Missing: []string{"admin:repo_hook scope"}},
+				{Host: APP_GITLAB_PROVIDER, User: "lio", Missing: []string{"api scope"}},
+			},
+		},
+		{
+			name:   "fine-grained token",
+			config: &AppConfig{GitServerToken: "github_pat"},
+			want:   []TokenCheck{{Host: APP_GIT_PROVIDER, User: "lio", Note: "fine-grained tokens need the Webhooks read and write permission of the repositories"}},
+		},
+		{
+			name:   "invalid token",
+			config: &AppConfig{GitServerToken: "ghp_revoked"},
+			want:   []TokenCheck{{Host: APP_GIT_PROVIDER, Err: ErrInvalidToken}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := svc.CheckTokens(tt.config)
+			if diff := cmp.Diff(got, tt.want, cmpopts.EquateErrors()); diff != "" {
+				t.Error("GitServerSvc.CheckTokens() = ", diff)
+			}
+		})
+	}
+}
@@ -0,0 +1,21 @@
+package gitfresh
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+)
+
+/* validHMACSHA256 checks a hex encoded HMAC-SHA256 signature of body in constant time */
+func validHMACSHA256(signature string, body []byte, secret string) bool {
+	if signature == "" || secret == "" {
+		return false
+	}
+	got, err := hex.DecodeString(signature)
+	if err != nil {
+		return false
+	}
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hmac.Equal(got, mac.Sum(nil))
+}
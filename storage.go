@@ -11,18 +11,24 @@ type FlatFiler interface {
 	Read() (n []byte, err error)
 }
 
+/* FlatAppender adds records to the end of the file, like the delivery log */
+type FlatAppender interface {
+	FlatFiler
+	Append(data []byte) (n int, err error)
+}
+
 type FlatFile struct {
 	Name string
 	Path string
 }
 
 func (f *FlatFile) Write(data []byte) (n int, err error) {
-	if err := os.MkdirAll(f.Path, os.ModePerm); err != nil {
+	if err := os.MkdirAll(f.Path, 0700); err != nil {
 		slog.Error(err.Error())
 		return 0, err
 	}
 	file := filepath.Join(f.Path, f.Name)
-	err = os.WriteFile(file, data, 0644)
+	err = os.WriteFile(file, data, 0600)
 	if err != nil {
 		slog.Error(err.Error())
 		return 0, err
@@ -40,3 +46,17 @@ func (f *FlatFile) Read() (n []byte, err error) {
 	}
 	return file, nil
 }
+
+func (f *FlatFile) Append(data []byte) (n int, err error) {
+	if err := os.MkdirAll(f.Path, 0700); err != nil {
+		slog.Error(err.Error())
+		return 0, err
+	}
+	file, err := os.OpenFile(filepath.Join(f.Path, f.Name), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		slog.Error(err.Error())
+		return 0, err
+	}
+	defer file.Close()
+	return file.Write(data)
+}
@@ -0,0 +1,42 @@
+package gitfresh
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+var ErrInvalidToken = errors.New("the token is invalid or expired")
+
+/* tokenUser asks who the token of the request belongs to, the headers of the answer tell its scopes */
+func tokenUser(c HttpClienter, req *http.Request, field string) (string, http.Header, error) {
+	resp, err := c.Do(req)
+	if err != nil {
+		return "", nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusUnauthorized {
+		return "", resp.Header, ErrInvalidToken
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", resp.Header, errors.New("requesting " + req.URL.String() + ", response with " + resp.Status)
+	}
+	user := map[string]any{}
+	if err := json.NewDecoder(resp.Body).Decode(&user); err != nil {
+		return "", resp.Header, err
+	}
+	login, _ := user[field].(string)
+	return login, resp.Header, nil
+}
+
+/* hasScope tells if a comma separated list of scopes has any of the wanted ones */
+func hasScope(list string, wanted ...string) bool {
+	for _, scope := range strings.Split(list, ",") {
+		if slices.Contains(wanted, strings.TrimSpace(scope)) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,121 @@
+package gitfresh
+
+import (
+	"errors"
+	"io/fs"
+	"path"
+	"strings"
+)
+
+const (
+	repoKindCheckout  = "checkout"
+	repoKindBare      = "bare"
+	repoKindWorktree  = "worktree"
+	repoKindSubmodule = "submodule"
+)
+
+type SkippedDir struct {
+	Path   string
+	Reason string
+}
+
+/*
+FindRepositories walks the workspace looking for git repositories up to maxDepth
+levels below the root. It never descends into a repository, so nested checkouts
+like submodules or vendored repos are not reported, and it honours the
+.gitfreshignore file placed at the workspace root.
+*/
+func FindRepositories(fsys fs.FS, maxDepth int) ([]string, []SkippedDir, error) {
+	if maxDepth < 1 {
+		maxDepth = APP_SCAN_DEPTH
+	}
+	ignore := &IgnoreMatcher{}
+	if file, err := fsys.Open(APP_IGNORE_FILE); err == nil {
+		ignore, err = NewIgnoreMatcher(file)
+		file.Close()
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	repos := []string{}
+	skipped := []SkippedDir{}
+	err := fs.WalkDir(fsys, ".", func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if p == "." {
+				return err
+			}
+			skipped = append(skipped, SkippedDir{Path: p, Reason: "unreadable: " + err.Error()})
+			return fs.SkipDir
+		}
+		if !d.IsDir() || p == "." {
+			return nil
+		}
+		if d.Name() == ".git" {
+			return fs.SkipDir
+		}
+		if ignore.Match(p, true) {
+			skipped = append(skipped, SkippedDir{Path: p, Reason: "ignored by " + APP_IGNORE_FILE})
+			return fs.SkipDir
+		}
+		switch repositoryKind(fsys, p) {
+		case repoKindCheckout:
+			repos = append(repos, p)
+			return fs.SkipDir
+		case repoKindBare:
+			skipped = append(skipped, SkippedDir{Path: p, Reason: "bare repository without working tree"})
+			return fs.SkipDir
+		case repoKindWorktree:
+			skipped = append(skipped, SkippedDir{Path: p, Reason: "linked worktree, not registered"})
+			return fs.SkipDir
+		case repoKindSubmodule:
+			skipped = append(skipped, SkippedDir{Path: p, Reason: "submodule, refreshed by its parent repository"})
+			return fs.SkipDir
+		}
+		if strings.Count(p, "/")+1 >= maxDepth {
+			skipped = append(skipped, SkippedDir{Path: p, Reason: "not a git repository within the max depth"})
+			return fs.SkipDir
+		}
+		return nil
+	})
+	return repos, skipped, err
+}
+
+func repositoryKind(fsys fs.FS, dir string) string {
+	dotgit := path.Join(dir, ".git")
+	info, err := fs.Stat(fsys, dotgit)
+	if err == nil && info.IsDir() {
+		return repoKindCheckout
+	}
+	if err == nil {
+		/* A .git file points to the real git dir of worktrees and submodules */
+		content, err := fs.ReadFile(fsys, dotgit)
+		if err != nil {
+			return ""
+		}
+		gitdir := strings.TrimSpace(strings.TrimPrefix(string(content), "gitdir:"))
+		if strings.Contains(gitdir, "/worktrees/") {
+			return repoKindWorktree
+		}
+		if strings.Contains(gitdir, "/modules/") {
+			return repoKindSubmodule
+		}
+		return repoKindCheckout
+	}
+	if !errors.Is(err, fs.ErrNotExist) {
+		return ""
+	}
+	if isFile(fsys, path.Join(dir, "HEAD")) && isDir(fsys, path.Join(dir, "objects")) && isDir(fsys, path.Join(dir, "refs")) {
+		return repoKindBare
+	}
+	return ""
+}
+
+func isFile(fsys fs.FS, name string) bool {
+	info, err := fs.Stat(fsys, name)
+	return err == nil && !info.IsDir()
+}
+
+func isDir(fsys fs.FS, name string) bool {
+	info, err := fs.Stat(fsys, name)
+	return err == nil && info.IsDir()
+}
@@ -0,0 +1,101 @@
+package gitfresh
+
+import (
+	"strings"
+	"testing"
+	"testing/fstest"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestFindRepositories(t *testing.T) {
+	fsys := fstest.MapFS{
+		APP_IGNORE_FILE: &fstest.MapFile{Data: []byte(strings.Join([]string{
+			"# dependencies and old clients",
+			"node_modules/",
+			"/archived/",
+			"acme/legacy-*",
+			"!acme/legacy-keep",
+		}, "\n"))},
+		"gitfresh/.git/HEAD":                      &fstest.MapFile{},
+		"gitfresh/vendor/lib/.git/HEAD":           &fstest.MapFile{},
+		"acme/api/.git/HEAD":                      &fstest.MapFile{},
+		"acme/api-feature/.git":                   &fstest.MapFile{Data: []byte("gitdir: /code/acme/api/.git/worktrees/api-feature\n")},
+		"acme/legacy-crm/.git/HEAD":               &fstest.MapFile{},
+		"acme/legacy-keep/.git/HEAD":              &fstest.MapFile{},
+		"acme/web/node_modules/pkg/.git/HEAD":     &fstest.MapFile{},
+		"acme/web/.git/HEAD":                      &fstest.MapFile{},
+		"acme/mirror.git/HEAD":                    &fstest.MapFile{},
+		"acme/mirror.git/objects/pack/p":          &fstest.MapFile{},
+		"acme/mirror.git/refs/heads/main":         &fstest.MapFile{},
+		"archived/old/.git/HEAD":                  &fstest.MapFile{},
+		"node_modules/tool/.git/HEAD":             &fstest.MapFile{},
+		"notes/2024/drafts/readme.md":             &fstest.MapFile{},
+		"clients/deep/nested/too/far/.git/HEAD":   &fstest.MapFile{},
+		"clients/deep/nested/too/far/.git/config": &fstest.MapFile{},
+	}
+	repos, skipped, err := FindRepositories(fsys, 3)
+	if err != nil {
+		t.Fatalf("FindRepositories() error = %v", err)
+	}
+	wantRepos := []string{"acme/api", "acme/legacy-keep", "acme/web", "gitfresh"}
+	if diff := cmp.Diff(repos, wantRepos); diff != "" {
+		t.Error("FindRepositories() repos = ", diff)
+	}
+	wantSkipped := []SkippedDir{
+		{Path: "acme/api-feature", Reason: "linked worktree, not registered"},
+		{Path: "acme/legacy-crm", Reason: "ignored by .gitfreshignore"},
+		{Path: "acme/mirror.git", Reason: "bare repository without working tree"},
+		{Path: "archived", Reason: "ignored by .gitfreshignore"},
+		{Path: "clients/deep/nested", Reason: "not a git repository within the max depth"},
+		{Path: "node_modules", Reason: "ignored by .gitfreshignore"},
+		{Path: "notes/2024/drafts", Reason: "not a git repository within the max depth"},
+	}
+	if diff := cmp.Diff(skipped, wantSkipped); diff != "" {
+		t.Error("FindRepositories() skipped = ", diff)
+	}
+}
+
+func TestIgnoreMatcher_Match(t *testing.T) {
+	rules := strings.Join([]string{
+		"*.bak",
+		"build/",
+		"/tmp",
+		"docs/**/drafts",
+		"clients/*/old",
+		"!clients/acme/old",
+		"\\#hash",
+		"repo-[0-9]",
+	}, "\n")
+	m, err := NewIgnoreMatcher(strings.NewReader(rules))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		path  string
+		isDir bool
+		want  bool
+	}{
+		{"site.bak", true, true},
+		{"a/b/site.bak", true, true},
+		{"build", true, true},
+		{"src/build", true, true},
+		{"build", false, false},
+		{"tmp", true, true},
+		{"src/tmp", true, false},
+		{"docs/drafts", true, true},
+		{"docs/a/b/drafts", true, true},
+		{"clients/globex/old", true, true},
+		{"clients/acme/old", true, false},
+		{"clients/globex/x/old", true, false},
+		{"#hash", true, true},
+		{"repo-7", true, true},
+		{"repo-x", true, false},
+		{"gitfresh", true, false},
+	}
+	for _, tt := range tests {
+		if got := m.Match(tt.path, tt.isDir); got != tt.want {
+			t.Errorf("IgnoreMatcher.Match(%q, %v) = %v, want %v", tt.path, tt.isDir, got, tt.want)
+		}
+	}
+}